@@ -5,13 +5,14 @@ go 1.23.0
 require (
 	github.com/aws/aws-sdk-go-v2/config v1.27.37
 	github.com/golang-jwt/jwt/v4 v4.5.0
+	github.com/gorilla/mux v1.8.1
 	golang.org/x/crypto v0.26.0
 )
 
 require (
 	github.com/aws/aws-sdk-go-v2/service/dynamodbstreams v1.23.1 // indirect
 	github.com/aws/aws-sdk-go-v2/service/internal/endpoint-discovery v1.9.19 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
+	golang.org/x/sys v0.23.0 // indirect
 )
 
 require (
@@ -2,28 +2,80 @@ package app
 
 import (
 	"context"
+	"fmt"
 	"log"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/joho/godotenv"
+	"github.com/tabichanorg/tabichan-server/internal/config"
 	"github.com/tabichanorg/tabichan-server/internal/db"
+	middleware "github.com/tabichanorg/tabichan-server/internal/middleware/session"
+	"github.com/tabichanorg/tabichan-server/internal/oauth"
 	"github.com/tabichanorg/tabichan-server/internal/server"
+	"github.com/tabichanorg/tabichan-server/internal/trip"
+	"github.com/tabichanorg/tabichan-server/internal/user"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+	"github.com/tabichanorg/tabichan-server/internal/webauthn"
 )
 
 func InitializeApp() (*server.Server, error) {
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		log.Printf("No .env file loaded: %v", err)
 	}
 
-	db.InitDynamoDB()
-	verifyDynamoDBConnection(db.DynamoClient)
+	cfg := config.Load()
 
-	srv := server.NewServer("localhost:8080")
+	repos, err := initRepositories(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := utils.LoadJWTKeySet(cfg.JWTKeysDir, cfg.JWTSigningKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := server.NewServer(cfg, repos, tokens)
 
 	return srv, nil
 }
 
+func initRepositories(cfg *config.Config) (*server.Repositories, error) {
+	switch cfg.Storage {
+	case config.StorageDynamoDB:
+		db.InitDynamoDB()
+		verifyDynamoDBConnection(db.DynamoClient)
+		for _, table := range []string{"Sessions", "RevokedTokens", "RefreshTokens", "OAuthStates", "PasswordResetTokens", "MFAChallenges", "WebAuthnChallenges", "LoginAttempts"} {
+			if err := db.EnableTTL(db.DynamoClient, table, "ExpiresAtTTL"); err != nil {
+				log.Printf("Expired rows in %s won't be cleaned up automatically: %v", table, err)
+			}
+		}
+
+		return &server.Repositories{
+			Trip:       &trip.DynamoTripRepository{Client: db.DynamoClient},
+			User:       &user.DynamoUserRepository{Client: db.DynamoClient},
+			Middleware: &middleware.DynamoMiddlewareRepository{Client: db.DynamoClient},
+			OAuth:      &oauth.DynamoOAuthRepository{Client: db.DynamoClient},
+			WebAuthn:   &webauthn.DynamoWebAuthnRepository{Client: db.DynamoClient},
+		}, nil
+	case config.StorageMemory:
+		log.Println("Using in-memory storage, data will not persist between restarts")
+		sessions := db.NewMemoryTable[utils.Session]()
+		revokedTokens := db.NewMemoryTable[utils.RevokedToken]()
+
+		return &server.Repositories{
+			Trip:       trip.NewMemoryTripRepository(),
+			User:       user.NewMemoryUserRepository(sessions, revokedTokens),
+			Middleware: middleware.NewMemoryMiddlewareRepository(sessions, revokedTokens),
+			OAuth:      oauth.NewMemoryOAuthRepository(),
+			WebAuthn:   webauthn.NewMemoryWebAuthnRepository(),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+	}
+}
+
 func verifyDynamoDBConnection(client *dynamodb.Client) {
 	result, err := client.ListTables(context.TODO(), &dynamodb.ListTablesInput{})
 	if err != nil {
@@ -1 +1,209 @@
 package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	StorageDynamoDB = "dynamodb"
+	StorageMemory   = "memory"
+
+	MailerLog  = "log"
+	MailerFile = "file"
+	MailerSMTP = "smtp"
+
+	HasherArgon2id = "argon2id"
+	HasherBcrypt   = "bcrypt"
+)
+
+// OAuthProviderConfig configures a login provider, which is only enabled
+// when ClientID is set. URL and APIURL default to the real provider and can
+// point at a stub instead.
+type OAuthProviderConfig struct {
+	ClientID     string
+	ClientSecret string
+	URL          string
+	APIURL       string
+}
+
+// MailConfig picks how emails are delivered: MailerLog writes them to the
+// server log, MailerFile to .eml files in Dir and MailerSMTP sends them
+// through SMTPAddr.
+type MailConfig struct {
+	Mailer       string
+	From         string
+	Dir          string
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// PasswordConfig picks the hasher new passwords are stored with and its
+// parameters, Argon2Memory being in KiB, and the policy they have to meet.
+// BreachedFile lists passwords that are never accepted, one per line.
+type PasswordConfig struct {
+	Hasher        string
+	BcryptCost    int
+	Argon2Time    int
+	Argon2Memory  int
+	Argon2Threads int
+	MinLength     int
+	BreachedFile  string
+}
+
+// WebAuthnConfig holds Origins as a comma separated list.
+type WebAuthnConfig struct {
+	RPID    string
+	RPName  string
+	Origins string
+}
+
+type Config struct {
+	Addr         string
+	Storage      string
+	CursorSecret string
+
+	// JWTKeysDir holds the PEM keys access tokens are signed and verified
+	// with, and JWTSigningKeyID names the one new tokens are signed with.
+	JWTKeysDir      string
+	JWTSigningKeyID string
+
+	// OAuthRedirectBaseURL is the public address of this server, which
+	// providers send the browser back to. OAuthSuccessRedirect is where the
+	// browser goes after logging in.
+	OAuthRedirectBaseURL string
+	OAuthSuccessRedirect string
+	Google               OAuthProviderConfig
+	GitHub               OAuthProviderConfig
+
+	// WebAuthn scopes passkeys to a domain and the origins allowed to use
+	// them; both default to the web app's.
+	WebAuthn WebAuthnConfig
+
+	// EmailVerificationSecret signs the links that verify a user's email.
+	EmailVerificationSecret string
+
+	// AppURL is the address of the web app that emailed links open.
+	AppURL string
+	Mail   MailConfig
+
+	Password PasswordConfig
+
+	// TrustProxyHeaders takes a client's address from X-Forwarded-For, for
+	// when the server sits behind a reverse proxy that sets it.
+	TrustProxyHeaders bool
+
+	// TripStatusInterval is how often trips are moved to in-progress or
+	// completed as their dates pass. Zero disables the worker.
+	TripStatusInterval time.Duration
+}
+
+func Load() *Config {
+	addr := getEnv("SERVER_ADDR", "localhost:8080")
+	return &Config{
+		Addr:         addr,
+		Storage:      getEnv("STORAGE_BACKEND", StorageDynamoDB),
+		CursorSecret: getEnv("CURSOR_SECRET_KEY", ""),
+
+		JWTKeysDir:      getEnv("JWT_KEYS_DIR", ""),
+		JWTSigningKeyID: getEnv("JWT_SIGNING_KEY_ID", ""),
+
+		OAuthRedirectBaseURL: getEnv("OAUTH_REDIRECT_BASE_URL", "http://"+addr),
+		OAuthSuccessRedirect: getEnv("OAUTH_SUCCESS_REDIRECT", ""),
+		Google: OAuthProviderConfig{
+			ClientID:     getEnv("GOOGLE_CLIENT_ID", ""),
+			ClientSecret: getEnv("GOOGLE_CLIENT_SECRET", ""),
+			URL:          getEnv("GOOGLE_ISSUER", "https://accounts.google.com"),
+		},
+		GitHub: OAuthProviderConfig{
+			ClientID:     getEnv("GITHUB_CLIENT_ID", ""),
+			ClientSecret: getEnv("GITHUB_CLIENT_SECRET", ""),
+			URL:          getEnv("GITHUB_URL", "https://github.com"),
+			APIURL:       getEnv("GITHUB_API_URL", "https://api.github.com"),
+		},
+
+		WebAuthn: WebAuthnConfig{
+			RPID:    getEnv("WEBAUTHN_RP_ID", ""),
+			RPName:  getEnv("WEBAUTHN_RP_NAME", "tabichan"),
+			Origins: getEnv("WEBAUTHN_ORIGINS", ""),
+		},
+
+		EmailVerificationSecret: getEnv("EMAIL_VERIFICATION_SECRET", ""),
+
+		AppURL: getEnv("APP_URL", "http://"+addr),
+		Mail: MailConfig{
+			Mailer:       getEnv("MAILER", MailerLog),
+			From:         getEnv("MAIL_FROM", "tabichan <no-reply@localhost>"),
+			Dir:          getEnv("MAIL_DIR", "mail"),
+			SMTPAddr:     getEnv("SMTP_ADDR", ""),
+			SMTPUsername: getEnv("SMTP_USERNAME", ""),
+			SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+		},
+
+		Password: PasswordConfig{
+			Hasher:        getEnv("PASSWORD_HASHER", HasherArgon2id),
+			BcryptCost:    getInt("BCRYPT_COST", 12),
+			Argon2Time:    getInt("ARGON2_TIME", 2),
+			Argon2Memory:  getInt("ARGON2_MEMORY", 19*1024),
+			Argon2Threads: getInt("ARGON2_THREADS", 1),
+			MinLength:     getInt("PASSWORD_MIN_LENGTH", 8),
+			BreachedFile:  getEnv("BREACHED_PASSWORDS_FILE", ""),
+		},
+
+		TrustProxyHeaders: getBool("TRUST_PROXY_HEADERS", false),
+
+		TripStatusInterval: getDuration("TRIP_STATUS_INTERVAL", 5*time.Minute),
+	}
+}
+
+func getDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s: %v", key, value, fallback, err)
+		return fallback
+	}
+	return duration
+}
+
+func getInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %d: %v", key, value, fallback, err)
+		return fallback
+	}
+	return parsed
+}
+
+func getBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %t: %v", key, value, fallback, err)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
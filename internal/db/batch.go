@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MaxBatchWriteItems is the most requests DynamoDB accepts in one
+// BatchWriteItem call.
+const MaxBatchWriteItems = 25
+
+// MaxBatchGetItems is the most keys DynamoDB accepts in one BatchGetItem
+// call.
+const MaxBatchGetItems = 100
+
+const maxBatchAttempts = 5
+
+// BatchGet reads every key from tableName in chunks of MaxBatchGetItems,
+// retrying unprocessed keys with backoff. Missing items are skipped and the
+// order of the result is not guaranteed.
+func BatchGet(client *dynamodb.Client, tableName string, keys []map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	for start := 0; start < len(keys); start += MaxBatchGetItems {
+		end := min(start+MaxBatchGetItems, len(keys))
+
+		requests := map[string]types.KeysAndAttributes{tableName: {Keys: keys[start:end]}}
+		backoff := 50 * time.Millisecond
+		for attempt := 1; len(requests) > 0; attempt++ {
+			if attempt > maxBatchAttempts {
+				return nil, fmt.Errorf("failed to batch get from %s: keys still unprocessed after %d attempts", tableName, maxBatchAttempts)
+			}
+
+			result, err := client.BatchGetItem(context.TODO(), &dynamodb.BatchGetItemInput{
+				RequestItems: requests,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to batch get from %s: %w", tableName, err)
+			}
+			items = append(items, result.Responses[tableName]...)
+
+			requests = result.UnprocessedKeys
+			if len(requests) > 0 {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+	}
+	return items, nil
+}
+
+// BatchDelete removes every key from tableName in chunks of
+// MaxBatchWriteItems, retrying unprocessed requests with backoff.
+func BatchDelete(client *dynamodb.Client, tableName string, keys []map[string]types.AttributeValue) error {
+	for start := 0; start < len(keys); start += MaxBatchWriteItems {
+		end := min(start+MaxBatchWriteItems, len(keys))
+
+		requests := make([]types.WriteRequest, 0, end-start)
+		for _, key := range keys[start:end] {
+			requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+		}
+
+		if err := batchWrite(client, map[string][]types.WriteRequest{tableName: requests}); err != nil {
+			return fmt.Errorf("failed to batch delete from %s: %w", tableName, err)
+		}
+	}
+	return nil
+}
+
+func batchWrite(client *dynamodb.Client, requests map[string][]types.WriteRequest) error {
+	backoff := 50 * time.Millisecond
+	for attempt := 1; len(requests) > 0; attempt++ {
+		if attempt > maxBatchAttempts {
+			return fmt.Errorf("requests still unprocessed after %d attempts", maxBatchAttempts)
+		}
+
+		result, err := client.BatchWriteItem(context.TODO(), &dynamodb.BatchWriteItemInput{
+			RequestItems: requests,
+		})
+		if err != nil {
+			return err
+		}
+
+		requests = result.UnprocessedItems
+		if len(requests) > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package db
+
+import "sync"
+
+// MemoryTable is a process-local stand-in for a DynamoDB table, used when the
+// server runs with the in-memory storage backend.
+type MemoryTable[T any] struct {
+	mu    sync.RWMutex
+	items map[string]T
+}
+
+func NewMemoryTable[T any]() *MemoryTable[T] {
+	return &MemoryTable[T]{items: map[string]T{}}
+}
+
+func (t *MemoryTable[T]) Get(key string) (T, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	item, ok := t.items[key]
+	return item, ok
+}
+
+func (t *MemoryTable[T]) Put(key string, item T) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.items[key] = item
+}
+
+func (t *MemoryTable[T]) Delete(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.items[key]
+	delete(t.items, key)
+	return ok
+}
+
+// Update applies fn to the stored item under the table lock. The item is only
+// written back when fn returns true.
+func (t *MemoryTable[T]) Update(key string, fn func(item *T) bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	item, ok := t.items[key]
+	if !ok {
+		return false
+	}
+	if fn(&item) {
+		t.items[key] = item
+	}
+	return true
+}
+
+func (t *MemoryTable[T]) Filter(match func(item T) bool) []T {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var items []T
+	for _, item := range t.items {
+		if match(item) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// PageKey is the position a page of results ended on: DynamoDB's
+// LastEvaluatedKey reduced to its string attributes. A nil PageKey means
+// there are no further pages.
+type PageKey map[string]string
+
+// PageRequest selects a page of a listing. A zero Limit returns everything
+// after the After key.
+type PageRequest struct {
+	Limit int
+	After PageKey
+}
+
+// QueryPage reads up to page.Limit items, starting after page.After. Queries
+// with a filter expression can come back short, so it keeps following
+// LastEvaluatedKey until the page is full or the query is exhausted.
+func QueryPage(client *dynamodb.Client, input *dynamodb.QueryInput, page PageRequest) ([]map[string]types.AttributeValue, PageKey, error) {
+	query := *input
+	query.ExclusiveStartKey = page.After.attributeValues()
+
+	var items []map[string]types.AttributeValue
+	for {
+		if page.Limit > 0 {
+			query.Limit = aws.Int32(int32(page.Limit - len(items)))
+		}
+
+		result, err := client.Query(context.TODO(), &query)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, result.Items...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return items, nil, nil
+		}
+		if page.Limit > 0 && len(items) >= page.Limit {
+			lastKey, err := pageKey(result.LastEvaluatedKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			return items, lastKey, nil
+		}
+		query.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// ItemKey builds the page key that resumes a query right after item. names
+// lists the table and index key attributes.
+func ItemKey(item map[string]types.AttributeValue, names ...string) (PageKey, error) {
+	key := make(map[string]types.AttributeValue, len(names))
+	for _, name := range names {
+		key[name] = item[name]
+	}
+	return pageKey(key)
+}
+
+func (k PageKey) attributeValues() map[string]types.AttributeValue {
+	if len(k) == 0 {
+		return nil
+	}
+
+	key := make(map[string]types.AttributeValue, len(k))
+	for name, value := range k {
+		key[name] = &types.AttributeValueMemberS{Value: value}
+	}
+	return key
+}
+
+func pageKey(key map[string]types.AttributeValue) (PageKey, error) {
+	page := make(PageKey, len(key))
+	for name, value := range key {
+		s, ok := value.(*types.AttributeValueMemberS)
+		if !ok {
+			return nil, fmt.Errorf("key attribute %s is not a string", name)
+		}
+		page[name] = s.Value
+	}
+	return page, nil
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// QueryAll follows LastEvaluatedKey until every page of the query has been
+// read and returns the combined items.
+func QueryAll(client *dynamodb.Client, input *dynamodb.QueryInput) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	paginator := dynamodb.NewQueryPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+	}
+	return items, nil
+}
+
+// PrimaryKeys reduces each item to its PK and SK attributes.
+func PrimaryKeys(items []map[string]types.AttributeValue) []map[string]types.AttributeValue {
+	keys := make([]map[string]types.AttributeValue, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, map[string]types.AttributeValue{
+			"PK": item["PK"],
+			"SK": item["SK"],
+		})
+	}
+	return keys
+}
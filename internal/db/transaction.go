@@ -0,0 +1,56 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MaxTransactionItems is the most actions DynamoDB accepts in one
+// TransactWriteItems call.
+const MaxTransactionItems = 100
+
+var ErrConditionFailed = errors.New("condition check failed")
+
+// TransactWrite applies every item in a single TransactWriteItems call, so
+// either all puts, updates, deletes and condition checks succeed or none do.
+// A failed condition is reported as ErrConditionFailed.
+func TransactWrite(client *dynamodb.Client, items []types.TransactWriteItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if len(items) > MaxTransactionItems {
+		return fmt.Errorf("transaction has %d items, limit is %d", len(items), MaxTransactionItems)
+	}
+
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for i, reason := range canceled.CancellationReasons {
+			if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				return fmt.Errorf("%w on transaction item %d", ErrConditionFailed, i)
+			}
+		}
+		return fmt.Errorf("transaction canceled: %w", err)
+	}
+	return err
+}
+
+// PutIfNotExists builds a transactional put that fails if an item with the
+// same primary key is already stored.
+func PutIfNotExists(tableName string, item map[string]types.AttributeValue) types.TransactWriteItem {
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			TableName:           aws.String(tableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(PK)"),
+		},
+	}
+}
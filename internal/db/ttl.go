@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// EnableTTL turns on time to live for the table using attribute, which must
+// hold an epoch seconds number. It does nothing if TTL is already on.
+func EnableTTL(client *dynamodb.Client, tableName, attribute string) error {
+	described, err := client.DescribeTimeToLive(context.TODO(), &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe TTL on %s: %w", tableName, err)
+	}
+
+	if ttl := described.TimeToLiveDescription; ttl != nil {
+		switch ttl.TimeToLiveStatus {
+		case types.TimeToLiveStatusEnabled, types.TimeToLiveStatusEnabling:
+			if aws.ToString(ttl.AttributeName) != attribute {
+				return fmt.Errorf("TTL on %s already uses attribute %s", tableName, aws.ToString(ttl.AttributeName))
+			}
+			return nil
+		}
+	}
+
+	_, err = client.UpdateTimeToLive(context.TODO(), &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(attribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable TTL on %s: %w", tableName, err)
+	}
+	return nil
+}
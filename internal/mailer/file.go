@@ -0,0 +1,29 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileMailer writes every email to its own .eml file in Dir, for local use
+// and for inspecting what would have been sent.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(message Message) error {
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create mail directory: %w", err)
+	}
+
+	name := time.Now().UTC().Format("20060102T150405") + "-" + uuid.New().String() + ".eml"
+	if err := os.WriteFile(filepath.Join(m.Dir, name), format(m.From, message), 0o600); err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+	return nil
+}
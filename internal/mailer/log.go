@@ -0,0 +1,12 @@
+package mailer
+
+import "log"
+
+// LogMailer writes emails to the server log instead of sending them. Meant
+// for local development only, since the log then holds reset links.
+type LogMailer struct{}
+
+func (m *LogMailer) Send(message Message) error {
+	log.Printf("Email to %s: %s\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
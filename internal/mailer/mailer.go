@@ -0,0 +1,13 @@
+package mailer
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails to users, such as password reset links.
+type Mailer interface {
+	Send(message Message) error
+}
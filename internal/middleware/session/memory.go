@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/tabichanorg/tabichan-server/internal/db"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+)
+
+type MemoryMiddlewareRepository struct {
+	Sessions      *db.MemoryTable[utils.Session]
+	RevokedTokens *db.MemoryTable[utils.RevokedToken]
+}
+
+func NewMemoryMiddlewareRepository(sessions *db.MemoryTable[utils.Session], revokedTokens *db.MemoryTable[utils.RevokedToken]) *MemoryMiddlewareRepository {
+	return &MemoryMiddlewareRepository{Sessions: sessions, RevokedTokens: revokedTokens}
+}
+
+func (r *MemoryMiddlewareRepository) GetSession(sessionID string) (*utils.Session, error) {
+	session, ok := r.Sessions.Get(sessionID)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (r *MemoryMiddlewareRepository) IsTokenRevoked(tokenID string) (bool, error) {
+	_, ok := r.RevokedTokens.Get(tokenID)
+	return ok, nil
+}
+
+func (r *MemoryMiddlewareRepository) TokensRevokedBefore(userID string) (int64, error) {
+	revocation, ok := r.RevokedTokens.Get(utils.UserTokensRevocationID(userID))
+	if !ok {
+		return 0, nil
+	}
+	return revocation.IssuedBefore, nil
+}
+
+func (r *MemoryMiddlewareRepository) RotateSession(old, next *utils.Session, graceExpiresAt time.Time) error {
+	rotated := false
+	found := r.Sessions.Update(old.SessionID, func(session *utils.Session) bool {
+		if session.ReplacedBy != "" {
+			rotated = true
+			return false
+		}
+		session.ReplacedBy = next.SessionID
+		session.SetExpiry(graceExpiresAt)
+		return true
+	})
+	if !found {
+		return ErrSessionNotFound
+	}
+	if rotated {
+		return ErrSessionRotated
+	}
+
+	r.Sessions.Put(next.SessionID, *next)
+	return nil
+}
@@ -2,20 +2,33 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/tabichanorg/tabichan-server/internal/db"
 	"github.com/tabichanorg/tabichan-server/internal/utils"
 )
 
-type MiddlewareRepository struct {
+type MiddlewareRepository interface {
+	GetSession(sessionID string) (*utils.Session, error)
+	RotateSession(old, next *utils.Session, graceExpiresAt time.Time) error
+	IsTokenRevoked(tokenID string) (bool, error)
+	// TokensRevokedBefore returns the epoch second before which the user's
+	// tokens were all revoked, or 0 if they weren't.
+	TokensRevokedBefore(userID string) (int64, error)
+}
+
+type DynamoMiddlewareRepository struct {
 	Client *dynamodb.Client
 }
 
-func (r *MiddlewareRepository) GetSession(sessionID string) (*utils.Session, error) {
+func (r *DynamoMiddlewareRepository) GetSession(sessionID string) (*utils.Session, error) {
 	queryInput := &dynamodb.QueryInput{
 		TableName:              aws.String("Sessions"),
 		IndexName:              aws.String("SessionIDIndex"),
@@ -30,7 +43,7 @@ func (r *MiddlewareRepository) GetSession(sessionID string) (*utils.Session, err
 	}
 
 	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("session not found")
+		return nil, ErrSessionNotFound
 	}
 
 	var session utils.Session
@@ -42,19 +55,75 @@ func (r *MiddlewareRepository) GetSession(sessionID string) (*utils.Session, err
 	return &session, nil
 }
 
-func (r *MiddlewareRepository) UpdateSession(oldSessionID, newSessionID, newExpiresAt string) error {
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String("Sessions"),
+func (r *DynamoMiddlewareRepository) IsTokenRevoked(tokenID string) (bool, error) {
+	result, err := r.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String("RevokedTokens"),
 		Key: map[string]types.AttributeValue{
-			"SessionID": &types.AttributeValueMemberS{Value: oldSessionID},
+			"TokenID": &types.AttributeValueMemberS{Value: tokenID},
 		},
-		UpdateExpression: aws.String("SET SessionID = :newSessionID, ExpiresAt = :newExpiry"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":newSessionID": &types.AttributeValueMemberS{Value: newSessionID},
-			":newExpiry":    &types.AttributeValueMemberS{Value: newExpiresAt},
+		ProjectionExpression: aws.String("TokenID"),
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.Item != nil, nil
+}
+
+func (r *DynamoMiddlewareRepository) TokensRevokedBefore(userID string) (int64, error) {
+	result, err := r.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String("RevokedTokens"),
+		Key: map[string]types.AttributeValue{
+			"TokenID": &types.AttributeValueMemberS{Value: utils.UserTokensRevocationID(userID)},
 		},
+		ProjectionExpression: aws.String("IssuedBefore"),
+	})
+	if err != nil || result.Item == nil {
+		return 0, err
 	}
 
-	_, err := r.Client.UpdateItem(context.TODO(), input)
+	var revocation utils.RevokedToken
+	if err := attributevalue.UnmarshalMap(result.Item, &revocation); err != nil {
+		return 0, err
+	}
+	return revocation.IssuedBefore, nil
+}
+
+// RotateSession stores next and cuts the old session's lifetime down to
+// graceExpiresAt in one transaction. It fails with ErrSessionRotated if a
+// parallel request already rotated the old session.
+func (r *DynamoMiddlewareRepository) RotateSession(old, next *utils.Session, graceExpiresAt time.Time) error {
+	item, err := attributevalue.MarshalMap(next)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+	delete(item, "ReplacedBy")
+
+	err = db.TransactWrite(r.Client, []types.TransactWriteItem{
+		{
+			Put: &types.Put{
+				TableName:           aws.String("Sessions"),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(SessionID)"),
+			},
+		},
+		{
+			Update: &types.Update{
+				TableName: aws.String("Sessions"),
+				Key: map[string]types.AttributeValue{
+					"SessionID": &types.AttributeValueMemberS{Value: old.SessionID},
+				},
+				UpdateExpression:    aws.String("SET ExpiresAt = :expiresAt, ExpiresAtTTL = :ttl, ReplacedBy = :replacedBy"),
+				ConditionExpression: aws.String("attribute_exists(SessionID) AND attribute_not_exists(ReplacedBy)"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":expiresAt":  &types.AttributeValueMemberS{Value: graceExpiresAt.Format(time.RFC3339)},
+					":ttl":        &types.AttributeValueMemberN{Value: strconv.FormatInt(graceExpiresAt.Unix(), 10)},
+					":replacedBy": &types.AttributeValueMemberS{Value: next.SessionID},
+				},
+			},
+		},
+	})
+	if errors.Is(err, db.ErrConditionFailed) {
+		return ErrSessionRotated
+	}
 	return err
 }
@@ -6,18 +6,42 @@ import (
 	"net/http"
 	"time"
 
+	jwt "github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/tabichanorg/tabichan-server/internal/utils"
 )
 
 type MiddlewareService struct {
-	Repo *MiddlewareRepository
+	Repo   MiddlewareRepository
+	Tokens *utils.JWTKeySet
 }
 
 var sessionRenewalThreshold = time.Minute * 30
 
+// sessionRotationGracePeriod is how long a rotated session ID keeps working,
+// so requests already in flight with the old cookie don't fail.
+var sessionRotationGracePeriod = time.Minute
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionRotated  = errors.New("session already rotated")
+)
+
 func (s *MiddlewareService) SessionMiddleware(next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if tokenString, ok := utils.BearerToken(r); ok {
+			claims, err := s.VerifyToken(tokenString)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "userID", claims.Subject)
+			ctx = context.WithValue(ctx, "tokenID", claims.ID)
+			next(w, r.WithContext(ctx))
+			return
+		}
+
 		cookie, err := r.Cookie("sessionID")
 		if err != nil {
 			http.Error(w, "Session not found", http.StatusUnauthorized)
@@ -37,37 +61,76 @@ func (s *MiddlewareService) SessionMiddleware(next func(w http.ResponseWriter, r
 			return
 		}
 
-		if time.Until(expiresAt) <= sessionRenewalThreshold {
-			newSession, err := s.RenewSession(sessionID)
-			if err != nil {
+		// A session that was already rotated is only serving out its grace
+		// period, so it isn't renewed again.
+		if session.ReplacedBy == "" && time.Until(expiresAt) <= sessionRenewalThreshold {
+			newSession, err := s.RenewSession(session)
+			if err != nil && !errors.Is(err, ErrSessionRotated) {
 				http.Error(w, "Failed to renew user session", http.StatusInternalServerError)
 				return
 			}
 
-			newExpiresAt, err := utils.ConvertTimeStringToRFC3339(session.ExpiresAt)
-			if err != nil {
-				http.Error(w, "Session renewal expiry error", http.StatusInternalServerError)
-				return
+			if err == nil {
+				newExpiresAt, err := utils.ConvertTimeStringToRFC3339(newSession.ExpiresAt)
+				if err != nil {
+					http.Error(w, "Session renewal expiry error", http.StatusInternalServerError)
+					return
+				}
+
+				http.SetCookie(w, &http.Cookie{
+					Name:     "sessionID",
+					Path:     "/",
+					Value:    newSession.SessionID,
+					Expires:  newExpiresAt,
+					HttpOnly: true,
+					// Secure: true, // TODO: use Secure when hosting HTTPS
+				})
+				sessionID = newSession.SessionID
 			}
+		}
 
-			http.SetCookie(w, &http.Cookie{
-				Name:     "sessionID",
-				Value:    newSession.SessionID,
-				Expires:  newExpiresAt,
-				HttpOnly: true,
-				// Secure: true, // TODO: use Secure when hosting HTTPS
-			})
+		// Requests still using a rotated ID act on the session that replaced it.
+		if session.ReplacedBy != "" {
+			sessionID = session.ReplacedBy
 		}
 
 		ctx := context.WithValue(r.Context(), "userID", session.UserID)
+		ctx = context.WithValue(ctx, "sessionID", sessionID)
 		next(w, r.WithContext(ctx))
 	}
 }
 
+// VerifyToken checks a bearer JWT and that it hasn't been revoked, either on
+// its own or along with every other token of its user.
+func (s *MiddlewareService) VerifyToken(tokenString string) (*jwt.RegisteredClaims, error) {
+	claims, err := s.Tokens.Parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.Repo.IsTokenRevoked(claims.ID)
+	if err != nil {
+		return nil, errors.New("failed to check token")
+	}
+	if revoked {
+		return nil, errors.New("token revoked")
+	}
+
+	revokedBefore, err := s.Repo.TokensRevokedBefore(claims.Subject)
+	if err != nil {
+		return nil, errors.New("failed to check token")
+	}
+	if claims.IssuedAt.Unix() < revokedBefore {
+		return nil, errors.New("token revoked")
+	}
+
+	return claims, nil
+}
+
 func (s *MiddlewareService) FetchSession(sessionID string) (*utils.Session, error) {
 	session, err := s.Repo.GetSession(sessionID)
 	if err != nil || session == nil {
-		return nil, errors.New("session not found")
+		return nil, ErrSessionNotFound
 	}
 
 	expiresAt, err := utils.ConvertTimeStringToRFC3339(session.ExpiresAt)
@@ -78,15 +141,22 @@ func (s *MiddlewareService) FetchSession(sessionID string) (*utils.Session, erro
 	return session, nil
 }
 
-func (s *MiddlewareService) RenewSession(oldSessionID string) (*utils.Session, error) {
-	newSessionID := uuid.New().String()
-
-	newExpiresAt := time.Now().Add(24 * time.Hour)
+// RenewSession rotates the session to a new ID with a fresh lifetime of the
+// same kind, leaving the old ID valid for sessionRotationGracePeriod.
+func (s *MiddlewareService) RenewSession(old *utils.Session) (*utils.Session, error) {
+	now := time.Now()
+	newSession := &utils.Session{
+		SessionID:  uuid.New().String(),
+		UserID:     old.UserID,
+		Device:     old.Device,
+		CreatedAt:  old.CreatedAt,
+		RememberMe: old.RememberMe,
+	}
+	newSession.SetExpiry(now.Add(utils.SessionLifetimeFor(old.RememberMe)))
 
-	err := s.Repo.UpdateSession(oldSessionID, newSessionID, newExpiresAt.Format(time.RFC3339))
-	if err != nil {
+	if err := s.Repo.RotateSession(old, newSession, now.Add(sessionRotationGracePeriod)); err != nil {
 		return nil, err
 	}
 
-	return &utils.Session{SessionID: newSessionID, ExpiresAt: newExpiresAt.Format(time.RFC3339)}, nil
+	return newSession, nil
 }
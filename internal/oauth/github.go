@@ -0,0 +1,99 @@
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tabichanorg/tabichan-server/internal/user"
+)
+
+// GitHubProvider logs users in with GitHub, which speaks plain OAuth 2.0
+// rather than OpenID Connect: the identity comes from its API instead of an
+// ID token. BaseURL and APIURL can point at a local stub.
+type GitHubProvider struct {
+	BaseURL      string
+	APIURL       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+func (p *GitHubProvider) Name() string {
+	return "github"
+}
+
+func (p *GitHubProvider) AuthCodeURL(state, nonce, codeChallenge string) (string, error) {
+	query := url.Values{
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {"read:user user:email"},
+		"state":                 {state},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	return withQuery(strings.TrimSuffix(p.BaseURL, "/")+"/login/oauth/authorize", query)
+}
+
+func (p *GitHubProvider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*user.ExternalIdentity, error) {
+	token, err := exchangeCode(ctx, strings.TrimSuffix(p.BaseURL, "/")+"/login/oauth/access_token", url.Values{
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code_verifier": {codeVerifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("%w: no access token in token response", ErrIdentityRejected)
+	}
+
+	var account struct {
+		ID int64 `json:"id"`
+	}
+	if err := p.get(ctx, token.AccessToken, "/user", &account); err != nil {
+		return nil, err
+	}
+	if account.ID == 0 {
+		return nil, fmt.Errorf("%w: GitHub user has no id", ErrIdentityRejected)
+	}
+
+	// The profile email is optional and unverified, so the primary address
+	// is taken from the emails endpoint instead.
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := p.get(ctx, token.AccessToken, "/user/emails", &emails); err != nil {
+		return nil, err
+	}
+
+	identity := &user.ExternalIdentity{Provider: p.Name(), Subject: strconv.FormatInt(account.ID, 10)}
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = email.Email
+			identity.EmailVerified = email.Verified
+		}
+	}
+	return identity, nil
+}
+
+func (p *GitHubProvider) get(ctx context.Context, accessToken, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.APIURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	if err := doJSON(req, out); err != nil {
+		return fmt.Errorf("failed to fetch GitHub %s: %w", path, err)
+	}
+	return nil
+}
@@ -1 +1,135 @@
 package oauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	"github.com/tabichanorg/tabichan-server/internal/user"
+)
+
+type OAuthHandler struct {
+	Service *OAuthService
+	// SuccessRedirect is where the browser goes once logged in. Without one
+	// the callback answers with the login response as JSON. Users with
+	// two-factor authentication are sent there too, with the MFA token in
+	// the URL fragment, to finish logging in at POST /login/mfa.
+	SuccessRedirect string
+}
+
+// Start sends the browser to the provider's login page. The state is also
+// kept in a cookie so the callback can tell it was this browser that started
+// the login.
+func (h *OAuthHandler) Start(w http.ResponseWriter, r *http.Request) {
+	h.start(w, r, "")
+}
+
+// Link sends the logged in user to the provider to attach that account as
+// another way to log in.
+func (h *OAuthHandler) Link(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	h.start(w, r, userID)
+}
+
+func (h *OAuthHandler) start(w http.ResponseWriter, r *http.Request, linkUserID string) {
+	authURL, state, err := h.Service.Start(mux.Vars(r)["provider"], linkUserID)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oauthState",
+		Path:     "/oauth/",
+		Value:    state,
+		MaxAge:   int(stateLifetime.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		// Secure:   true, // TODO: use Secure when hosting HTTPS
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (h *OAuthHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		http.Error(w, "Login was not completed: "+providerError, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie("oauthState")
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, ErrInvalidState.Error(), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oauthState", Path: "/oauth/", MaxAge: -1, HttpOnly: true})
+
+	result, err := h.Service.Callback(r.Context(), mux.Vars(r)["provider"], state, query.Get("code"), r.Header.Get("User-Agent"))
+	if err != nil {
+		user.SetRetryAfter(w, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if result.Linked != nil {
+		if h.SuccessRedirect != "" {
+			http.Redirect(w, r, h.SuccessRedirect, http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result.Linked)
+		return
+	}
+
+	if result.Challenge != nil {
+		if h.SuccessRedirect != "" {
+			// The fragment stays in the browser, so the token doesn't end up
+			// in server logs or Referer headers.
+			fragment := url.Values{"mfaToken": {result.Challenge.MFAToken}}.Encode()
+			http.Redirect(w, r, h.SuccessRedirect+"#"+fragment, http.StatusSeeOther)
+			return
+		}
+		json.NewEncoder(w).Encode(result.Challenge)
+		return
+	}
+
+	if err := user.SetSessionCookie(w, result.Login.Session); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if h.SuccessRedirect != "" {
+		http.Redirect(w, r, h.SuccessRedirect, http.StatusSeeOther)
+		return
+	}
+	json.NewEncoder(w).Encode(result.Login)
+}
+
+func errorStatus(err error) int {
+	var throttled *user.LoginThrottledError
+	switch {
+	case errors.Is(err, ErrUnknownProvider):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidState):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrIdentityRejected):
+		return http.StatusUnauthorized
+	case errors.Is(err, user.ErrEmailNotVerified):
+		return http.StatusForbidden
+	case errors.Is(err, user.ErrIdentityInUse),
+		errors.Is(err, user.ErrUnverifiedAccount):
+		return http.StatusConflict
+	case errors.As(err, &throttled):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
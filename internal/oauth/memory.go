@@ -0,0 +1,25 @@
+package oauth
+
+import "github.com/tabichanorg/tabichan-server/internal/db"
+
+type MemoryOAuthRepository struct {
+	States *db.MemoryTable[AuthState]
+}
+
+func NewMemoryOAuthRepository() *MemoryOAuthRepository {
+	return &MemoryOAuthRepository{States: db.NewMemoryTable[AuthState]()}
+}
+
+func (r *MemoryOAuthRepository) CreateState(state *AuthState) error {
+	r.States.Put(state.State, *state)
+	return nil
+}
+
+func (r *MemoryOAuthRepository) ConsumeState(state string) (*AuthState, error) {
+	stored, ok := r.States.Get(state)
+	// Only the caller that actually deletes the state gets to use it.
+	if !ok || !r.States.Delete(state) {
+		return nil, ErrInvalidState
+	}
+	return &stored, nil
+}
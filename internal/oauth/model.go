@@ -0,0 +1,15 @@
+package oauth
+
+// AuthState is what the server remembers about a login between sending the
+// browser to the provider and the provider sending it back. It can only be
+// used once. LinkUserID is set when a logged in user is linking the provider
+// account rather than logging in with it.
+type AuthState struct {
+	State        string
+	Provider     string
+	LinkUserID   string `dynamodbav:",omitempty"`
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    string
+	ExpiresAtTTL int64
+}
@@ -0,0 +1,245 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/tabichanorg/tabichan-server/internal/user"
+)
+
+// OIDCProvider logs users in with an OpenID Connect provider such as Google.
+// Its endpoints and signing keys are read from the issuer's discovery
+// document, so pointing Issuer at a local stub is enough to test against it.
+type OIDCProvider struct {
+	ProviderName string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// jwksRefetchInterval is how long to wait between fetches of the issuer's
+// keys, so ID tokens with made up kids can't make us fetch on every login.
+const jwksRefetchInterval = 5 * time.Minute
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string    `json:"nonce"`
+	Email         string    `json:"email"`
+	EmailVerified claimBool `json:"email_verified"`
+}
+
+// claimBool accepts both true and "true", since not every provider sends
+// email_verified as a JSON boolean.
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = claimBool(v)
+	case string:
+		*b = claimBool(v == "true")
+	}
+	return nil
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.ProviderName
+}
+
+func (p *OIDCProvider) AuthCodeURL(state, nonce, codeChallenge string) (string, error) {
+	discovery, err := p.discover(context.TODO())
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {"openid email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	return withQuery(discovery.AuthorizationEndpoint, query)
+}
+
+func (p *OIDCProvider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*user.ExternalIdentity, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := exchangeCode(ctx, discovery.TokenEndpoint, url.Values{
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code_verifier": {codeVerifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("%w: no ID token in token response", ErrIdentityRejected)
+	}
+
+	claims, err := p.verifyIDToken(ctx, discovery, token.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user.ExternalIdentity{
+		Provider:      p.ProviderName,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+	}, nil
+}
+
+// verifyIDToken checks the ID token's signature against the issuer's keys,
+// and that it was issued by the issuer, for us, for this login.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, discovery *oidcDiscovery, idToken, nonce string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		id, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, discovery, id)
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIdentityRejected, err)
+	}
+
+	switch {
+	case !claims.VerifyIssuer(discovery.Issuer, true):
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrIdentityRejected, claims.Issuer)
+	case !claims.VerifyAudience(p.ClientID, true):
+		return nil, fmt.Errorf("%w: ID token was issued to another client", ErrIdentityRejected)
+	case claims.ExpiresAt == nil || claims.IssuedAt == nil:
+		return nil, fmt.Errorf("%w: ID token is missing exp or iat", ErrIdentityRejected)
+	case claims.Nonce == "" || claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrIdentityRejected)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: ID token has no subject", ErrIdentityRejected)
+	}
+
+	return claims, nil
+}
+
+// discover fetches the issuer's discovery document the first time it is
+// needed.
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var discovery oidcDiscovery
+	if err := doJSON(req, &discovery); err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", p.ProviderName, err)
+	}
+	if discovery.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery document of %s is for issuer %q", p.Issuer, discovery.Issuer)
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// signingKey looks up an ID token key by kid, fetching the issuer's keys
+// again when it doesn't know the kid, as happens after the issuer rotates.
+// Once there are keys, they are fetched at most once per jwksRefetchInterval.
+func (p *OIDCProvider) signingKey(ctx context.Context, discovery *oidcDiscovery, id string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetchedAt) < jwksRefetchInterval {
+		return nil, fmt.Errorf("unknown signing key %q", id)
+	}
+	p.keysFetchedAt = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := doJSON(req, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch keys of %s: %w", p.ProviderName, err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.keys = keys
+
+	key, ok := keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", id)
+	}
+	return key, nil
+}
+
+func withQuery(endpoint string, query url.Values) (string, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	values := parsed.Query()
+	for key, value := range query {
+		values[key] = value
+	}
+	parsed.RawQuery = values.Encode()
+	return parsed.String(), nil
+}
@@ -0,0 +1,304 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/tabichanorg/tabichan-server/internal/db"
+	"github.com/tabichanorg/tabichan-server/internal/user"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+)
+
+const testClientID = "tabichan-test"
+
+// stubIssuer is an OpenID Connect provider serving discovery, JWKS and token
+// endpoints. Codes are registered by the test in place of a login page.
+type stubIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	keyID  string
+
+	mu        sync.Mutex
+	codes     map[string]stubGrant
+	jwksFetch int
+	// signWith, when set, signs ID tokens with another key under its kid.
+	signWith *rsa.PrivateKey
+	signKID  string
+	// claims, when set, changes the ID token's claims before signing.
+	claims func(jwt.MapClaims)
+}
+
+type stubGrant struct {
+	codeChallenge string
+	nonce         string
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubIssuer{t: t, key: key, keyID: "current", codes: map[string]stubGrant{}}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                s.server.URL,
+			AuthorizationEndpoint: s.server.URL + "/authorize",
+			TokenEndpoint:         s.server.URL + "/token",
+			JWKSURI:               s.server.URL + "/jwks",
+		})
+	})
+	router.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.jwksFetch++
+		s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": s.keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+		}}})
+	})
+	router.HandleFunc("/token", s.token)
+	s.server = httptest.NewServer(router)
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *stubIssuer) token(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grant, ok := s.codes[r.PostFormValue("code")]
+	delete(s.codes, r.PostFormValue("code"))
+	if !ok || codeChallenge(r.PostFormValue("code_verifier")) != grant.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            s.server.URL,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"email":          "traveller@example.com",
+		"email_verified": true,
+		"nonce":          grant.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	if s.claims != nil {
+		s.claims(claims)
+	}
+
+	key, keyID := s.key, s.keyID
+	if s.signWith != nil {
+		key, keyID = s.signWith, s.signKID
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(key)
+	if err != nil {
+		s.t.Error(err)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "id_token": idToken})
+}
+
+// approve registers code as the provider's answer to the login at authURL,
+// as if the user had logged in there. With a codeChallenge, that is what the
+// code is bound to instead of the one in authURL.
+func (s *stubIssuer) approve(authURL, code, codeChallenge string) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	query := parsed.Query()
+	if codeChallenge == "" {
+		codeChallenge = query.Get("code_challenge")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code] = stubGrant{codeChallenge: codeChallenge, nonce: query.Get("nonce")}
+}
+
+func (s *stubIssuer) jwksFetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jwksFetch
+}
+
+func newTestRouter(t *testing.T, issuer *stubIssuer) *mux.Router {
+	tokens, err := utils.LoadJWTKeySet("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := &user.UserService{
+		Repo:   user.NewMemoryUserRepository(db.NewMemoryTable[utils.Session](), db.NewMemoryTable[utils.RevokedToken]()),
+		Tokens: tokens,
+		Hasher: &utils.BcryptHasher{Cost: 4},
+	}
+	handler := &OAuthHandler{Service: &OAuthService{
+		Providers: map[string]Provider{"google": &OIDCProvider{
+			ProviderName: "google",
+			Issuer:       issuer.server.URL,
+			ClientID:     testClientID,
+			ClientSecret: "secret",
+			RedirectURL:  "http://localhost/oauth/google/callback",
+		}},
+		Repo:  NewMemoryOAuthRepository(),
+		Users: users,
+	}}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/oauth/{provider}/start", handler.Start).Methods("GET")
+	router.HandleFunc("/oauth/{provider}/callback", handler.Callback).Methods("GET")
+	return router
+}
+
+// startLogin begins a login and returns the provider URL the browser was
+// sent to and the state cookie it got.
+func startLogin(t *testing.T, router *mux.Router) (string, *http.Cookie) {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/oauth/google/start", nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("start: got %d: %s", recorder.Code, recorder.Body)
+	}
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == "oauthState" {
+			return recorder.Header().Get("Location"), cookie
+		}
+	}
+	t.Fatal("start: no state cookie")
+	return "", nil
+}
+
+func callback(router *mux.Router, state, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	query := url.Values{"state": {state}, "code": {code}}
+	req := httptest.NewRequest("GET", "/oauth/google/callback?"+query.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newStubIssuer(t)
+	router := newTestRouter(t, issuer)
+
+	authURL, cookie := startLogin(t, router)
+	issuer.approve(authURL, "code", "")
+
+	recorder := callback(router, cookie.Value, "code", cookie)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", recorder.Code, recorder.Body)
+	}
+	var login user.LoginRequestResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&login); err != nil || login.Session == nil {
+		t.Fatalf("got %q, want a login response", recorder.Body)
+	}
+
+	// The state is used up by the first callback.
+	if recorder := callback(router, cookie.Value, "code", cookie); recorder.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback: got %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCCallbackStateCookieMismatch(t *testing.T) {
+	issuer := newStubIssuer(t)
+	router := newTestRouter(t, issuer)
+
+	authURL, cookie := startLogin(t, router)
+	issuer.approve(authURL, "code", "")
+	_, otherCookie := startLogin(t, router)
+
+	for name, sent := range map[string]*http.Cookie{
+		"other login's cookie": otherCookie,
+		"no cookie":            nil,
+	} {
+		recorder := callback(router, cookie.Value, "code", sent)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", name, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	// The rejected callbacks didn't use up the state.
+	if recorder := callback(router, cookie.Value, "code", cookie); recorder.Code != http.StatusOK {
+		t.Errorf("matching cookie: got %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestOIDCCallbackRejectsIdentity(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims func(jwt.MapClaims)
+		// codeChallenge binds the code to another login's PKCE challenge.
+		codeChallenge string
+	}{
+		{name: "nonce mismatch", claims: func(c jwt.MapClaims) { c["nonce"] = "another-nonce" }},
+		{name: "missing nonce", claims: func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{name: "wrong issuer", claims: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{name: "wrong audience", claims: func(c jwt.MapClaims) { c["aud"] = "another-client" }},
+		{name: "expired", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{name: "bad PKCE verifier", codeChallenge: codeChallenge("another-verifier")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := newStubIssuer(t)
+			issuer.claims = test.claims
+			router := newTestRouter(t, issuer)
+
+			authURL, cookie := startLogin(t, router)
+			issuer.approve(authURL, "code", test.codeChallenge)
+
+			recorder := callback(router, cookie.Value, "code", cookie)
+			if recorder.Code != http.StatusUnauthorized {
+				t.Errorf("got %d, want %d: %s", recorder.Code, http.StatusUnauthorized, recorder.Body)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackUnknownKeyID(t *testing.T) {
+	issuer := newStubIssuer(t)
+	router := newTestRouter(t, issuer)
+
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.signWith, issuer.signKID = rotated, "rotated"
+
+	for i := range 3 {
+		authURL, cookie := startLogin(t, router)
+		issuer.approve(authURL, "code", "")
+
+		recorder := callback(router, cookie.Value, "code", cookie)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got %d, want %d: %s", i, recorder.Code, http.StatusUnauthorized, recorder.Body)
+		}
+	}
+
+	// Only the first unknown kid fetches the keys; the rest wait for
+	// jwksRefetchInterval.
+	if fetches := issuer.jwksFetches(); fetches != 1 {
+		t.Errorf("keys were fetched %d times, want 1", fetches)
+	}
+}
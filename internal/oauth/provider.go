@@ -0,0 +1,97 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tabichanorg/tabichan-server/internal/user"
+)
+
+// Provider is an identity provider users can log in with using the
+// authorization code flow with PKCE.
+type Provider interface {
+	Name() string
+	// AuthCodeURL is where the browser is sent to log in. Providers that
+	// don't issue ID tokens ignore nonce.
+	AuthCodeURL(state, nonce, codeChallenge string) (string, error)
+	// Exchange redeems the code the provider sent back and returns the
+	// identity it belongs to.
+	Exchange(ctx context.Context, code, codeVerifier, nonce string) (*user.ExternalIdentity, error)
+}
+
+// providerClient is used for every call to a provider.
+var providerClient = &http.Client{Timeout: 10 * time.Second}
+
+// randomToken returns 32 random bytes encoded for use in URLs, as used for
+// states, nonces and PKCE code verifiers.
+func randomToken() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// codeChallenge derives the S256 PKCE challenge from a code verifier.
+func codeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchangeCode posts the authorization code grant to a provider's token
+// endpoint.
+func exchangeCode(ctx context.Context, tokenURL string, form url.Values) (*tokenResponse, error) {
+	form.Set("grant_type", "authorization_code")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var token tokenResponse
+	if err := doJSON(req, &token); err != nil {
+		return nil, fmt.Errorf("token exchange failed: %w", err)
+	}
+	if token.Error != "" {
+		return nil, fmt.Errorf("%w: %s %s", ErrIdentityRejected, token.Error, token.ErrorDescription)
+	}
+	return &token, nil
+}
+
+// doJSON sends req and decodes a successful JSON response into out.
+func doJSON(req *http.Request, out any) error {
+	resp, err := providerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	// Token endpoints report errors such as a bad code as JSON with a 400,
+	// which the caller wants to see.
+	if resp.StatusCode >= 300 && !(resp.StatusCode == http.StatusBadRequest && json.Valid(body)) {
+		return fmt.Errorf("%s %s returned %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,63 @@
+package oauth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type OAuthRepository interface {
+	CreateState(state *AuthState) error
+	// ConsumeState removes and returns the state, so that it can't be used
+	// for a second login.
+	ConsumeState(state string) (*AuthState, error)
+}
+
+// DynamoOAuthRepository stores login states in the OAuthStates table, keyed
+// by State and cleaned up through TTL on ExpiresAtTTL.
+type DynamoOAuthRepository struct {
+	Client *dynamodb.Client
+}
+
+func (r *DynamoOAuthRepository) CreateState(state *AuthState) error {
+	item, err := attributevalue.MarshalMap(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal OAuth state: %w", err)
+	}
+
+	_, err = r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String("OAuthStates"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#State)"),
+		ExpressionAttributeNames: map[string]string{
+			"#State": "State",
+		},
+	})
+	return err
+}
+
+func (r *DynamoOAuthRepository) ConsumeState(state string) (*AuthState, error) {
+	result, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String("OAuthStates"),
+		Key: map[string]types.AttributeValue{
+			"State": &types.AttributeValueMemberS{Value: state},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Attributes) == 0 {
+		return nil, ErrInvalidState
+	}
+
+	var stored AuthState
+	if err := attributevalue.UnmarshalMap(result.Attributes, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal OAuth state: %w", err)
+	}
+	return &stored, nil
+}
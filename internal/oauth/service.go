@@ -0,0 +1,115 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tabichanorg/tabichan-server/internal/user"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+)
+
+var (
+	ErrUnknownProvider  = errors.New("unknown login provider")
+	ErrInvalidState     = errors.New("login state is invalid or has expired")
+	ErrIdentityRejected = errors.New("provider identity could not be verified")
+)
+
+// stateLifetime is how long a user has to finish logging in at the provider.
+const stateLifetime = 10 * time.Minute
+
+type OAuthService struct {
+	Providers map[string]Provider
+	Repo      OAuthRepository
+	Users     *user.UserService
+}
+
+// CallbackResult is the outcome of a callback: a login, an MFA challenge
+// for a user with two-factor authentication, or an identity linked to the
+// user who started the flow.
+type CallbackResult struct {
+	Login     *user.LoginRequestResponse
+	Challenge *user.MFAChallengeResponse
+	Linked    *user.LinkedIdentity
+}
+
+// Start begins a login with the provider and returns where to send the
+// browser along with the state it must come back with. With a linkUserID
+// the flow links the provider account to that user instead of logging in.
+func (s *OAuthService) Start(providerName, linkUserID string) (string, string, error) {
+	provider, ok := s.Providers[providerName]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate state: %v", err)
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	codeVerifier, err := randomToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate code verifier: %v", err)
+	}
+
+	authURL, err := provider.AuthCodeURL(state, nonce, codeChallenge(codeVerifier))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to build %s login URL: %v", providerName, err)
+	}
+
+	expiresAt := time.Now().Add(stateLifetime)
+	err = s.Repo.CreateState(&AuthState{
+		State:        state,
+		Provider:     providerName,
+		LinkUserID:   linkUserID,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		ExpiresAt:    expiresAt.Format(time.RFC3339),
+		ExpiresAtTTL: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store state: %v", err)
+	}
+
+	return authURL, state, nil
+}
+
+// Callback finishes a flow: it redeems the code for the provider identity
+// and either links it or logs in as the user it belongs to.
+func (s *OAuthService) Callback(ctx context.Context, providerName, state, code, device string) (*CallbackResult, error) {
+	provider, ok := s.Providers[providerName]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	stored, err := s.Repo.ConsumeState(state)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt, err := utils.ConvertTimeStringToRFC3339(stored.ExpiresAt)
+	if err != nil || time.Now().After(expiresAt) || stored.Provider != providerName {
+		return nil, ErrInvalidState
+	}
+
+	identity, err := provider.Exchange(ctx, code, stored.CodeVerifier, stored.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if stored.LinkUserID != "" {
+		linked, err := s.Users.LinkIdentity(stored.LinkUserID, *identity)
+		if err != nil {
+			return nil, err
+		}
+		return &CallbackResult{Linked: linked}, nil
+	}
+
+	login, challenge, err := s.Users.LoginWithProvider(*identity, device)
+	if err != nil {
+		return nil, err
+	}
+	return &CallbackResult{Login: login, Challenge: challenge}, nil
+}
@@ -1,78 +1,271 @@
 package server
 
 import (
+	"log"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/gorilla/mux"
-	"github.com/tabichanorg/tabichan-server/internal/db"
+	"github.com/tabichanorg/tabichan-server/internal/config"
 	"github.com/tabichanorg/tabichan-server/internal/healthcheck"
+	"github.com/tabichanorg/tabichan-server/internal/mailer"
 	middleware "github.com/tabichanorg/tabichan-server/internal/middleware/session"
+	"github.com/tabichanorg/tabichan-server/internal/oauth"
 	"github.com/tabichanorg/tabichan-server/internal/trip"
 	"github.com/tabichanorg/tabichan-server/internal/user"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+	"github.com/tabichanorg/tabichan-server/internal/webauthn"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func SetupRoutes(mux *mux.Router) *mux.Router {
+type Repositories struct {
+	Trip       trip.TripRepository
+	User       user.UserRepository
+	Middleware middleware.MiddlewareRepository
+	OAuth      oauth.OAuthRepository
+	WebAuthn   webauthn.WebAuthnRepository
+}
+
+func SetupRoutes(mux *mux.Router, cfg *config.Config, repos *Repositories, tokens *utils.JWTKeySet) *mux.Router {
 	mux.HandleFunc("/healthcheck", healthcheck.HealthCheck).Methods("GET")
 
-	userHandler := initUserHandler()
-	initRoute(mux, "/signup", userHandler.Signup, false, "POST")
-	initRoute(mux, "/login", userHandler.Login, false, "POST")
-	initRoute(mux, "/user/details", userHandler.GetUser, true, "GET")
+	auth := initMiddleware(repos, tokens)
+
+	userHandler := initUserHandler(cfg, repos, tokens)
+	mux.HandleFunc("/.well-known/jwks.json", userHandler.JWKS).Methods("GET")
+	initRoute(mux, auth, "/signup", userHandler.Signup, false, "POST")
+	initRoute(mux, auth, "/login", userHandler.Login, false, "POST")
+	initRoute(mux, auth, "/login/mfa", userHandler.LoginMFA, false, "POST")
+	initRoute(mux, auth, "/user/details", userHandler.GetUser, true, "GET")
+	initRoute(mux, auth, "/logout", userHandler.Logout, false, "POST")
+	initRoute(mux, auth, "/token/refresh", userHandler.RefreshToken, false, "POST")
+	initRoute(mux, auth, "/password/forgot", userHandler.ForgotPassword, false, "POST")
+	initRoute(mux, auth, "/password/reset", userHandler.ResetPassword, false, "POST")
+	initRoute(mux, auth, "/password", userHandler.ChangePassword, true, "PUT")
+	initRoute(mux, auth, "/verify-email", userHandler.VerifyEmail, false, "GET")
+	initRoute(mux, auth, "/verify-email", userHandler.ResendVerification, true, "POST")
+	initRoute(mux, auth, "/user/email", userHandler.ChangeEmail, true, "PUT")
+
+	initRoute(mux, auth, "/mfa", userHandler.GetMFAStatus, true, "GET")
+	initRoute(mux, auth, "/mfa/totp", userHandler.EnrollTOTP, true, "POST")
+	initRoute(mux, auth, "/mfa/totp/confirm", userHandler.ConfirmTOTP, true, "POST")
+	initRoute(mux, auth, "/mfa/totp", userHandler.DisableTOTP, true, "DELETE")
+	initRoute(mux, auth, "/mfa/recovery-codes", userHandler.RegenerateRecoveryCodes, true, "POST")
+	initRoute(mux, auth, "/sessions", userHandler.GetSessions, true, "GET")
+	initRoute(mux, auth, "/sessions", userHandler.RevokeAllSessions, true, "DELETE")
+	initRoute(mux, auth, "/sessions/{sessionID}", userHandler.RevokeSession, true, "DELETE")
+
+	oauthHandler := initOAuthHandler(cfg, repos, userHandler.Service)
+	initRoute(mux, auth, "/oauth/{provider}/start", oauthHandler.Start, false, "GET")
+	initRoute(mux, auth, "/oauth/{provider}/callback", oauthHandler.Callback, false, "GET")
+	initRoute(mux, auth, "/oauth/{provider}/link", oauthHandler.Link, true, "GET")
+	initRoute(mux, auth, "/identities", userHandler.GetIdentities, true, "GET")
+	initRoute(mux, auth, "/identities/{provider}/{subject}", userHandler.UnlinkIdentity, true, "DELETE")
 
-	initTripRoutes(mux)
+	webAuthnHandler := initWebAuthnHandler(cfg, repos, userHandler.Service)
+	initRoute(mux, auth, "/webauthn/register/begin", webAuthnHandler.BeginRegistration, true, "POST")
+	initRoute(mux, auth, "/webauthn/register/finish", webAuthnHandler.FinishRegistration, true, "POST")
+	initRoute(mux, auth, "/webauthn/login/begin", webAuthnHandler.BeginLogin, false, "POST")
+	initRoute(mux, auth, "/webauthn/login/finish", webAuthnHandler.FinishLogin, false, "POST")
+	initRoute(mux, auth, "/webauthn/credentials", webAuthnHandler.GetCredentials, true, "GET")
+	initRoute(mux, auth, "/webauthn/credentials/{credentialID}", webAuthnHandler.DeleteCredential, true, "DELETE")
+
+	initTripRoutes(mux, cfg, repos, auth)
 
 	return mux
 }
 
-func initTripRoutes(mux *mux.Router) {
-	tripHandler := initTripHandler()
-	initRoute(mux, "/trips", tripHandler.GetTrips, true, "GET")
-	initRoute(mux, "/trips/{tripID}", tripHandler.GetTrip, true, "GET")
-	initRoute(mux, "/trips", tripHandler.CreateTrip, true, "POST")
-	// initRoute(mux, "/trips/{tripID}", tripHandler.EditTrip, true, "PUT")
-	initRoute(mux, "/trips/{tripID}", tripHandler.DeleteTrip, true, "DELETE")
-
-	initRoute(mux, "/itineraries/{planID}", tripHandler.GetItineraries, true, "GET")
-	initRoute(mux, "/itineraries", tripHandler.CreateItinerary, true, "POST")
-	initRoute(mux, "/itineraries/{itineraryID}", tripHandler.GetItinerary, true, "GET")
-	// initRoute(mux, "/itineraries/{itineraryID}", tripHandler.EditItinerary, true, "PUT")
-	initRoute(mux, "/itineraries/{itineraryID}", tripHandler.DeleteItinerary, true, "DELETE")
-
-	// initRoute(mux, "/itineraries/{itineraryID}/items", tripHandler.GetItineraryItems, true, "GET")
-	// initRoute(mux, "/itineraries/{itineraryID}/{itineraryItemID}", tripHandler.GetItineraryItem, true, "GET")
-	// initRoute(mux, "/itineraries/{itineraryID}", tripHandler.CreateItineraryItem, true, "POST")
-	// initRoute(mux, "/itineraries/{itineraryID}/{itineraryItemID}", tripHandler.EditItineraryItem, true, "PUT")
-	// initRoute(mux, "/itineraries/{itineraryID}/{itineraryItemID}", tripHandler.DeleteItineraryItem, true, "DELETE")
-
-	// initRoute(mux, "/plans/{planID}", tripHandler.GetPlan, true, "GET") // get itinerary (+items), get planitems
-	// initRoute(mux, "/plans/{planID}/items", tripHandler.GetPlanItems, true, "GET")
-	// initRoute(mux, "/plans/{planID}/{planItemID}", tripHandler.GetPlanItem, true, "GET")
-	// initRoute(mux, "/plans/{planID}", tripHandler.CreatePlanItem, true, "POST")
-	// initRoute(mux, "/plans/{planID}/{planItemID}", tripHandler.EditPlanItem, true, "PUT")
-	// initRoute(mux, "/plans/{planID}/{planItemID}", tripHandler.DeletePlanItem, true, "DELETE")
+func initTripRoutes(mux *mux.Router, cfg *config.Config, repos *Repositories, auth *middleware.MiddlewareService) {
+	tripHandler := initTripHandler(cfg, repos)
+	initRoute(mux, auth, "/trips", tripHandler.GetTrips, true, "GET")
+	initRoute(mux, auth, "/trips/{tripID}", tripHandler.GetTrip, true, "GET")
+	initRoute(mux, auth, "/trips", tripHandler.CreateTrip, true, "POST")
+	initRoute(mux, auth, "/trips/{tripID}", tripHandler.EditTrip, true, "PATCH")
+	initRoute(mux, auth, "/trips/{tripID}", tripHandler.DeleteTrip, true, "DELETE")
+
+	initRoute(mux, auth, "/trips/{tripID}/members", tripHandler.GetMembers, true, "GET")
+	initRoute(mux, auth, "/trips/{tripID}/members", tripHandler.InviteMember, true, "POST")
+	initRoute(mux, auth, "/trips/{tripID}/members/{userID}", tripHandler.UpdateMember, true, "PUT")
+	initRoute(mux, auth, "/trips/{tripID}/members/{userID}", tripHandler.RemoveMember, true, "DELETE")
+
+	initRoute(mux, auth, "/invitations", tripHandler.GetInvitations, true, "GET")
+	initRoute(mux, auth, "/invitations/{tripID}/accept", tripHandler.AcceptInvitation, true, "POST")
+	initRoute(mux, auth, "/invitations/{tripID}/decline", tripHandler.DeclineInvitation, true, "POST")
+
+	initRoute(mux, auth, "/itineraries", tripHandler.CreateItinerary, true, "POST")
+	initRoute(mux, auth, "/itineraries/{itineraryID}", tripHandler.GetItinerary, true, "GET")
+	initRoute(mux, auth, "/itineraries/{itineraryID}", tripHandler.EditItinerary, true, "PATCH")
+	initRoute(mux, auth, "/itineraries/{itineraryID}", tripHandler.DeleteItinerary, true, "DELETE")
+
+	initRoute(mux, auth, "/itineraries/{itineraryID}/items", tripHandler.GetItineraryItems, true, "GET")
+	initRoute(mux, auth, "/itineraries/{itineraryID}/items/{itineraryItemID}", tripHandler.GetItineraryItem, true, "GET")
+	initRoute(mux, auth, "/itineraries/{itineraryID}/items", tripHandler.CreateItineraryItem, true, "POST")
+	initRoute(mux, auth, "/itineraries/{itineraryID}/items/{itineraryItemID}", tripHandler.EditItineraryItem, true, "PUT")
+	initRoute(mux, auth, "/itineraries/{itineraryID}/items/{itineraryItemID}", tripHandler.DeleteItineraryItem, true, "DELETE")
+
+	initRoute(mux, auth, "/plans/{planID}", tripHandler.GetPlan, true, "GET")
+	initRoute(mux, auth, "/plans/{planID}/itineraries", tripHandler.GetItineraries, true, "GET")
+	initRoute(mux, auth, "/plans/{planID}/items", tripHandler.GetPlanItems, true, "GET")
+	initRoute(mux, auth, "/plans/{planID}/items/{planItemID}", tripHandler.GetPlanItem, true, "GET")
+	initRoute(mux, auth, "/plans/{planID}/items", tripHandler.CreatePlanItem, true, "POST")
+	initRoute(mux, auth, "/plans/{planID}/items/{planItemID}", tripHandler.EditPlanItem, true, "PUT")
+	initRoute(mux, auth, "/plans/{planID}/items/{planItemID}", tripHandler.DeletePlanItem, true, "DELETE")
+	initRoute(mux, auth, "/plans/{planID}/items/{planItemID}/schedule", tripHandler.SchedulePlanItem, true, "POST")
+}
+
+func initUserHandler(cfg *config.Config, repos *Repositories, tokens *utils.JWTKeySet) *user.UserHandler {
+	policy, err := user.LoadPasswordPolicy(cfg.Password.MinLength, cfg.Password.BreachedFile)
+	if err != nil {
+		log.Fatalf("Failed to load password policy: %v", err)
+	}
+	if cfg.Password.Hasher == config.HasherBcrypt {
+		policy.MaxLength = utils.BcryptMaxPasswordLength
+	}
+
+	userService := &user.UserService{
+		Repo:     repos.User,
+		Tokens:   tokens,
+		Mailer:   initMailer(cfg),
+		Verifier: user.NewEmailVerifier(cfg.EmailVerificationSecret),
+		AppURL:   cfg.AppURL,
+		Hasher:   initPasswordHasher(cfg),
+		Policy:   policy,
+	}
+	return &user.UserHandler{Service: userService, TrustProxyHeaders: cfg.TrustProxyHeaders}
+}
+
+func initPasswordHasher(cfg *config.Config) utils.PasswordHasher {
+	password := cfg.Password
+	switch password.Hasher {
+	case config.HasherArgon2id:
+		if password.Argon2Time < 1 || password.Argon2Threads < 1 || password.Argon2Threads > 255 || password.Argon2Memory < 8*password.Argon2Threads {
+			log.Fatalf("Invalid argon2id parameters: time %d, memory %d KiB, threads %d", password.Argon2Time, password.Argon2Memory, password.Argon2Threads)
+		}
+		return &utils.Argon2idHasher{
+			Time:    uint32(password.Argon2Time),
+			Memory:  uint32(password.Argon2Memory),
+			Threads: uint8(password.Argon2Threads),
+		}
+	case config.HasherBcrypt:
+		if password.BcryptCost < bcrypt.MinCost || password.BcryptCost > bcrypt.MaxCost {
+			log.Fatalf("Invalid BCRYPT_COST %d, must be between %d and %d", password.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return &utils.BcryptHasher{Cost: password.BcryptCost}
+	default:
+		log.Fatalf("Unknown PASSWORD_HASHER %q", password.Hasher)
+		return nil
+	}
+}
+
+func initMailer(cfg *config.Config) mailer.Mailer {
+	switch cfg.Mail.Mailer {
+	case config.MailerLog:
+		log.Println("Emails are written to the log, set MAILER to send them")
+		return &mailer.LogMailer{}
+	case config.MailerFile:
+		return &mailer.FileMailer{Dir: cfg.Mail.Dir, From: cfg.Mail.From}
+	case config.MailerSMTP:
+		return &mailer.SMTPMailer{
+			Addr:     cfg.Mail.SMTPAddr,
+			Username: cfg.Mail.SMTPUsername,
+			Password: cfg.Mail.SMTPPassword,
+			From:     cfg.Mail.From,
+		}
+	default:
+		log.Fatalf("Unknown MAILER %q, expected log, file or smtp", cfg.Mail.Mailer)
+		return nil
+	}
+}
+
+// initWebAuthnHandler scopes passkeys to the web app's host unless
+// WEBAUTHN_RP_ID says otherwise, and accepts them from the web app's origin
+// unless WEBAUTHN_ORIGINS lists others.
+func initWebAuthnHandler(cfg *config.Config, repos *Repositories, users *user.UserService) *webauthn.WebAuthnHandler {
+	appURL, err := url.Parse(cfg.AppURL)
+	if err != nil {
+		log.Fatalf("Invalid APP_URL %q: %v", cfg.AppURL, err)
+	}
+
+	rpID := cfg.WebAuthn.RPID
+	if rpID == "" {
+		rpID = appURL.Hostname()
+	}
+	origins := []string{appURL.Scheme + "://" + appURL.Host}
+	if cfg.WebAuthn.Origins != "" {
+		origins = strings.Split(cfg.WebAuthn.Origins, ",")
+		for i := range origins {
+			origins[i] = strings.TrimSpace(origins[i])
+		}
+	}
+
+	webAuthnService := &webauthn.WebAuthnService{
+		RPID:    rpID,
+		RPName:  cfg.WebAuthn.RPName,
+		Origins: origins,
+		Repo:    repos.WebAuthn,
+		Users:   users,
+	}
+	return &webauthn.WebAuthnHandler{Service: webAuthnService}
 }
 
-func initUserHandler() *user.UserHandler {
-	userRepo := &user.UserRepository{Client: db.DynamoClient}
-	userService := &user.UserService{Repo: userRepo}
-	return &user.UserHandler{Service: userService}
+// initOAuthHandler enables the login providers that have a client ID.
+func initOAuthHandler(cfg *config.Config, repos *Repositories, users *user.UserService) *oauth.OAuthHandler {
+	callbackURL := func(provider string) string {
+		return strings.TrimSuffix(cfg.OAuthRedirectBaseURL, "/") + "/oauth/" + provider + "/callback"
+	}
+
+	providers := map[string]oauth.Provider{}
+	if cfg.Google.ClientID != "" {
+		providers["google"] = &oauth.OIDCProvider{
+			ProviderName: "google",
+			Issuer:       cfg.Google.URL,
+			ClientID:     cfg.Google.ClientID,
+			ClientSecret: cfg.Google.ClientSecret,
+			RedirectURL:  callbackURL("google"),
+		}
+	}
+	if cfg.GitHub.ClientID != "" {
+		providers["github"] = &oauth.GitHubProvider{
+			BaseURL:      cfg.GitHub.URL,
+			APIURL:       cfg.GitHub.APIURL,
+			ClientID:     cfg.GitHub.ClientID,
+			ClientSecret: cfg.GitHub.ClientSecret,
+			RedirectURL:  callbackURL("github"),
+		}
+	}
+
+	oauthService := &oauth.OAuthService{Providers: providers, Repo: repos.OAuth, Users: users}
+	return &oauth.OAuthHandler{Service: oauthService, SuccessRedirect: cfg.OAuthSuccessRedirect}
 }
 
-func initTripHandler() *trip.TripHandler {
-	tripRepo := &trip.TripRepository{Client: db.DynamoClient}
-	tripService := &trip.TripService{Repo: tripRepo}
+func initTripHandler(cfg *config.Config, repos *Repositories) *trip.TripHandler {
+	tripService := &trip.TripService{
+		Repo:    repos.Trip,
+		Users:   repos.User,
+		Cursors: utils.NewCursorCodec(cfg.CursorSecret),
+	}
 	return &trip.TripHandler{Service: tripService}
 }
 
-func initMiddleware() *middleware.MiddlewareService {
-	middlewareRepo := &middleware.MiddlewareRepository{Client: db.DynamoClient}
-	return &middleware.MiddlewareService{Repo: middlewareRepo}
+func initWorkers(cfg *config.Config, repos *Repositories) []Worker {
+	var workers []Worker
+	if cfg.TripStatusInterval > 0 {
+		workers = append(workers, &trip.StatusWorker{
+			Service:  &trip.TripService{Repo: repos.Trip, Users: repos.User},
+			Interval: cfg.TripStatusInterval,
+		})
+	}
+	return workers
+}
+
+func initMiddleware(repos *Repositories, tokens *utils.JWTKeySet) *middleware.MiddlewareService {
+	return &middleware.MiddlewareService{Repo: repos.Middleware, Tokens: tokens}
 }
 
-func initRoute(mux *mux.Router, endpoint string, handlerFunc func(http.ResponseWriter, *http.Request), isSecureRoute bool, method string) {
-	middlewareService := initMiddleware()
+func initRoute(mux *mux.Router, auth *middleware.MiddlewareService, endpoint string, handlerFunc func(http.ResponseWriter, *http.Request), isSecureRoute bool, method string) {
 	if isSecureRoute {
-		mux.HandleFunc(endpoint, middlewareService.SessionMiddleware(handlerFunc)).Methods(method)
+		mux.HandleFunc(endpoint, auth.SessionMiddleware(handlerFunc)).Methods(method)
 		return
 	}
 	mux.HandleFunc(endpoint, handlerFunc).Methods(method)
@@ -7,33 +7,54 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/tabichanorg/tabichan-server/internal/config"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
 )
 
 type Server struct {
-	Addr   string
-	Server *http.Server
+	Addr    string
+	Server  *http.Server
+	Workers []Worker
+
+	stopWorkers context.CancelFunc
+}
+
+// Worker is a background job that runs alongside the HTTP server until its
+// context is canceled.
+type Worker interface {
+	Run(ctx context.Context)
 }
 
-func NewServer(addr string) *Server {
+func NewServer(cfg *config.Config, repos *Repositories, tokens *utils.JWTKeySet) *Server {
 	router := mux.NewRouter()
-	SetupRoutes(router)
+	SetupRoutes(router, cfg, repos, tokens)
 
 	return &Server{
-		Addr: addr,
+		Addr: cfg.Addr,
 		Server: &http.Server{
-			Addr:    addr,
+			Addr:    cfg.Addr,
 			Handler: corsHandler(router),
 		},
+		Workers: initWorkers(cfg, repos),
 	}
 }
 
 func (s *Server) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopWorkers = cancel
+	for _, worker := range s.Workers {
+		go worker.Run(ctx)
+	}
+
 	log.Printf("Starting server on %s", s.Addr)
 	return s.Server.ListenAndServe()
 }
 
 func (s *Server) Shutdown(timeout time.Duration) error {
 	log.Println("Shutting down server...")
+	if s.stopWorkers != nil {
+		s.stopWorkers()
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -44,8 +65,9 @@ func (s *Server) Shutdown(timeout time.Duration) error {
 func corsHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
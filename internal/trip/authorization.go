@@ -0,0 +1,141 @@
+package trip
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Action is what a user is trying to do with a trip or anything inside it.
+type Action int
+
+const (
+	ActionRead Action = iota
+	ActionEdit
+	ActionManage
+)
+
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleEditor Role = "editor"
+	RoleViewer Role = "viewer"
+)
+
+func (r Role) Valid() bool {
+	return r == RoleOwner || r == RoleEditor || r == RoleViewer
+}
+
+func (r Role) Can(action Action) bool {
+	switch r {
+	case RoleOwner:
+		return true
+	case RoleEditor:
+		return action <= ActionEdit
+	case RoleViewer:
+		return action == ActionRead
+	}
+	return false
+}
+
+// authorizeTrip loads the trip and checks that userID may perform action on
+// it. Every other authorize helper resolves its record to the owning trip and
+// ends up here.
+func (s *TripService) authorizeTrip(userID, tripID string, action Action) (*Trip, error) {
+	trip, err := s.Repo.GetTrip(tripID)
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := s.roleFor(userID, trip)
+	if err != nil {
+		return nil, err
+	}
+	if !role.Can(action) {
+		return nil, ErrForbidden
+	}
+
+	return trip, nil
+}
+
+func (s *TripService) authorizePlan(userID, planID string, action Action) (*Plan, *Trip, error) {
+	plan, err := s.Repo.GetPlan(planID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	trip, err := s.authorizeTrip(userID, plan.TripID, action)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return plan, trip, nil
+}
+
+func (s *TripService) authorizeItinerary(userID, itineraryID string, action Action) (*Itinerary, *Trip, error) {
+	itinerary, err := s.Repo.GetItinerary(itineraryID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	trip, err := s.authorizeTrip(userID, itinerary.TripID, action)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return itinerary, trip, nil
+}
+
+func (s *TripService) authorizeItineraryItem(userID, itineraryID, itineraryItemID string, action Action) (*ItineraryItem, *Trip, error) {
+	itineraryItem, err := s.Repo.GetItineraryItem(itineraryID, itineraryItemID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	trip, err := s.authorizeTrip(userID, itineraryItem.TripID, action)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return itineraryItem, trip, nil
+}
+
+// authorizePlanItem checks action against the trip that owns the plan item.
+func (s *TripService) authorizePlanItem(userID, planID, planItemID string, action Action) (*PlanItem, *Trip, error) {
+	planItem, err := s.Repo.GetPlanItem(planID, planItemID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	trip, err := s.authorizeTrip(userID, planItem.TripID, action)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return planItem, trip, nil
+}
+
+// roleFor returns the role userID holds on trip, or an empty role when they
+// aren't an accepted member. Trips created before memberships existed have no
+// owner row, so their creator is treated as the owner.
+func (s *TripService) roleFor(userID string, trip *Trip) (Role, error) {
+	if userID == "" {
+		return "", fmt.Errorf("missing user ID")
+	}
+
+	member, err := s.Repo.GetMember(trip.ID, userID)
+	if errors.Is(err, ErrMemberNotFound) {
+		if trip.CreatedBy == userID {
+			return RoleOwner, nil
+		}
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if member.Status != MemberStatusAccepted {
+		return "", nil
+	}
+	return member.Role, nil
+}
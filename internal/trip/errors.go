@@ -0,0 +1,43 @@
+package trip
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTripNotFound          = errors.New("trip doesn't exist")
+	ErrPlanNotFound          = errors.New("plan doesn't exist")
+	ErrItineraryNotFound     = errors.New("itinerary doesn't exist")
+	ErrItineraryItemNotFound = errors.New("itinerary item doesn't exist")
+	ErrPlanItemNotFound      = errors.New("plan item doesn't exist")
+	ErrMemberNotFound        = errors.New("trip member doesn't exist")
+	ErrUserNotFound          = errors.New("user not found")
+	ErrForbidden             = errors.New("you don't have access to this trip")
+	ErrAlreadyMember         = errors.New("user is already a member of this trip")
+	ErrLastOwner             = errors.New("a trip must keep at least one owner")
+	ErrTripCreator           = errors.New("the trip creator can't be removed from the trip")
+	ErrInvalidRole           = errors.New("role must be one of owner, editor or viewer")
+	ErrInvalidPatch          = errors.New("invalid merge patch")
+	ErrPreconditionFailed    = errors.New("the resource has changed since it was last read")
+	ErrInvalidTransition     = errors.New("the trip can't move to that status from its current one")
+	ErrEmailNotVerified      = errors.New("verify your email address before sharing trips")
+)
+
+// ValidationError reports input that failed validation, as opposed to a
+// failure while reading or writing data.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func validationErrorf(format string, args ...any) error {
+	return &ValidationError{Err: fmt.Errorf(format, args...)}
+}
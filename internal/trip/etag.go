@@ -0,0 +1,77 @@
+package trip
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Precondition is a parsed If-Match header. The zero value matches any
+// version, which is what a request without the header gets.
+type Precondition struct {
+	etags []string
+}
+
+func ParsePrecondition(header string) Precondition {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return Precondition{}
+	}
+
+	return Precondition{etags: splitETags(header)}
+}
+
+// Matches uses the strong comparison RFC 9110 requires for If-Match, so weak
+// ETags never match.
+func (p Precondition) Matches(version int64) bool {
+	if p.etags == nil {
+		return true
+	}
+
+	current := ETag(version)
+	for _, etag := range p.etags {
+		if etag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// ETag formats a record version as a strong entity tag.
+func ETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", ETag(version))
+}
+
+// notModified reports whether the request's If-None-Match header already
+// names the current version. It uses weak comparison, so W/"3" matches "3".
+func notModified(r *http.Request, version int64) bool {
+	header := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+
+	current := ETag(version)
+	for _, etag := range splitETags(header) {
+		if strings.TrimPrefix(etag, "W/") == current {
+			return true
+		}
+	}
+	return false
+}
+
+func splitETags(header string) []string {
+	etags := []string{}
+	for _, etag := range strings.Split(header, ",") {
+		if etag = strings.TrimSpace(etag); etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
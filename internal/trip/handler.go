@@ -2,7 +2,14 @@ package trip
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -11,6 +18,8 @@ type TripHandler struct {
 	Service *TripService
 }
 
+const maxPatchSize = 64 << 10
+
 func (h *TripHandler) GetTrips(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
@@ -18,9 +27,20 @@ func (h *TripHandler) GetTrips(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	trips, err := h.Service.GetTrips(userID)
+	limit, err := pageLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, err := tripQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	trips, err := h.Service.GetTrips(userID, query, limit, r.URL.Query().Get("cursor"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -28,11 +48,22 @@ func (h *TripHandler) GetTrips(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *TripHandler) GetTrip(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
 	tripID := mux.Vars(r)["tripID"]
 
-	tripData, err := h.Service.GetTrip(tripID)
+	tripData, err := h.Service.GetTrip(userID, tripID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	setETag(w, tripData.Version)
+	if notModified(r, tripData.Version) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
@@ -55,35 +86,181 @@ func (h *TripHandler) CreateTrip(w http.ResponseWriter, r *http.Request) {
 
 	tripData, err := h.Service.CreateTrip(createTripData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
+	setETag(w, tripData.Version)
 	json.NewEncoder(w).Encode(tripData)
 }
 
-// func (h *TripHandler) EditTrip(w http.ResponseWriter, r *http.Request) {
-// 	var editTripData Trip
-// 	if err := json.NewDecoder(r.Body).Decode(&editTripData); err != nil {
-// 		http.Error(w, "Invalid request", http.StatusBadRequest)
-// 		return
-// 	}
+func (h *TripHandler) EditTrip(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	tripID := mux.Vars(r)["tripID"]
 
-// 	tripData, err := h.Service.EditTrip(editTripData)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
+	patch, err := readMergePatch(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), patchReadStatus(err))
+		return
+	}
+
+	tripData, err := h.Service.EditTrip(userID, tripID, patch, ParsePrecondition(r.Header.Get("If-Match")))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
 
-// 	json.NewEncoder(w).Encode(tripData)
-// }
+	setETag(w, tripData.Version)
+	json.NewEncoder(w).Encode(tripData)
+}
 
 func (h *TripHandler) DeleteTrip(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	tripID := mux.Vars(r)["tripID"]
+
+	response, err := h.Service.DeleteTrip(userID, tripID, ParsePrecondition(r.Header.Get("If-Match")))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *TripHandler) GetMembers(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	tripID := mux.Vars(r)["tripID"]
+
+	members, err := h.Service.GetMembers(userID, tripID)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(members)
+}
+
+func (h *TripHandler) InviteMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	tripID := mux.Vars(r)["tripID"]
+
+	var inviteData InviteMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&inviteData); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	member, err := h.Service.InviteMember(userID, tripID, inviteData)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(member)
+}
+
+func (h *TripHandler) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	vars := mux.Vars(r)
+
+	var updateData UpdateMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	member, err := h.Service.UpdateMemberRole(userID, vars["tripID"], vars["userID"], updateData.Role)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(member)
+}
+
+func (h *TripHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	vars := mux.Vars(r)
+
+	err := h.Service.RemoveMember(userID, vars["tripID"], vars["userID"])
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *TripHandler) GetInvitations(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	invitations, err := h.Service.GetInvitations(userID)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(invitations)
+}
+
+func (h *TripHandler) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
 	tripID := mux.Vars(r)["tripID"]
 
-	err := h.Service.DeleteTrip(tripID)
+	member, err := h.Service.RespondToInvitation(userID, tripID, true)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(member)
+}
+
+func (h *TripHandler) DeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	tripID := mux.Vars(r)["tripID"]
+
+	_, err := h.Service.RespondToInvitation(userID, tripID, false)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -91,11 +268,22 @@ func (h *TripHandler) DeleteTrip(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *TripHandler) GetItineraries(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
 	planID := mux.Vars(r)["planID"]
 
-	itineraries, err := h.Service.GetItineraries(planID)
+	limit, err := pageLimit(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	itineraries, err := h.Service.GetItineraries(userID, planID, limit, r.URL.Query().Get("cursor"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -103,11 +291,22 @@ func (h *TripHandler) GetItineraries(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *TripHandler) GetItinerary(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
 	itineraryID := mux.Vars(r)["itineraryID"]
 
-	itinerary, err := h.Service.GetItinerary(itineraryID)
+	itinerary, err := h.Service.GetItinerary(userID, itineraryID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	setETag(w, itinerary.Version)
+	if notModified(r, itinerary.Version) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
@@ -115,194 +314,448 @@ func (h *TripHandler) GetItinerary(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *TripHandler) CreateItinerary(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
 	var createItineraryData Itinerary
 	if err := json.NewDecoder(r.Body).Decode(&createItineraryData); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	itineraryData, err := h.Service.CreateItinerary(createItineraryData)
+	itineraryData, err := h.Service.CreateItinerary(userID, createItineraryData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
+	setETag(w, itineraryData.Version)
 	json.NewEncoder(w).Encode(itineraryData)
 }
 
-// func (h *TripHandler) EditItinerary(w http.ResponseWriter, r *http.Request) {
-// 	var editItineraryData Itinerary
-// 	if err := json.NewDecoder(r.Body).Decode(&editItineraryData); err != nil {
-// 		http.Error(w, "Invalid request", http.StatusBadRequest)
-// 		return
-// 	}
+func (h *TripHandler) EditItinerary(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	itineraryID := mux.Vars(r)["itineraryID"]
+
+	patch, err := readMergePatch(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), patchReadStatus(err))
+		return
+	}
 
-// 	itineraryData, err := h.Service.EditItinerary(editItineraryData)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
+	itineraryData, err := h.Service.EditItinerary(userID, itineraryID, patch, ParsePrecondition(r.Header.Get("If-Match")))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
 
-// 	json.NewEncoder(w).Encode(itineraryData)
-// }
+	setETag(w, itineraryData.Version)
+	json.NewEncoder(w).Encode(itineraryData)
+}
 
 func (h *TripHandler) DeleteItinerary(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
 	itineraryID := mux.Vars(r)["itineraryID"]
 
-	err := h.Service.DeleteItinerary(itineraryID)
+	err := h.Service.DeleteItinerary(userID, itineraryID, ParsePrecondition(r.Header.Get("If-Match")))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-// func (h *TripHandler) GetItineraryItems(w http.ResponseWriter, r *http.Request) {
-// 	itineraryID := mux.Vars(r)["itineraryID"]
+func (h *TripHandler) GetItineraryItems(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	itineraryID := mux.Vars(r)["itineraryID"]
+
+	itineraryItems, err := h.Service.GetItineraryItems(userID, itineraryID)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
 
-// 	itineraryItems, err := h.Service.GetItineraryItems(itineraryID)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
+	json.NewEncoder(w).Encode(itineraryItems)
+}
 
-// 	json.NewEncoder(w).Encode(itineraryItems)
-// }
+func (h *TripHandler) GetItineraryItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	vars := mux.Vars(r)
 
-// func (h *TripHandler) GetItineraryItem(w http.ResponseWriter, r *http.Request) {
-// 	itineraryItemID := mux.Vars(r)["itineraryItemID"]
+	itineraryItem, err := h.Service.GetItineraryItem(userID, vars["itineraryID"], vars["itineraryItemID"])
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
 
-// 	itineraryItem, err := h.Service.GetItineraryItem(itineraryItemID)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
+	setETag(w, itineraryItem.Version)
+	if notModified(r, itineraryItem.Version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-// 	json.NewEncoder(w).Encode(itineraryItem)
-// }
+	json.NewEncoder(w).Encode(itineraryItem)
+}
 
 func (h *TripHandler) CreateItineraryItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
 	var createItineraryItemData ItineraryItem
 	if err := json.NewDecoder(r.Body).Decode(&createItineraryItemData); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	createItineraryItemData.ItineraryID = mux.Vars(r)["itineraryID"]
+
+	itineraryItemData, err := h.Service.CreateItineraryItem(userID, createItineraryItemData)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	setETag(w, itineraryItemData.Version)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(itineraryItemData)
+}
+
+func (h *TripHandler) EditItineraryItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	vars := mux.Vars(r)
+
+	var editItineraryItemData ItineraryItem
+	if err := json.NewDecoder(r.Body).Decode(&editItineraryItemData); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	editItineraryItemData.ItineraryID = vars["itineraryID"]
+	editItineraryItemData.ID = vars["itineraryItemID"]
+
+	itineraryItemData, err := h.Service.EditItineraryItem(userID, editItineraryItemData, ParsePrecondition(r.Header.Get("If-Match")))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	setETag(w, itineraryItemData.Version)
+	json.NewEncoder(w).Encode(itineraryItemData)
+}
+
+func (h *TripHandler) DeleteItineraryItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	vars := mux.Vars(r)
+
+	err := h.Service.DeleteItineraryItem(userID, vars["itineraryID"], vars["itineraryItemID"], ParsePrecondition(r.Header.Get("If-Match")))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *TripHandler) GetPlan(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	planID := mux.Vars(r)["planID"]
+
+	plan, err := h.Service.GetPlan(userID, planID)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(plan)
+}
+
+func (h *TripHandler) GetPlanItems(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	planID := mux.Vars(r)["planID"]
+
+	planItems, err := h.Service.GetPlanItems(userID, planID)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(planItems)
+}
+
+func (h *TripHandler) GetPlanItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	vars := mux.Vars(r)
+
+	planItem, err := h.Service.GetPlanItem(userID, vars["planID"], vars["planItemID"])
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(planItem)
+}
+
+func (h *TripHandler) CreatePlanItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	var createPlanItemData PlanItem
+	if err := json.NewDecoder(r.Body).Decode(&createPlanItemData); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	createPlanItemData.PlanID = mux.Vars(r)["planID"]
 
-	itineraryItemData, err := h.Service.CreateItineraryItem(createItineraryItemData)
+	planItemData, err := h.Service.CreatePlanItem(userID, createPlanItemData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(planItemData)
+}
+
+func (h *TripHandler) EditPlanItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	vars := mux.Vars(r)
+
+	var editPlanItemData PlanItem
+	if err := json.NewDecoder(r.Body).Decode(&editPlanItemData); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	editPlanItemData.PlanID = vars["planID"]
+	editPlanItemData.ID = vars["planItemID"]
 
+	planItemData, err := h.Service.EditPlanItem(userID, editPlanItemData)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(planItemData)
+}
+
+func (h *TripHandler) DeletePlanItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	vars := mux.Vars(r)
+
+	err := h.Service.DeletePlanItem(userID, vars["planID"], vars["planItemID"])
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *TripHandler) SchedulePlanItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	vars := mux.Vars(r)
+
+	var scheduleData SchedulePlanItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&scheduleData); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	itineraryItemData, err := h.Service.SchedulePlanItem(userID, vars["planID"], vars["planItemID"], scheduleData)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	setETag(w, itineraryItemData.Version)
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(itineraryItemData)
 }
 
-// func (h *TripHandler) EditItineraryItem(w http.ResponseWriter, r *http.Request) {
-// 	var editItineraryItemData ItineraryItem
-// 	if err := json.NewDecoder(r.Body).Decode(&editItineraryItemData); err != nil {
-// 		http.Error(w, "Invalid request", http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	itineraryItemData, err := h.Service.EditItineraryItem(editItineraryItemData)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
-
-// 	json.NewEncoder(w).Encode(itineraryItemData)
-// }
-
-// func (h *TripHandler) DeleteItineraryItem(w http.ResponseWriter, r *http.Request) {
-// 	itineraryItemID := mux.Vars(r)["itineraryItemID"]
-
-// 	response, err := h.Service.DeleteItineraryItem(itineraryID)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
-
-// 	w.WriteHeader(http.StatusOK)
-// 	json.NewEncoder(w).Encode(response)
-// }
-
-// func (h *TripHandler) GetPlan(w http.ResponseWriter, r *http.Request) {
-// 	planID := mux.Vars(r)["planID"]
-
-// 	plan, err := h.Service.GetPlan(planID)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
-
-// 	json.NewEncoder(w).Encode(plan)
-// }
-
-// func (h *TripHandler) GetPlanItems(w http.ResponseWriter, r *http.Request) {
-// 	planID := mux.Vars(r)["planID"]
-
-// 	planItems, err := h.Service.GetPlanItems(planID)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
-
-// 	json.NewEncoder(w).Encode(planItems)
-// }
-
-// func (h *TripHandler) GetPlanItem(w http.ResponseWriter, r *http.Request) {
-// 	planItemID := mux.Vars(r)["planItemID"]
-
-// 	planItem, err := h.Service.GetPlanItem(planItemID)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
-
-// 	json.NewEncoder(w).Encode(planItem)
-// }
-
-// func (h *TripHandler) CreatePlanItem() (w http.ResponseWriter, r *http.Request) {
-// 	var createPlanItemData PlanItem
-// 	if err := json.NewDecoder(r.Body).Decode(&createPlanItemData); err != nil {
-// 		http.Error(w, "Invalid request", http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	planItemData, err := h.Service.CreatePlanItem(createPlanItemData)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
-
-// 	json.NewEncoder(w).Encode(planItemData)
-// }
-
-// func (h *TripHandler) EditPlanItem() (w http.ResponseWriter, r *http.Request) {
-// 	var editPlanItemData PlanItem
-// 	if err := json.NewDecoder(r.Body).Decode(&editPlanItemData); err != nil {
-// 		http.Error(w, "Invalid request", http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	planItemData, err := h.Service.EditPlanItem(editPlanItemData)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
-
-// 	json.NewEncoder(w).Encode(planItemData)
-// }
-
-// func (h *TripHandler) DeletePlanItem() (w http.ResponseWriter, r *http.Request) {
-// 	planItemID := mux.Vars(r)["planItemID"]
-
-// 	response, err := h.Service.DeletePlanItem(planItemID)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-// 		return
-// 	}
-
-// 	json.NewEncoder(w).Encode(response)
-// }
+// pageLimit reads the optional limit query parameter. Zero means the service
+// default.
+func pageLimit(r *http.Request) (int, error) {
+	limit := r.URL.Query().Get("limit")
+	if limit == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(limit)
+	if err != nil {
+		return 0, errors.New("limit must be a number")
+	}
+	return n, nil
+}
+
+// tripQuery reads the trip listing filters: status, draft, completed,
+// timeframe, from, to and title, plus sort and order.
+func tripQuery(r *http.Request) (TripQuery, error) {
+	params := r.URL.Query()
+	query := TripQuery{
+		Status:    TripStatus(params.Get("status")),
+		Timeframe: Timeframe(params.Get("timeframe")),
+		Title:     params.Get("title"),
+		Sort:      TripSort(params.Get("sort")),
+	}
+
+	var err error
+	if query.Draft, err = boolParam(params, "draft"); err != nil {
+		return query, err
+	}
+	if query.Completed, err = boolParam(params, "completed"); err != nil {
+		return query, err
+	}
+	if query.From, err = timeParam(params, "from"); err != nil {
+		return query, err
+	}
+	if query.To, err = timeParam(params, "to"); err != nil {
+		return query, err
+	}
+
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, errors.New("order must be asc or desc")
+	}
+
+	return query, nil
+}
+
+func boolParam(params url.Values, name string) (*bool, error) {
+	if !params.Has(name) {
+		return nil, nil
+	}
+
+	value, err := strconv.ParseBool(params.Get(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true or false", name)
+	}
+	return &value, nil
+}
+
+// timeParam accepts either an RFC 3339 timestamp or a plain date.
+func timeParam(params url.Values, name string) (*time.Time, error) {
+	if !params.Has(name) {
+		return nil, nil
+	}
+
+	value := params.Get(name)
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s must be a date or an RFC 3339 timestamp", name)
+}
+
+var errUnsupportedPatchType = errors.New("content type must be application/merge-patch+json")
+
+// readMergePatch reads a JSON Merge Patch body. Plain application/json is
+// accepted too since most clients send it by default.
+func readMergePatch(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != "application/merge-patch+json" && mediaType != "application/json") {
+			return nil, errUnsupportedPatchType
+		}
+	}
+
+	return io.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchSize))
+}
+
+func patchReadStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, errUnsupportedPatchType):
+		return http.StatusUnsupportedMediaType
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrForbidden),
+		errors.Is(err, ErrEmailNotVerified):
+		return http.StatusForbidden
+	case errors.Is(err, ErrTripNotFound),
+		errors.Is(err, ErrPlanNotFound),
+		errors.Is(err, ErrItineraryNotFound),
+		errors.Is(err, ErrItineraryItemNotFound),
+		errors.Is(err, ErrPlanItemNotFound),
+		errors.Is(err, ErrMemberNotFound),
+		errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAlreadyMember),
+		errors.Is(err, ErrLastOwner),
+		errors.Is(err, ErrTripCreator),
+		errors.Is(err, ErrInvalidTransition):
+		return http.StatusConflict
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrInvalidRole),
+		errors.Is(err, ErrInvalidPatch),
+		errors.As(err, new(*ValidationError)):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
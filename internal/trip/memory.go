@@ -0,0 +1,512 @@
+package trip
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tabichanorg/tabichan-server/internal/db"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+)
+
+type MemoryTripRepository struct {
+	// txMu serializes every write, so checks and writes that span several
+	// records or tables are all-or-nothing like TransactWriteItems and the
+	// conditional writes on the DynamoDB backend.
+	txMu sync.Mutex
+
+	Trips          *db.MemoryTable[Trip]
+	Plans          *db.MemoryTable[Plan]
+	Itineraries    *db.MemoryTable[Itinerary]
+	ItineraryItems *db.MemoryTable[ItineraryItem]
+	PlanItems      *db.MemoryTable[PlanItem]
+	Members        *db.MemoryTable[TripMember]
+}
+
+func NewMemoryTripRepository() *MemoryTripRepository {
+	return &MemoryTripRepository{
+		Trips:          db.NewMemoryTable[Trip](),
+		Plans:          db.NewMemoryTable[Plan](),
+		Itineraries:    db.NewMemoryTable[Itinerary](),
+		ItineraryItems: db.NewMemoryTable[ItineraryItem](),
+		PlanItems:      db.NewMemoryTable[PlanItem](),
+		Members:        db.NewMemoryTable[TripMember](),
+	}
+}
+
+func (r *MemoryTripRepository) GetTrips(userID string, query TripQuery, page db.PageRequest) ([]*Trip, db.PageKey, error) {
+	memberships := r.Members.Filter(func(member TripMember) bool {
+		return member.UserID == userID && member.Status == MemberStatusAccepted
+	})
+
+	var matches []Trip
+	for _, membership := range memberships {
+		if trip, ok := r.Trips.Get(membership.TripID); ok && query.Matches(&trip) {
+			matches = append(matches, trip)
+		}
+	}
+
+	sortKey := func(trip Trip) string {
+		if query.Sort == SortByCreatedAt {
+			return createdSortKey(trip.CreatedAt, trip.ID)
+		}
+		return startSortKey(trip.StartDate, trip.ID)
+	}
+	slices.SortFunc(matches, func(a, b Trip) int {
+		if query.Descending {
+			return strings.Compare(sortKey(b), sortKey(a))
+		}
+		return strings.Compare(sortKey(a), sortKey(b))
+	})
+	matches, lastKey := memoryPage(matches, page, query.Descending, sortKey)
+
+	trips := make([]*Trip, 0, len(matches))
+	for i := range matches {
+		trips = append(trips, &matches[i])
+	}
+	return trips, lastKey, nil
+}
+
+func (r *MemoryTripRepository) GetTrip(tripID string) (*Trip, error) {
+	trip, ok := r.Trips.Get(tripID)
+	if !ok {
+		return nil, ErrTripNotFound
+	}
+	return &trip, nil
+}
+
+func (r *MemoryTripRepository) GetTripsDue(status TripStatus, now time.Time) ([]*Trip, error) {
+	matches := r.Trips.Filter(func(trip Trip) bool {
+		dueDate, ok := trip.statusDueDate()
+		return trip.Status == status && ok && !dueDate.After(now)
+	})
+
+	trips := make([]*Trip, 0, len(matches))
+	for i := range matches {
+		trips = append(trips, &matches[i])
+	}
+	return trips, nil
+}
+
+func (r *MemoryTripRepository) CreateTrip(tripData *Trip, planData *Plan, owner *TripMember) error {
+	return r.transact(func() error {
+		if _, ok := r.Plans.Get(planData.PlanID); ok {
+			return fmt.Errorf("failed to create trip with ID %s: %w", planData.TripID, db.ErrConditionFailed)
+		}
+		if _, ok := r.Trips.Get(planData.TripID); ok {
+			return fmt.Errorf("failed to create trip with ID %s: %w", planData.TripID, db.ErrConditionFailed)
+		}
+
+		tripData.Version = 1
+		trip := *tripData
+		trip.ID = planData.TripID
+		trip.PlanID = planData.PlanID
+		r.Plans.Put(planData.PlanID, *planData)
+		r.Trips.Put(trip.ID, trip)
+		r.Members.Put(memberTableKey(owner.TripID, owner.UserID), *owner)
+		return nil
+	})
+}
+
+func (r *MemoryTripRepository) EditTrip(tripData *Trip) error {
+	return r.transact(func() error {
+		trip, ok := r.Trips.Get(tripData.ID)
+		if !ok {
+			return ErrTripNotFound
+		}
+		if trip.Version != tripData.Version {
+			return ErrPreconditionFailed
+		}
+
+		trip.StartDate = tripData.StartDate
+		trip.EndDate = tripData.EndDate
+		trip.Title = tripData.Title
+		trip.Completed = tripData.Completed
+		trip.Draft = tripData.Draft
+		trip.Status = tripData.Status
+		trip.StatusChangedBy = tripData.StatusChangedBy
+		trip.StatusChangedAt = tripData.StatusChangedAt
+		trip.Version++
+		r.Trips.Put(trip.ID, trip)
+
+		tripData.Version++
+		return nil
+	})
+}
+
+func (r *MemoryTripRepository) DeleteTrip(tripID string, version int64) (*DeleteTripResult, error) {
+	result := &DeleteTripResult{}
+	err := r.transact(func() error {
+		trip, ok := r.Trips.Get(tripID)
+		if !ok {
+			return ErrTripNotFound
+		}
+		if trip.Version != version {
+			return ErrPreconditionFailed
+		}
+
+		itineraries := r.Itineraries.Filter(func(itinerary Itinerary) bool {
+			return itinerary.TripID == tripID
+		})
+		for _, itinerary := range itineraries {
+			itineraryItems := r.ItineraryItems.Filter(func(item ItineraryItem) bool {
+				return item.ItineraryID == itinerary.ID
+			})
+			for _, item := range itineraryItems {
+				r.ItineraryItems.Delete(item.ID)
+			}
+			result.ItineraryItems += len(itineraryItems)
+
+			r.Itineraries.Delete(itinerary.ID)
+		}
+		result.Itineraries = len(itineraries)
+
+		planItems := r.PlanItems.Filter(func(planItem PlanItem) bool {
+			return planItem.TripID == tripID
+		})
+		for _, planItem := range planItems {
+			r.PlanItems.Delete(planItem.ID)
+		}
+		result.PlanItems = len(planItems)
+
+		plans := r.Plans.Filter(func(plan Plan) bool {
+			return plan.TripID == tripID
+		})
+		for _, plan := range plans {
+			r.Plans.Delete(plan.PlanID)
+		}
+		result.Plans = len(plans)
+
+		members := r.Members.Filter(func(member TripMember) bool {
+			return member.TripID == tripID
+		})
+		for _, member := range members {
+			r.Members.Delete(memberTableKey(member.TripID, member.UserID))
+		}
+		result.Members = len(members)
+
+		if r.Trips.Delete(tripID) {
+			result.Trips = 1
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *MemoryTripRepository) GetPlan(planID string) (*Plan, error) {
+	plan, ok := r.Plans.Get(planID)
+	if !ok {
+		return nil, ErrPlanNotFound
+	}
+	return &plan, nil
+}
+
+func (r *MemoryTripRepository) GetItineraries(planID string, page db.PageRequest) ([]*Itinerary, db.PageKey, error) {
+	matches := r.Itineraries.Filter(func(itinerary Itinerary) bool {
+		return itinerary.PlanID == planID
+	})
+	slices.SortFunc(matches, func(a, b Itinerary) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	matches, lastKey := memoryPage(matches, page, false, func(itinerary Itinerary) string {
+		return itinerary.ID
+	})
+
+	itineraries := make([]*Itinerary, 0, len(matches))
+	for i := range matches {
+		itineraries = append(itineraries, &matches[i])
+	}
+	return itineraries, lastKey, nil
+}
+
+func (r *MemoryTripRepository) GetItinerary(itineraryID string) (*Itinerary, error) {
+	itinerary, ok := r.Itineraries.Get(itineraryID)
+	if !ok {
+		return nil, ErrItineraryNotFound
+	}
+	return &itinerary, nil
+}
+
+func (r *MemoryTripRepository) CreateItinerary(createItineraryData Itinerary) (*Itinerary, error) {
+	createItineraryData.ID = utils.GenerateID()
+	createItineraryData.Version = 1
+	r.transact(func() error {
+		r.Itineraries.Put(createItineraryData.ID, createItineraryData)
+		return nil
+	})
+	return &createItineraryData, nil
+}
+
+func (r *MemoryTripRepository) EditItinerary(itineraryData *Itinerary) error {
+	return r.transact(func() error {
+		itinerary, ok := r.Itineraries.Get(itineraryData.ID)
+		if !ok {
+			return ErrItineraryNotFound
+		}
+		if itinerary.Version != itineraryData.Version {
+			return ErrPreconditionFailed
+		}
+
+		itinerary.ItineraryName = itineraryData.ItineraryName
+		itinerary.StartDate = itineraryData.StartDate
+		itinerary.EndDate = itineraryData.EndDate
+		itinerary.Version++
+		r.Itineraries.Put(itinerary.ID, itinerary)
+
+		itineraryData.Version++
+		return nil
+	})
+}
+
+func (r *MemoryTripRepository) DeleteItinerary(itineraryID string, version int64) error {
+	return r.transact(func() error {
+		itinerary, ok := r.Itineraries.Get(itineraryID)
+		if !ok {
+			return ErrItineraryNotFound
+		}
+		if itinerary.Version != version {
+			return ErrPreconditionFailed
+		}
+
+		itineraryItems := r.ItineraryItems.Filter(func(item ItineraryItem) bool {
+			return item.ItineraryID == itineraryID
+		})
+		for _, item := range itineraryItems {
+			r.ItineraryItems.Delete(item.ID)
+		}
+
+		r.Itineraries.Delete(itineraryID)
+		return nil
+	})
+}
+
+func (r *MemoryTripRepository) GetItineraryItems(itineraryID string) ([]*ItineraryItem, error) {
+	matches := r.ItineraryItems.Filter(func(item ItineraryItem) bool {
+		return item.ItineraryID == itineraryID
+	})
+
+	itineraryItems := make([]*ItineraryItem, 0, len(matches))
+	for i := range matches {
+		itineraryItems = append(itineraryItems, &matches[i])
+	}
+	return itineraryItems, nil
+}
+
+func (r *MemoryTripRepository) GetItineraryItem(itineraryID, itineraryItemID string) (*ItineraryItem, error) {
+	itineraryItem, ok := r.ItineraryItems.Get(itineraryItemID)
+	if !ok || itineraryItem.ItineraryID != itineraryID {
+		return nil, ErrItineraryItemNotFound
+	}
+	return &itineraryItem, nil
+}
+
+func (r *MemoryTripRepository) CreateItineraryItem(createItineraryItemData ItineraryItem) (*ItineraryItem, error) {
+	createItineraryItemData.ID = utils.GenerateID()
+	createItineraryItemData.Version = 1
+	r.transact(func() error {
+		r.ItineraryItems.Put(createItineraryItemData.ID, createItineraryItemData)
+		return nil
+	})
+	return &createItineraryItemData, nil
+}
+
+func (r *MemoryTripRepository) EditItineraryItem(editItineraryItemData ItineraryItem) (*ItineraryItem, error) {
+	err := r.transact(func() error {
+		existing, err := r.GetItineraryItem(editItineraryItemData.ItineraryID, editItineraryItemData.ID)
+		if err != nil {
+			return err
+		}
+		if existing.Version != editItineraryItemData.Version {
+			return ErrPreconditionFailed
+		}
+
+		editItineraryItemData.Version++
+		r.ItineraryItems.Put(editItineraryItemData.ID, editItineraryItemData)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &editItineraryItemData, nil
+}
+
+func (r *MemoryTripRepository) DeleteItineraryItem(itineraryID, itineraryItemID string, version int64) error {
+	return r.transact(func() error {
+		itineraryItem, err := r.GetItineraryItem(itineraryID, itineraryItemID)
+		if err != nil {
+			return err
+		}
+		if itineraryItem.Version != version {
+			return ErrPreconditionFailed
+		}
+		r.ItineraryItems.Delete(itineraryItemID)
+		return nil
+	})
+}
+
+func (r *MemoryTripRepository) GetPlanItems(planID string) ([]*PlanItem, error) {
+	matches := r.PlanItems.Filter(func(planItem PlanItem) bool {
+		return planItem.PlanID == planID
+	})
+
+	planItems := make([]*PlanItem, 0, len(matches))
+	for i := range matches {
+		planItems = append(planItems, &matches[i])
+	}
+	return planItems, nil
+}
+
+func (r *MemoryTripRepository) GetPlanItem(planID, planItemID string) (*PlanItem, error) {
+	planItem, ok := r.PlanItems.Get(planItemID)
+	if !ok || planItem.PlanID != planID {
+		return nil, ErrPlanItemNotFound
+	}
+	return &planItem, nil
+}
+
+func (r *MemoryTripRepository) CreatePlanItem(createPlanItemData PlanItem) (*PlanItem, error) {
+	createPlanItemData.ID = utils.GenerateID()
+	r.transact(func() error {
+		r.PlanItems.Put(createPlanItemData.ID, createPlanItemData)
+		return nil
+	})
+	return &createPlanItemData, nil
+}
+
+func (r *MemoryTripRepository) EditPlanItem(editPlanItemData PlanItem) (*PlanItem, error) {
+	err := r.transact(func() error {
+		if _, err := r.GetPlanItem(editPlanItemData.PlanID, editPlanItemData.ID); err != nil {
+			return err
+		}
+		r.PlanItems.Put(editPlanItemData.ID, editPlanItemData)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &editPlanItemData, nil
+}
+
+func (r *MemoryTripRepository) DeletePlanItem(planID, planItemID string) error {
+	return r.transact(func() error {
+		if _, err := r.GetPlanItem(planID, planItemID); err != nil {
+			return nil
+		}
+		r.PlanItems.Delete(planItemID)
+		return nil
+	})
+}
+
+func (r *MemoryTripRepository) SchedulePlanItem(planItem *PlanItem, itineraryItem ItineraryItem) (*ItineraryItem, error) {
+	err := r.transact(func() error {
+		if _, err := r.GetPlanItem(planItem.PlanID, planItem.ID); err != nil {
+			return err
+		}
+
+		itineraryItem.ID = utils.GenerateID()
+		itineraryItem.Version = 1
+		r.ItineraryItems.Put(itineraryItem.ID, itineraryItem)
+		r.PlanItems.Delete(planItem.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &itineraryItem, nil
+}
+
+func (r *MemoryTripRepository) GetMember(tripID, userID string) (*TripMember, error) {
+	member, ok := r.Members.Get(memberTableKey(tripID, userID))
+	if !ok {
+		return nil, ErrMemberNotFound
+	}
+	return &member, nil
+}
+
+func (r *MemoryTripRepository) GetMembers(tripID string) ([]*TripMember, error) {
+	return memberPointers(r.Members.Filter(func(member TripMember) bool {
+		return member.TripID == tripID
+	})), nil
+}
+
+func (r *MemoryTripRepository) GetMemberships(userID string) ([]*TripMember, error) {
+	return memberPointers(r.Members.Filter(func(member TripMember) bool {
+		return member.UserID == userID
+	})), nil
+}
+
+func (r *MemoryTripRepository) CreateMember(member *TripMember) error {
+	return r.transact(func() error {
+		key := memberTableKey(member.TripID, member.UserID)
+		if _, ok := r.Members.Get(key); ok {
+			return ErrAlreadyMember
+		}
+		r.Members.Put(key, *member)
+		return nil
+	})
+}
+
+func (r *MemoryTripRepository) UpdateMember(member *TripMember) error {
+	return r.transact(func() error {
+		key := memberTableKey(member.TripID, member.UserID)
+		if _, ok := r.Members.Get(key); !ok {
+			return ErrMemberNotFound
+		}
+		r.Members.Put(key, *member)
+		return nil
+	})
+}
+
+func (r *MemoryTripRepository) DeleteMember(tripID, userID string) error {
+	return r.transact(func() error {
+		r.Members.Delete(memberTableKey(tripID, userID))
+		return nil
+	})
+}
+
+func memberPointers(members []TripMember) []*TripMember {
+	pointers := make([]*TripMember, 0, len(members))
+	for i := range members {
+		pointers = append(pointers, &members[i])
+	}
+	return pointers
+}
+
+func (r *MemoryTripRepository) transact(fn func() error) error {
+	r.txMu.Lock()
+	defer r.txMu.Unlock()
+	return fn()
+}
+
+// memoryPage cuts a page out of items, which must already be sorted by key in
+// the listing's direction. The page key holds the key of the last item
+// returned.
+func memoryPage[T any](items []T, page db.PageRequest, descending bool, key func(T) string) ([]T, db.PageKey) {
+	if after, ok := page.After["Key"]; ok {
+		start := slices.IndexFunc(items, func(item T) bool {
+			if descending {
+				return key(item) < after
+			}
+			return key(item) > after
+		})
+		if start < 0 {
+			start = len(items)
+		}
+		items = items[start:]
+	}
+
+	if page.Limit <= 0 || len(items) <= page.Limit {
+		return items, nil
+	}
+	items = items[:page.Limit]
+	return items, db.PageKey{"Key": key(items[len(items)-1])}
+}
+
+func memberTableKey(tripID, userID string) string {
+	return tripID + "#" + userID
+}
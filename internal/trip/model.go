@@ -13,6 +13,19 @@ type Trip struct {
 	Completed bool      `json:"completed"`
 	Draft     bool      `json:"draft"`
 	PlanID    string    `json:"planId"`
+	CreatedAt time.Time `json:"createdAt"`
+	Version   int64     `json:"version"`
+
+	Status          TripStatus `json:"status"`
+	StatusChangedBy string     `json:"statusChangedBy"`
+	StatusChangedAt time.Time  `json:"statusChangedAt"`
+}
+
+// TripPage is one page of a trip listing. NextCursor is empty on the last
+// page.
+type TripPage struct {
+	Trips      []*Trip `json:"trips"`
+	NextCursor string  `json:"nextCursor,omitempty"`
 }
 
 type Plan struct {
@@ -21,33 +34,99 @@ type Plan struct {
 }
 
 type Itinerary struct {
-	ID   string    `json:"itineraryId"`
+	ID            string    `json:"itineraryId"`
 	ItineraryName string    `json:"itineraryName"`
 	PlanID        string    `json:"planId"`
 	TripID        string    `json:"tripId"`
 	StartDate     time.Time `json:"startDate"`
 	EndDate       time.Time `json:"endDate"`
+	Version       int64     `json:"version"`
+}
+
+type ItineraryPage struct {
+	Itineraries []*Itinerary `json:"itineraries"`
+	NextCursor  string       `json:"nextCursor,omitempty"`
 }
 
 type ItineraryItem struct {
-	TripID      string
-	ItineraryID string
-	PlanID string
-	ID          string
-	StartDate   time.Time
-	EndDate     time.Time
-	Title       string
-	Description string
+	TripID      string    `json:"tripId"`
+	ItineraryID string    `json:"itineraryId"`
+	PlanID      string    `json:"planId"`
+	ID          string    `json:"id"`
+	StartDate   time.Time `json:"startDate"`
+	EndDate     time.Time `json:"endDate"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Link        string    `json:"link"`
+	Location    string    `json:"location"`
+	Version     int64     `json:"version"`
 }
 
+// PlanItem is an unscheduled idea in a trip's plan. Dates are optional and
+// only rough until the item is scheduled into an itinerary.
 type PlanItem struct {
-	TripID      string
-	PlanID      string
-	ID          string
-	StartDate   time.Time
-	EndDate     time.Time
-	Title       string
-	Description string
+	TripID      string     `json:"tripId"`
+	PlanID      string     `json:"planId"`
+	ID          string     `json:"id"`
+	StartDate   *time.Time `json:"startDate,omitempty"`
+	EndDate     *time.Time `json:"endDate,omitempty"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Link        string     `json:"link"`
+	Location    string     `json:"location"`
+	CreatedBy   string     `json:"createdBy"`
+}
+
+type PlanDetails struct {
+	TripID    string      `json:"tripId"`
+	PlanID    string      `json:"planId"`
+	PlanItems []*PlanItem `json:"planItems"`
+}
+
+type SchedulePlanItemRequest struct {
+	ItineraryID string     `json:"itineraryId"`
+	StartDate   *time.Time `json:"startDate"`
+	EndDate     *time.Time `json:"endDate"`
+}
+
+type TripMember struct {
+	TripID    string       `json:"tripId"`
+	UserID    string       `json:"userId"`
+	Username  string       `json:"username"`
+	Role      Role         `json:"role"`
+	Status    MemberStatus `json:"status"`
+	InvitedBy string       `json:"invitedBy"`
+	CreatedAt time.Time    `json:"createdAt"`
+
+	// TripStartDate and TripCreatedAt copy the trip's values so a user's
+	// trips can be listed in order straight from their memberships.
+	TripStartDate time.Time `json:"-"`
+	TripCreatedAt time.Time `json:"-"`
+}
+
+type MemberStatus string
+
+const (
+	MemberStatusPending  MemberStatus = "pending"
+	MemberStatusAccepted MemberStatus = "accepted"
+)
+
+type InviteMemberRequest struct {
+	UsernameOrEmail string `json:"usernameOrEmail"`
+	Role            Role   `json:"role"`
+}
+
+type UpdateMemberRequest struct {
+	Role Role `json:"role"`
+}
+
+type DeleteTripResult struct {
+	Trips          int `json:"trips"`
+	Plans          int `json:"plans"`
+	Itineraries    int `json:"itineraries"`
+	ItineraryItems int `json:"itineraryItems"`
+	PlanItems      int `json:"planItems"`
+	Members        int `json:"members"`
 }
 
 type TimeRange struct {
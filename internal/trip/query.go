@@ -0,0 +1,127 @@
+package trip
+
+import (
+	"strings"
+	"time"
+)
+
+type Timeframe string
+
+const (
+	TimeframeUpcoming Timeframe = "upcoming"
+	TimeframeOngoing  Timeframe = "ongoing"
+	TimeframePast     Timeframe = "past"
+)
+
+type TripSort string
+
+const (
+	SortByStartDate TripSort = "startDate"
+	SortByCreatedAt TripSort = "createdAt"
+)
+
+// TripQuery filters and orders a user's trip listing. Nil and zero fields
+// don't filter. Timeframes are judged against Now.
+type TripQuery struct {
+	Status     TripStatus
+	Draft      *bool
+	Completed  *bool
+	Timeframe  Timeframe
+	From       *time.Time
+	To         *time.Time
+	Title      string
+	Sort       TripSort
+	Descending bool
+	Now        time.Time
+}
+
+func (q *TripQuery) Validate() error {
+	if q.Status != "" && !q.Status.Valid() {
+		return validationErrorf("status must be one of draft, planned, in-progress, completed or archived")
+	}
+
+	switch q.Timeframe {
+	case "", TimeframeUpcoming, TimeframeOngoing, TimeframePast:
+	default:
+		return validationErrorf("timeframe must be one of upcoming, ongoing or past")
+	}
+
+	switch q.Sort {
+	case SortByStartDate, SortByCreatedAt:
+	default:
+		return validationErrorf("sort must be one of startDate or createdAt")
+	}
+
+	if q.From != nil && q.To != nil && q.To.Before(*q.From) {
+		return validationErrorf("to can't be before from")
+	}
+
+	return nil
+}
+
+// Matches reports whether trip passes every filter in the query. A date
+// window keeps trips that lie entirely within it.
+func (q *TripQuery) Matches(trip *Trip) bool {
+	if q.Status != "" && trip.Status != q.Status {
+		return false
+	}
+	if q.Draft != nil && trip.Draft != *q.Draft {
+		return false
+	}
+	if q.Completed != nil && trip.Completed != *q.Completed {
+		return false
+	}
+
+	switch q.Timeframe {
+	case TimeframeUpcoming:
+		if !trip.StartDate.After(q.Now) {
+			return false
+		}
+	case TimeframeOngoing:
+		if trip.StartDate.After(q.Now) || trip.EndDate.Before(q.Now) {
+			return false
+		}
+	case TimeframePast:
+		if !trip.EndDate.Before(q.Now) {
+			return false
+		}
+	}
+
+	if q.From != nil && trip.StartDate.Before(*q.From) {
+		return false
+	}
+	if q.To != nil && trip.EndDate.After(*q.To) {
+		return false
+	}
+
+	if q.Title != "" && !strings.Contains(strings.ToLower(trip.Title), strings.ToLower(q.Title)) {
+		return false
+	}
+
+	return true
+}
+
+// scope identifies the listing order, so a cursor can only resume the
+// ordering it was issued for.
+func (q *TripQuery) scope() string {
+	direction := "asc"
+	if q.Descending {
+		direction = "desc"
+	}
+	return string(q.Sort) + ":" + direction
+}
+
+// startSortKey and createdSortKey order a user's trips on the TripMembers
+// indexes, falling back to the trip id for trips on the same date.
+func startSortKey(startDate time.Time, tripID string) string {
+	return "START#" + sortableTime(startDate) + "#TRIP#" + tripID
+}
+
+func createdSortKey(createdAt time.Time, tripID string) string {
+	return "CREATED#" + sortableTime(createdAt) + "#TRIP#" + tripID
+}
+
+// sortableTime formats in UTC so that keys compare in time order.
+func sortableTime(date time.Time) string {
+	return date.UTC().Format(time.RFC3339)
+}
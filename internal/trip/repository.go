@@ -2,52 +2,155 @@ package trip
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/tabichanorg/tabichan-server/internal/db"
 	"github.com/tabichanorg/tabichan-server/internal/utils"
 )
 
-type TripRepository struct {
+type TripRepository interface {
+	GetTrips(userID string, query TripQuery, page db.PageRequest) ([]*Trip, db.PageKey, error)
+	GetTrip(tripID string) (*Trip, error)
+	GetTripsDue(status TripStatus, now time.Time) ([]*Trip, error)
+	CreateTrip(tripData *Trip, planData *Plan, owner *TripMember) error
+	EditTrip(tripData *Trip) error
+	DeleteTrip(tripID string, version int64) (*DeleteTripResult, error)
+	GetPlan(planID string) (*Plan, error)
+	GetItineraries(planID string, page db.PageRequest) ([]*Itinerary, db.PageKey, error)
+	GetItinerary(itineraryID string) (*Itinerary, error)
+	CreateItinerary(createItineraryData Itinerary) (*Itinerary, error)
+	EditItinerary(itineraryData *Itinerary) error
+	DeleteItinerary(itineraryID string, version int64) error
+	GetItineraryItems(itineraryID string) ([]*ItineraryItem, error)
+	GetItineraryItem(itineraryID, itineraryItemID string) (*ItineraryItem, error)
+	CreateItineraryItem(createItineraryItemData ItineraryItem) (*ItineraryItem, error)
+	EditItineraryItem(editItineraryItemData ItineraryItem) (*ItineraryItem, error)
+	DeleteItineraryItem(itineraryID, itineraryItemID string, version int64) error
+	GetPlanItems(planID string) ([]*PlanItem, error)
+	GetPlanItem(planID, planItemID string) (*PlanItem, error)
+	CreatePlanItem(createPlanItemData PlanItem) (*PlanItem, error)
+	EditPlanItem(editPlanItemData PlanItem) (*PlanItem, error)
+	DeletePlanItem(planID, planItemID string) error
+	SchedulePlanItem(planItem *PlanItem, itineraryItem ItineraryItem) (*ItineraryItem, error)
+	GetMember(tripID, userID string) (*TripMember, error)
+	GetMembers(tripID string) ([]*TripMember, error)
+	GetMemberships(userID string) ([]*TripMember, error)
+	CreateMember(member *TripMember) error
+	UpdateMember(member *TripMember) error
+	DeleteMember(tripID, userID string) error
+}
+
+type DynamoTripRepository struct {
 	Client *dynamodb.Client
 }
 
-func (r *TripRepository) GetTrips(userID string) ([]*Trip, error) {
-	queryInput := &dynamodb.QueryInput{
-		TableName:              aws.String("Trips"),
-		IndexName:              aws.String("GSI1"),
-		KeyConditionExpression: aws.String("GSI1PK = :userID"),
+// GetTrips returns a page of the trips userID has accepted membership of that
+// match query. Memberships are read in order from the index for the requested
+// sort and the trips themselves are filtered after they're fetched, so a page
+// may take several queries to fill.
+func (r *DynamoTripRepository) GetTrips(userID string, query TripQuery, page db.PageRequest) ([]*Trip, db.PageKey, error) {
+	indexName, partitionKey, sortKey := "GSI2", "GSI2PK", "GSI2SK"
+	if query.Sort == SortByCreatedAt {
+		indexName, partitionKey, sortKey = "GSI3", "GSI3PK", "GSI3SK"
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String("TripMembers"),
+		IndexName:              aws.String(indexName),
+		KeyConditionExpression: aws.String("#PK = :userID"),
+		FilterExpression:       aws.String("#Status = :accepted"),
+		ExpressionAttributeNames: map[string]string{
+			"#PK":     partitionKey,
+			"#Status": "Status",
+		},
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":userID": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+			":userID":   &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+			":accepted": &types.AttributeValueMemberS{Value: string(MemberStatusAccepted)},
 		},
+		ScanIndexForward: aws.Bool(!query.Descending),
 	}
-	result, err := r.Client.Query(context.TODO(), queryInput)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch trips for user with ID %s: %w", userID, err)
+
+	var trips []*Trip
+	after := page.After
+	for {
+		request := db.PageRequest{After: after}
+		if page.Limit > 0 {
+			request.Limit = page.Limit - len(trips)
+		}
+		items, lastKey, err := db.QueryPage(r.Client, input, request)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch trip memberships for user with ID %s: %w", userID, err)
+		}
+
+		memberships, err := unmarshalMembers(items)
+		if err != nil {
+			return nil, nil, err
+		}
+		tripsByID, err := r.batchGetTrips(memberships)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch trips for user with ID %s: %w", userID, err)
+		}
+
+		for i, membership := range memberships {
+			trip, ok := tripsByID[membership.TripID]
+			if !ok || !query.Matches(trip) {
+				continue
+			}
+			trips = append(trips, trip)
+
+			if page.Limit > 0 && len(trips) == page.Limit {
+				if i == len(memberships)-1 {
+					return trips, lastKey, nil
+				}
+				resumeKey, err := db.ItemKey(items[i], "PK", "SK", partitionKey, sortKey)
+				if err != nil {
+					return nil, nil, err
+				}
+				return trips, resumeKey, nil
+			}
+		}
+
+		if lastKey == nil {
+			return trips, nil, nil
+		}
+		after = lastKey
 	}
+}
 
-	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("couldn't find any trips for user with ID: %s", userID)
+func (r *DynamoTripRepository) batchGetTrips(memberships []*TripMember) (map[string]*Trip, error) {
+	keys := make([]map[string]types.AttributeValue, 0, len(memberships))
+	for _, membership := range memberships {
+		keys = append(keys, map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", membership.TripID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", membership.TripID)},
+		})
 	}
 
-	var trips []*Trip
-	for _, item := range result.Items {
-		var trip Trip
-		err = attributevalue.UnmarshalMap(item, &trip)
+	items, err := db.BatchGet(r.Client, "Trips", keys)
+	if err != nil {
+		return nil, err
+	}
+
+	// BatchGetItem doesn't keep the order of the keys it was given.
+	tripsByID := make(map[string]*Trip, len(items))
+	for _, item := range items {
+		trip, err := unmarshalTrip(item)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal trip: %w", err)
+			return nil, err
 		}
-		trips = append(trips, &trip)
+		tripsByID[trip.ID] = trip
 	}
-
-	return trips, nil
+	return tripsByID, nil
 }
 
-func (r *TripRepository) GetTrip(tripID string) (*Trip, error) {
+func (r *DynamoTripRepository) GetTrip(tripID string) (*Trip, error) {
 	queryInput := &dynamodb.GetItemInput{
 		TableName: aws.String("Trips"),
 		Key: map[string]types.AttributeValue{
@@ -61,174 +164,349 @@ func (r *TripRepository) GetTrip(tripID string) (*Trip, error) {
 	}
 
 	if result.Item == nil {
-		return nil, fmt.Errorf("trip doesn't exist")
+		return nil, ErrTripNotFound
 	}
 
-	var trip Trip
-	err = attributevalue.UnmarshalMap(result.Item, &trip)
+	return unmarshalTrip(result.Item)
+}
+
+// GetTripsDue returns the trips in status whose start or end date, whichever
+// moves them on, is at or before now.
+func (r *DynamoTripRepository) GetTripsDue(status TripStatus, now time.Time) ([]*Trip, error) {
+	items, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("Trips"),
+		IndexName:              aws.String("GSI3"),
+		KeyConditionExpression: aws.String("GSI3PK = :statusKey AND GSI3SK <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":statusKey": &types.AttributeValueMemberS{Value: fmt.Sprintf("STATUS#%s", status)},
+			":now":       &types.AttributeValueMemberS{Value: sortableTime(now)},
+		},
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal trip: %w", err)
+		return nil, fmt.Errorf("failed to fetch %s trips that are due: %w", status, err)
 	}
 
+	trips := make([]*Trip, 0, len(items))
+	for _, item := range items {
+		trip, err := unmarshalTrip(item)
+		if err != nil {
+			return nil, err
+		}
+		trips = append(trips, trip)
+	}
+	return trips, nil
+}
+
+func unmarshalTrip(item map[string]types.AttributeValue) (*Trip, error) {
+	var trip Trip
+	if err := attributevalue.UnmarshalMap(item, &trip); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal trip: %w", err)
+	}
+	trip.normalizeStatus()
 	return &trip, nil
 }
 
-func (r *TripRepository) CreateTrip(tripData *Trip, planData *Plan) error {
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String("Trips"),
-		Item: map[string]types.AttributeValue{
-			"PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", planData.TripID)},
-			"SK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", planData.TripID)},
-			"GSI1PK":    &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", tripData.CreatedBy)},
-			"GSI2PK":    &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", planData.TripID)},
-			"CreatedBy": &types.AttributeValueMemberS{Value: tripData.CreatedBy},
-			"StartDate": &types.AttributeValueMemberS{Value: formatTime(tripData.StartDate)},
-			"EndDate":   &types.AttributeValueMemberS{Value: formatTime(tripData.EndDate)},
-			"Title":     &types.AttributeValueMemberS{Value: tripData.Title},
-			"ID":        &types.AttributeValueMemberS{Value: planData.TripID},
-			"Completed": &types.AttributeValueMemberBOOL{Value: tripData.Completed},
-			"Draft":     &types.AttributeValueMemberBOOL{Value: tripData.Draft},
-			"PlanID":    &types.AttributeValueMemberS{Value: planData.PlanID},
-		},
+func (r *DynamoTripRepository) CreateTrip(tripData *Trip, planData *Plan, owner *TripMember) error {
+	tripData.Version = 1
+	err := db.TransactWrite(r.Client, []types.TransactWriteItem{
+		db.PutIfNotExists("Plans", planItem(planData)),
+		db.PutIfNotExists("Trips", tripItem(tripData, planData)),
+		db.PutIfNotExists("TripMembers", memberItem(owner)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create trip with ID %s: %w", planData.TripID, err)
 	}
 
-	_, err := r.Client.PutItem(context.TODO(), input)
-	return err
+	return nil
 }
 
-// TODO:
-func (r *TripRepository) EditTrip(tripID string, tripData *Trip) error {
-	// Define the update expression and attribute values
-	updateExpression := "SET "
-	attributeValues := map[string]types.AttributeValue{}
-	attributeNames := map[string]string{}
+// EditTrip overwrites the editable fields of an existing trip with the values
+// in tripData, including false and empty values. The write only succeeds while
+// the stored trip is still at tripData.Version, which is then incremented.
+func (r *DynamoTripRepository) EditTrip(tripData *Trip) error {
+	updateExpression := "SET #StartDate = :startDate, #EndDate = :endDate, #Title = :title, #Completed = :completed, #Draft = :draft, " +
+		"#Status = :status, #StatusChangedBy = :statusChangedBy, #StatusChangedAt = :statusChangedAt, #Version = :nextVersion"
+	values := map[string]types.AttributeValue{
+		":startDate":       &types.AttributeValueMemberS{Value: formatTime(tripData.StartDate)},
+		":endDate":         &types.AttributeValueMemberS{Value: formatTime(tripData.EndDate)},
+		":title":           &types.AttributeValueMemberS{Value: tripData.Title},
+		":completed":       &types.AttributeValueMemberBOOL{Value: tripData.Completed},
+		":draft":           &types.AttributeValueMemberBOOL{Value: tripData.Draft},
+		":status":          &types.AttributeValueMemberS{Value: string(tripData.Status)},
+		":statusChangedBy": &types.AttributeValueMemberS{Value: tripData.StatusChangedBy},
+		":statusChangedAt": &types.AttributeValueMemberS{Value: formatTime(tripData.StatusChangedAt)},
+		":version":         versionValue(tripData.Version),
+		":nextVersion":     versionValue(tripData.Version + 1),
+	}
+	if statusKey, dueKey, ok := statusIndexKeys(tripData); ok {
+		updateExpression += ", GSI3PK = :statusKey, GSI3SK = :dueKey"
+		values[":statusKey"] = statusKey
+		values[":dueKey"] = dueKey
+	} else {
+		updateExpression += " REMOVE GSI3PK, GSI3SK"
+	}
 
-	// Only add fields that are set in the tripData
-	if !tripData.StartDate.IsZero() {
-		updateExpression += "#StartDate = :startDate, "
-		attributeValues[":startDate"] = &types.AttributeValueMemberS{Value: tripData.StartDate.Format(time.RFC3339)}
-		attributeNames["#StartDate"] = "StartDate"
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("Trips"),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripData.ID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", tripData.ID)},
+		},
+		UpdateExpression:    aws.String(updateExpression),
+		ConditionExpression: aws.String(versionCondition(tripData.Version)),
+		ExpressionAttributeNames: map[string]string{
+			"#StartDate":       "StartDate",
+			"#EndDate":         "EndDate",
+			"#Title":           "Title",
+			"#Completed":       "Completed",
+			"#Draft":           "Draft",
+			"#Status":          "Status",
+			"#StatusChangedBy": "StatusChangedBy",
+			"#StatusChangedAt": "StatusChangedAt",
+			"#Version":         "Version",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        types.ReturnValueUpdatedOld,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
 	}
-	if !tripData.EndDate.IsZero() {
-		updateExpression += "#EndDate = :endDate, "
-		attributeValues[":endDate"] = &types.AttributeValueMemberS{Value: tripData.EndDate.Format(time.RFC3339)}
-		attributeNames["#EndDate"] = "EndDate"
+
+	result, err := r.Client.UpdateItem(context.TODO(), input)
+	if err != nil {
+		return fmt.Errorf("failed to update trip: %w", versionConflictError(err, ErrTripNotFound))
 	}
-	if tripData.Title != "" {
-		updateExpression += "#Title = :title, "
-		attributeValues[":title"] = &types.AttributeValueMemberS{Value: tripData.Title}
-		attributeNames["#Title"] = "Title"
+	tripData.Version++
+
+	var previous struct{ StartDate time.Time }
+	if err := attributevalue.UnmarshalMap(result.Attributes, &previous); err != nil {
+		return fmt.Errorf("failed to unmarshal trip: %w", err)
 	}
-	if tripData.Completed {
-		updateExpression += "#Completed = :completed, "
-		attributeValues[":completed"] = &types.AttributeValueMemberBOOL{Value: tripData.Completed}
-		attributeNames["#Completed"] = "Completed"
+	if !previous.StartDate.Equal(tripData.StartDate) {
+		return r.updateMembersStartDate(tripData.ID, tripData.StartDate)
 	}
-	if tripData.Draft {
-		updateExpression += "#Draft = :draft, "
-		attributeValues[":draft"] = &types.AttributeValueMemberBOOL{Value: tripData.Draft}
-		attributeNames["#Draft"] = "Draft"
+
+	return nil
+}
+
+// updateMembersStartDate moves the trip to its new place in each member's
+// start date ordering.
+func (r *DynamoTripRepository) updateMembersStartDate(tripID string, startDate time.Time) error {
+	members, err := r.GetMembers(tripID)
+	if err != nil {
+		return err
 	}
 
-	// If there are no fields to update, return an error
-	if len(attributeValues) == 0 {
-		return fmt.Errorf("no fields to update")
+	for _, member := range members {
+		_, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+			TableName:           aws.String("TripMembers"),
+			Key:                 memberKey(tripID, member.UserID),
+			UpdateExpression:    aws.String("SET GSI2SK = :sortKey, TripStartDate = :startDate"),
+			ConditionExpression: aws.String("attribute_exists(PK)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":sortKey":   &types.AttributeValueMemberS{Value: startSortKey(startDate, tripID)},
+				":startDate": &types.AttributeValueMemberS{Value: formatTime(startDate)},
+			},
+		})
+		var conditionFailed *types.ConditionalCheckFailedException
+		if err != nil && !errors.As(err, &conditionFailed) {
+			return fmt.Errorf("failed to update trip start date for member %s: %w", member.UserID, err)
+		}
 	}
 
-	// Remove the trailing comma and space from the update expression
-	updateExpression = updateExpression[:len(updateExpression)-2]
+	return nil
+}
 
-	// Prepare the update input for DynamoDB
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String("Trips"),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripID)},
-			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", tripID)},
-		},
-		UpdateExpression:          aws.String(updateExpression),
-		ExpressionAttributeValues: attributeValues,
-		ExpressionAttributeNames:  attributeNames,
+// DeleteTrip removes the trip together with its plan, itineraries,
+// itinerary items and members, as long as the trip is still at version.
+// Content is deleted first so a failed run can be retried while the trip
+// record still exists. Members are what authorize that retry, so they go in
+// the same transaction as the trip record.
+func (r *DynamoTripRepository) DeleteTrip(tripID string, version int64) (*DeleteTripResult, error) {
+	result := &DeleteTripResult{}
+
+	tripKey := map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", tripID)},
+	}
+	if err := r.claimForDelete("Trips", tripKey, version, ErrTripNotFound); err != nil {
+		return nil, fmt.Errorf("failed to delete trip with ID %s: %w", tripID, err)
 	}
 
-	_, err := r.Client.UpdateItem(context.TODO(), input)
+	itineraries, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("Itineraries"),
+		IndexName:              aws.String("GSI2"),
+		KeyConditionExpression: aws.String("GSI2PK = :tripID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tripID": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripID)},
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("failed to update trip: %w", err)
+		return nil, fmt.Errorf("failed to fetch itineraries for trip with ID %s: %w", tripID, err)
 	}
+	itineraryKeys := db.PrimaryKeys(itineraries)
 
-	return nil
-}
+	for _, itineraryKey := range itineraryKeys {
+		itineraryItems, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+			TableName:              aws.String("ItineraryItems"),
+			KeyConditionExpression: aws.String("PK = :itineraryPK"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":itineraryPK": itineraryKey["PK"],
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch itinerary items for trip with ID %s: %w", tripID, err)
+		}
 
-func (r *TripRepository) DeleteTrip(tripID string) error {
-	queryInput := &dynamodb.DeleteItemInput{
-		TableName: aws.String("Trips"),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripID)},
-			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", tripID)},
+		if err := db.BatchDelete(r.Client, "ItineraryItems", db.PrimaryKeys(itineraryItems)); err != nil {
+			return nil, err
+		}
+		result.ItineraryItems += len(itineraryItems)
+	}
+
+	if err := db.BatchDelete(r.Client, "Itineraries", itineraryKeys); err != nil {
+		return nil, err
+	}
+	result.Itineraries = len(itineraryKeys)
+
+	planItems, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("PlanItems"),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :tripID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tripID": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripID)},
 		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plan items for trip with ID %s: %w", tripID, err)
 	}
-	_, err := r.Client.DeleteItem(context.TODO(), queryInput)
+	if err := db.BatchDelete(r.Client, "PlanItems", db.PrimaryKeys(planItems)); err != nil {
+		return nil, err
+	}
+	result.PlanItems = len(planItems)
+
+	plans, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("Plans"),
+		KeyConditionExpression: aws.String("PK = :tripID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tripID": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripID)},
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("failed to delete trip with ID %s: %w", tripID, err)
+		return nil, fmt.Errorf("failed to fetch plans for trip with ID %s: %w", tripID, err)
 	}
+	if err := db.BatchDelete(r.Client, "Plans", db.PrimaryKeys(plans)); err != nil {
+		return nil, err
+	}
+	result.Plans = len(plans)
 
-	return nil
-}
+	members, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("TripMembers"),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :tripID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tripID": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripID)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch members for trip with ID %s: %w", tripID, err)
+	}
+	memberKeys := db.PrimaryKeys(members)
 
-func (r *TripRepository) CreatePlan(planID, tripID string) (*Plan, error) {
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String("Plans"),
-		Item: map[string]types.AttributeValue{
-			"PK":     &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripID)},
-			"SK":     &types.AttributeValueMemberS{Value: fmt.Sprintf("PLAN#%s", planID)},
-			"PlanID": &types.AttributeValueMemberS{Value: planID},
-			"TripID": &types.AttributeValueMemberS{Value: tripID},
+	transactItems := []types.TransactWriteItem{{
+		Delete: &types.Delete{
+			TableName:           aws.String("Trips"),
+			Key:                 tripKey,
+			ConditionExpression: aws.String("#Version = :version"),
+			ExpressionAttributeNames: map[string]string{
+				"#Version": "Version",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":version": versionValue(version + 1),
+			},
 		},
+	}}
+	// Members past what fits in the transaction are deleted right after it;
+	// without the trip record they no longer grant anything.
+	inTransaction := min(len(memberKeys), db.MaxTransactionItems-1)
+	for _, key := range memberKeys[:inTransaction] {
+		transactItems = append(transactItems, types.TransactWriteItem{
+			Delete: &types.Delete{TableName: aws.String("TripMembers"), Key: key},
+		})
 	}
 
-	_, err := r.Client.PutItem(context.TODO(), input)
+	err = db.TransactWrite(r.Client, transactItems)
+	if errors.Is(err, db.ErrConditionFailed) {
+		// The trip was claimed at version+1 above, so only another request
+		// can have moved it on.
+		err = ErrPreconditionFailed
+	}
 	if err != nil {
-		return &Plan{}, err
+		return nil, fmt.Errorf("failed to delete trip with ID %s: %w", tripID, err)
 	}
+	result.Trips = 1
 
-	newPlan := &Plan{
-		PlanID: planID,
-		TripID: tripID,
+	if err := db.BatchDelete(r.Client, "TripMembers", memberKeys[inTransaction:]); err != nil {
+		return nil, err
 	}
-	return newPlan, err
+	result.Members = len(memberKeys)
+
+	return result, nil
 }
 
-func (r *TripRepository) GetItineraries(planId string) ([]*Itinerary, error) {
+func (r *DynamoTripRepository) GetPlan(planID string) (*Plan, error) {
 	queryInput := &dynamodb.QueryInput{
-		TableName:              aws.String("Itineraries"),
+		TableName:              aws.String("Plans"),
 		IndexName:              aws.String("GSI1"),
 		KeyConditionExpression: aws.String("GSI1PK = :planID"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":planID": &types.AttributeValueMemberS{Value: fmt.Sprintf("PLAN#%s", planId)},
+			":planID": &types.AttributeValueMemberS{Value: fmt.Sprintf("PLAN#%s", planID)},
 		},
 	}
 	result, err := r.Client.Query(context.TODO(), queryInput)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch itineraries for plan with ID %s: %w", planId, err)
+		return nil, fmt.Errorf("failed to fetch plan with ID %s: %w", planID, err)
 	}
 
 	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("couldn't find any itineraries for plan with ID: %s", planId)
+		return nil, ErrPlanNotFound
+	}
+
+	var plan Plan
+	err = attributevalue.UnmarshalMap(result.Items[0], &plan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal plan: %w", err)
+	}
+
+	return &plan, nil
+}
+
+func (r *DynamoTripRepository) GetItineraries(planId string, page db.PageRequest) ([]*Itinerary, db.PageKey, error) {
+	queryInput := &dynamodb.QueryInput{
+		TableName:              aws.String("Itineraries"),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :planID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":planID": &types.AttributeValueMemberS{Value: fmt.Sprintf("PLAN#%s", planId)},
+		},
+	}
+	items, lastKey, err := db.QueryPage(r.Client, queryInput, page)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch itineraries for plan with ID %s: %w", planId, err)
 	}
 
-	var itineraries []*Itinerary
-	for _, item := range result.Items {
+	itineraries := make([]*Itinerary, 0, len(items))
+	for _, item := range items {
 		var itinerary Itinerary
 		err = attributevalue.UnmarshalMap(item, &itinerary)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal itinerary: %w", err)
+			return nil, nil, fmt.Errorf("failed to unmarshal itinerary: %w", err)
 		}
 		itineraries = append(itineraries, &itinerary)
 	}
 
-	return itineraries, nil
+	return itineraries, lastKey, nil
 }
 
-func (r *TripRepository) GetItinerary(itineraryID string) (*Itinerary, error) {
+func (r *DynamoTripRepository) GetItinerary(itineraryID string) (*Itinerary, error) {
 	queryInput := &dynamodb.GetItemInput{
 		TableName: aws.String("Itineraries"),
 		Key: map[string]types.AttributeValue{
@@ -242,7 +520,7 @@ func (r *TripRepository) GetItinerary(itineraryID string) (*Itinerary, error) {
 	}
 
 	if result.Item == nil {
-		return nil, fmt.Errorf("itinerary doesn't exist")
+		return nil, ErrItineraryNotFound
 	}
 
 	var itinerary Itinerary
@@ -254,24 +532,55 @@ func (r *TripRepository) GetItinerary(itineraryID string) (*Itinerary, error) {
 	return &itinerary, nil
 }
 
-func (r *TripRepository) DeleteItinerary(itineraryID string) error {
+// DeleteItinerary removes the itinerary and its items, as long as the
+// itinerary is still at version. The items go first so a failed run can be
+// retried while the itinerary still exists.
+func (r *DynamoTripRepository) DeleteItinerary(itineraryID string, version int64) error {
+	itineraryKey := map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ITINERARY#%s", itineraryID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", itineraryID)},
+	}
+	if err := r.claimForDelete("Itineraries", itineraryKey, version, ErrItineraryNotFound); err != nil {
+		return fmt.Errorf("failed to delete itinerary with ID %s: %w", itineraryID, err)
+	}
+
+	itineraryItems, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("ItineraryItems"),
+		KeyConditionExpression: aws.String("PK = :itineraryID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":itineraryID": &types.AttributeValueMemberS{Value: fmt.Sprintf("ITINERARY#%s", itineraryID)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch items for itinerary with ID %s: %w", itineraryID, err)
+	}
+	if err := db.BatchDelete(r.Client, "ItineraryItems", db.PrimaryKeys(itineraryItems)); err != nil {
+		return err
+	}
+
 	queryInput := &dynamodb.DeleteItemInput{
-		TableName: aws.String("Itineraries"),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ITINERARY#%s", itineraryID)},
-			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", itineraryID)},
+		TableName:           aws.String("Itineraries"),
+		Key:                 itineraryKey,
+		ConditionExpression: aws.String("#Version = :version"),
+		ExpressionAttributeNames: map[string]string{
+			"#Version": "Version",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": versionValue(version + 1),
 		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
 	}
-	_, err := r.Client.DeleteItem(context.TODO(), queryInput)
+	_, err = r.Client.DeleteItem(context.TODO(), queryInput)
 	if err != nil {
-		return fmt.Errorf("failed to delete itinerary with ID %s: %w", itineraryID, err)
+		return fmt.Errorf("failed to delete itinerary with ID %s: %w", itineraryID, versionConflictError(err, ErrItineraryNotFound))
 	}
 
 	return nil
 }
 
-func (r *TripRepository) CreateItinerary(createItineraryData Itinerary) (*Itinerary, error) {
+func (r *DynamoTripRepository) CreateItinerary(createItineraryData Itinerary) (*Itinerary, error) {
 	createItineraryData.ID = utils.GenerateID()
+	createItineraryData.Version = 1
 	input := &dynamodb.PutItemInput{
 		TableName: aws.String("Itineraries"),
 		Item: map[string]types.AttributeValue{
@@ -284,7 +593,8 @@ func (r *TripRepository) CreateItinerary(createItineraryData Itinerary) (*Itiner
 			"StartDate":     &types.AttributeValueMemberS{Value: formatTime(createItineraryData.StartDate)},
 			"EndDate":       &types.AttributeValueMemberS{Value: formatTime(createItineraryData.EndDate)},
 			"ItineraryName": &types.AttributeValueMemberS{Value: createItineraryData.ItineraryName},
-			"ID":   &types.AttributeValueMemberS{Value: createItineraryData.ID},
+			"ID":            &types.AttributeValueMemberS{Value: createItineraryData.ID},
+			"Version":       versionValue(createItineraryData.Version),
 		},
 	}
 
@@ -296,27 +606,97 @@ func (r *TripRepository) CreateItinerary(createItineraryData Itinerary) (*Itiner
 	return &createItineraryData, err
 }
 
-func (r *TripRepository) GetItineraryItems(itineraryId ItineraryItem) ([]*ItineraryItem, error) {
+// EditItinerary overwrites the name and dates of an existing itinerary while
+// it is still at itineraryData.Version, which is then incremented.
+func (r *DynamoTripRepository) EditItinerary(itineraryData *Itinerary) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("Itineraries"),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ITINERARY#%s", itineraryData.ID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", itineraryData.ID)},
+		},
+		UpdateExpression:    aws.String("SET #ItineraryName = :itineraryName, #StartDate = :startDate, #EndDate = :endDate, #Version = :nextVersion"),
+		ConditionExpression: aws.String(versionCondition(itineraryData.Version)),
+		ExpressionAttributeNames: map[string]string{
+			"#ItineraryName": "ItineraryName",
+			"#StartDate":     "StartDate",
+			"#EndDate":       "EndDate",
+			"#Version":       "Version",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":itineraryName": &types.AttributeValueMemberS{Value: itineraryData.ItineraryName},
+			":startDate":     &types.AttributeValueMemberS{Value: formatTime(itineraryData.StartDate)},
+			":endDate":       &types.AttributeValueMemberS{Value: formatTime(itineraryData.EndDate)},
+			":version":       versionValue(itineraryData.Version),
+			":nextVersion":   versionValue(itineraryData.Version + 1),
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+
+	_, err := r.Client.UpdateItem(context.TODO(), input)
+	if err != nil {
+		return fmt.Errorf("failed to update itinerary: %w", versionConflictError(err, ErrItineraryNotFound))
+	}
+
+	itineraryData.Version++
+	return nil
+}
+
+func (r *DynamoTripRepository) GetItineraryItems(itineraryID string) ([]*ItineraryItem, error) {
+	items, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("ItineraryItems"),
+		KeyConditionExpression: aws.String("PK = :itineraryID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":itineraryID": &types.AttributeValueMemberS{Value: fmt.Sprintf("ITINERARY#%s", itineraryID)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch items for itinerary with ID %s: %w", itineraryID, err)
+	}
+
+	itineraryItems := []*ItineraryItem{}
+	for _, item := range items {
+		var itineraryItem ItineraryItem
+		err = attributevalue.UnmarshalMap(item, &itineraryItem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal itinerary item: %w", err)
+		}
+		itineraryItems = append(itineraryItems, &itineraryItem)
+	}
+
+	return itineraryItems, nil
+}
+
+func (r *DynamoTripRepository) GetItineraryItem(itineraryID, itineraryItemID string) (*ItineraryItem, error) {
+	queryInput := &dynamodb.GetItemInput{
+		TableName: aws.String("ItineraryItems"),
+		Key:       itineraryItemKey(itineraryID, itineraryItemID),
+	}
+	result, err := r.Client.GetItem(context.TODO(), queryInput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch itinerary item with ID %s: %w", itineraryItemID, err)
+	}
+
+	if result.Item == nil {
+		return nil, ErrItineraryItemNotFound
+	}
+
+	var itineraryItem ItineraryItem
+	err = attributevalue.UnmarshalMap(result.Item, &itineraryItem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal itinerary item: %w", err)
+	}
 
+	return &itineraryItem, nil
 }
 
-func (r *TripRepository) CreateItineraryItem(createItineraryItemData ItineraryItem) (*ItineraryItem, error) {
+func (r *DynamoTripRepository) CreateItineraryItem(createItineraryItemData ItineraryItem) (*ItineraryItem, error) {
 	createItineraryItemData.ID = utils.GenerateID()
+	createItineraryItemData.Version = 1
 	input := &dynamodb.PutItemInput{
-		TableName: aws.String("ItineraryItems"),
-		Item: map[string]types.AttributeValue{
-			"PK":            &types.AttributeValueMemberS{Value: fmt.Sprintf("ITINERARY#%s", createItineraryItemData.ItineraryID)},
-			"SK":            &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", createItineraryItemData.ItineraryID)},
-			"GSI1PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", createItineraryItemData.TripID)},
-			"GSI2PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("ITINERARYITEM#%s", createItineraryItemData.ID)},
-			"TripID":        &types.AttributeValueMemberS{Value: createItineraryItemData.TripID},
-			"ItineraryID":   &types.AttributeValueMemberS{Value: createItineraryItemData.ItineraryID},
-			"ID":            &types.AttributeValueMemberS{Value: createItineraryItemData.ID},
-			"StartDate":     &types.AttributeValueMemberS{Value: formatTime(createItineraryItemData.StartDate)},
-			"EndDate":       &types.AttributeValueMemberS{Value: formatTime(createItineraryItemData.EndDate)},
-			"Title":         &types.AttributeValueMemberS{Value: createItineraryItemData.Title},
-			"Description":   &types.AttributeValueMemberS{Value: createItineraryItemData.Description},
-		},
+		TableName:           aws.String("ItineraryItems"),
+		Item:                itineraryItemItem(&createItineraryItemData),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
 	}
 
 	_, err := r.Client.PutItem(context.TODO(), input)
@@ -327,6 +707,455 @@ func (r *TripRepository) CreateItineraryItem(createItineraryItemData ItineraryIt
 	return &createItineraryItemData, err
 }
 
+// EditItineraryItem replaces an existing item while it is still at
+// editItineraryItemData.Version and returns it with the incremented version.
+func (r *DynamoTripRepository) EditItineraryItem(editItineraryItemData ItineraryItem) (*ItineraryItem, error) {
+	expectedVersion := editItineraryItemData.Version
+	editItineraryItemData.Version++
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String("ItineraryItems"),
+		Item:                itineraryItemItem(&editItineraryItemData),
+		ConditionExpression: aws.String(versionCondition(expectedVersion)),
+		ExpressionAttributeNames: map[string]string{
+			"#Version": "Version",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": versionValue(expectedVersion),
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+
+	_, err := r.Client.PutItem(context.TODO(), input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update itinerary item with ID %s: %w", editItineraryItemData.ID, versionConflictError(err, ErrItineraryItemNotFound))
+	}
+
+	return &editItineraryItemData, nil
+}
+
+// DeleteItineraryItem removes the item while it is still at version.
+func (r *DynamoTripRepository) DeleteItineraryItem(itineraryID, itineraryItemID string, version int64) error {
+	queryInput := &dynamodb.DeleteItemInput{
+		TableName:           aws.String("ItineraryItems"),
+		Key:                 itineraryItemKey(itineraryID, itineraryItemID),
+		ConditionExpression: aws.String(versionCondition(version)),
+		ExpressionAttributeNames: map[string]string{
+			"#Version": "Version",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": versionValue(version),
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+	_, err := r.Client.DeleteItem(context.TODO(), queryInput)
+	if err != nil {
+		return fmt.Errorf("failed to delete itinerary item with ID %s: %w", itineraryItemID, versionConflictError(err, ErrItineraryItemNotFound))
+	}
+
+	return nil
+}
+
+func itineraryItemKey(itineraryID, itineraryItemID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ITINERARY#%s", itineraryID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ITEM#%s", itineraryItemID)},
+	}
+}
+
+// itineraryItemItem stores each item under its own sort key inside the
+// itinerary partition, so listing an itinerary is a single query on PK.
+func itineraryItemItem(itineraryItem *ItineraryItem) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK":          &types.AttributeValueMemberS{Value: fmt.Sprintf("ITINERARY#%s", itineraryItem.ItineraryID)},
+		"SK":          &types.AttributeValueMemberS{Value: fmt.Sprintf("ITEM#%s", itineraryItem.ID)},
+		"GSI1PK":      &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", itineraryItem.TripID)},
+		"TripID":      &types.AttributeValueMemberS{Value: itineraryItem.TripID},
+		"ItineraryID": &types.AttributeValueMemberS{Value: itineraryItem.ItineraryID},
+		"PlanID":      &types.AttributeValueMemberS{Value: itineraryItem.PlanID},
+		"ID":          &types.AttributeValueMemberS{Value: itineraryItem.ID},
+		"StartDate":   &types.AttributeValueMemberS{Value: formatTime(itineraryItem.StartDate)},
+		"EndDate":     &types.AttributeValueMemberS{Value: formatTime(itineraryItem.EndDate)},
+		"Title":       &types.AttributeValueMemberS{Value: itineraryItem.Title},
+		"Description": &types.AttributeValueMemberS{Value: itineraryItem.Description},
+		"Link":        &types.AttributeValueMemberS{Value: itineraryItem.Link},
+		"Location":    &types.AttributeValueMemberS{Value: itineraryItem.Location},
+		"Version":     versionValue(itineraryItem.Version),
+	}
+}
+
+func (r *DynamoTripRepository) GetPlanItems(planID string) ([]*PlanItem, error) {
+	items, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("PlanItems"),
+		KeyConditionExpression: aws.String("PK = :planID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":planID": &types.AttributeValueMemberS{Value: fmt.Sprintf("PLAN#%s", planID)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch items for plan with ID %s: %w", planID, err)
+	}
+
+	planItems := make([]*PlanItem, 0, len(items))
+	for _, item := range items {
+		var planItem PlanItem
+		err = attributevalue.UnmarshalMap(item, &planItem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal plan item: %w", err)
+		}
+		planItems = append(planItems, &planItem)
+	}
+
+	return planItems, nil
+}
+
+func (r *DynamoTripRepository) GetPlanItem(planID, planItemID string) (*PlanItem, error) {
+	result, err := r.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String("PlanItems"),
+		Key:       planItemKey(planID, planItemID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plan item with ID %s: %w", planItemID, err)
+	}
+
+	if result.Item == nil {
+		return nil, ErrPlanItemNotFound
+	}
+
+	var planItem PlanItem
+	err = attributevalue.UnmarshalMap(result.Item, &planItem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal plan item: %w", err)
+	}
+
+	return &planItem, nil
+}
+
+func (r *DynamoTripRepository) CreatePlanItem(createPlanItemData PlanItem) (*PlanItem, error) {
+	createPlanItemData.ID = utils.GenerateID()
+	_, err := r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String("PlanItems"),
+		Item:                planItemItem(&createPlanItemData),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &createPlanItemData, nil
+}
+
+func (r *DynamoTripRepository) EditPlanItem(editPlanItemData PlanItem) (*PlanItem, error) {
+	_, err := r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String("PlanItems"),
+		Item:                planItemItem(&editPlanItemData),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nil, ErrPlanItemNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update plan item with ID %s: %w", editPlanItemData.ID, err)
+	}
+
+	return &editPlanItemData, nil
+}
+
+func (r *DynamoTripRepository) DeletePlanItem(planID, planItemID string) error {
+	_, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String("PlanItems"),
+		Key:       planItemKey(planID, planItemID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete plan item with ID %s: %w", planItemID, err)
+	}
+
+	return nil
+}
+
+// SchedulePlanItem moves a plan item into an itinerary: the itinerary item is
+// created and the plan item removed in one transaction.
+func (r *DynamoTripRepository) SchedulePlanItem(planItem *PlanItem, itineraryItem ItineraryItem) (*ItineraryItem, error) {
+	itineraryItem.ID = utils.GenerateID()
+	itineraryItem.Version = 1
+	err := db.TransactWrite(r.Client, []types.TransactWriteItem{
+		db.PutIfNotExists("ItineraryItems", itineraryItemItem(&itineraryItem)),
+		{
+			Delete: &types.Delete{
+				TableName:           aws.String("PlanItems"),
+				Key:                 planItemKey(planItem.PlanID, planItem.ID),
+				ConditionExpression: aws.String("attribute_exists(PK)"),
+			},
+		},
+	})
+	if errors.Is(err, db.ErrConditionFailed) {
+		return nil, ErrPlanItemNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to schedule plan item with ID %s: %w", planItem.ID, err)
+	}
+
+	return &itineraryItem, nil
+}
+
+func planItemKey(planID, planItemID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PLAN#%s", planID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ITEM#%s", planItemID)},
+	}
+}
+
+func planItemItem(planItem *PlanItem) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"PK":          &types.AttributeValueMemberS{Value: fmt.Sprintf("PLAN#%s", planItem.PlanID)},
+		"SK":          &types.AttributeValueMemberS{Value: fmt.Sprintf("ITEM#%s", planItem.ID)},
+		"GSI1PK":      &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", planItem.TripID)},
+		"TripID":      &types.AttributeValueMemberS{Value: planItem.TripID},
+		"PlanID":      &types.AttributeValueMemberS{Value: planItem.PlanID},
+		"ID":          &types.AttributeValueMemberS{Value: planItem.ID},
+		"Title":       &types.AttributeValueMemberS{Value: planItem.Title},
+		"Description": &types.AttributeValueMemberS{Value: planItem.Description},
+		"Link":        &types.AttributeValueMemberS{Value: planItem.Link},
+		"Location":    &types.AttributeValueMemberS{Value: planItem.Location},
+		"CreatedBy":   &types.AttributeValueMemberS{Value: planItem.CreatedBy},
+	}
+	if planItem.StartDate != nil {
+		item["StartDate"] = &types.AttributeValueMemberS{Value: formatTime(*planItem.StartDate)}
+	}
+	if planItem.EndDate != nil {
+		item["EndDate"] = &types.AttributeValueMemberS{Value: formatTime(*planItem.EndDate)}
+	}
+	return item
+}
+
+func (r *DynamoTripRepository) GetMember(tripID, userID string) (*TripMember, error) {
+	result, err := r.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String("TripMembers"),
+		Key:       memberKey(tripID, userID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch member %s of trip %s: %w", userID, tripID, err)
+	}
+
+	if result.Item == nil {
+		return nil, ErrMemberNotFound
+	}
+
+	var member TripMember
+	err = attributevalue.UnmarshalMap(result.Item, &member)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal trip member: %w", err)
+	}
+
+	return &member, nil
+}
+
+func (r *DynamoTripRepository) GetMembers(tripID string) ([]*TripMember, error) {
+	items, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("TripMembers"),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :tripID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tripID": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripID)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch members for trip with ID %s: %w", tripID, err)
+	}
+
+	return unmarshalMembers(items)
+}
+
+func (r *DynamoTripRepository) GetMemberships(userID string) ([]*TripMember, error) {
+	items, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("TripMembers"),
+		KeyConditionExpression: aws.String("PK = :userID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch trip memberships for user with ID %s: %w", userID, err)
+	}
+
+	return unmarshalMembers(items)
+}
+
+func (r *DynamoTripRepository) CreateMember(member *TripMember) error {
+	_, err := r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String("TripMembers"),
+		Item:                memberItem(member),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrAlreadyMember
+	}
+	return err
+}
+
+func (r *DynamoTripRepository) UpdateMember(member *TripMember) error {
+	_, err := r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String("TripMembers"),
+		Item:                memberItem(member),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrMemberNotFound
+	}
+	return err
+}
+
+func (r *DynamoTripRepository) DeleteMember(tripID, userID string) error {
+	_, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String("TripMembers"),
+		Key:       memberKey(tripID, userID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete member %s of trip %s: %w", userID, tripID, err)
+	}
+	return nil
+}
+
+func unmarshalMembers(items []map[string]types.AttributeValue) ([]*TripMember, error) {
+	members := make([]*TripMember, 0, len(items))
+	for _, item := range items {
+		var member TripMember
+		if err := attributevalue.UnmarshalMap(item, &member); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal trip member: %w", err)
+		}
+		members = append(members, &member)
+	}
+	return members, nil
+}
+
+func memberKey(tripID, userID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", tripID)},
+	}
+}
+
+func memberItem(member *TripMember) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", member.UserID)},
+		"SK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", member.TripID)},
+		"GSI1PK":    &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", member.TripID)},
+		"GSI1SK":    &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", member.UserID)},
+		"TripID":    &types.AttributeValueMemberS{Value: member.TripID},
+		"UserID":    &types.AttributeValueMemberS{Value: member.UserID},
+		"Username":  &types.AttributeValueMemberS{Value: member.Username},
+		"Role":      &types.AttributeValueMemberS{Value: string(member.Role)},
+		"Status":    &types.AttributeValueMemberS{Value: string(member.Status)},
+		"InvitedBy": &types.AttributeValueMemberS{Value: member.InvitedBy},
+		"CreatedAt": &types.AttributeValueMemberS{Value: formatTime(member.CreatedAt)},
+
+		"GSI2PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", member.UserID)},
+		"GSI2SK":        &types.AttributeValueMemberS{Value: startSortKey(member.TripStartDate, member.TripID)},
+		"GSI3PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", member.UserID)},
+		"GSI3SK":        &types.AttributeValueMemberS{Value: createdSortKey(member.TripCreatedAt, member.TripID)},
+		"TripStartDate": &types.AttributeValueMemberS{Value: formatTime(member.TripStartDate)},
+		"TripCreatedAt": &types.AttributeValueMemberS{Value: formatTime(member.TripCreatedAt)},
+	}
+}
+
+func tripItem(tripData *Trip, planData *Plan) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", planData.TripID)},
+		"SK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("META#%s", planData.TripID)},
+		"GSI1PK":    &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", tripData.CreatedBy)},
+		"GSI2PK":    &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", planData.TripID)},
+		"CreatedBy": &types.AttributeValueMemberS{Value: tripData.CreatedBy},
+		"StartDate": &types.AttributeValueMemberS{Value: formatTime(tripData.StartDate)},
+		"EndDate":   &types.AttributeValueMemberS{Value: formatTime(tripData.EndDate)},
+		"Title":     &types.AttributeValueMemberS{Value: tripData.Title},
+		"ID":        &types.AttributeValueMemberS{Value: planData.TripID},
+		"Completed": &types.AttributeValueMemberBOOL{Value: tripData.Completed},
+		"Draft":     &types.AttributeValueMemberBOOL{Value: tripData.Draft},
+		"PlanID":    &types.AttributeValueMemberS{Value: planData.PlanID},
+		"CreatedAt": &types.AttributeValueMemberS{Value: formatTime(tripData.CreatedAt)},
+		"Version":   versionValue(tripData.Version),
+
+		"Status":          &types.AttributeValueMemberS{Value: string(tripData.Status)},
+		"StatusChangedBy": &types.AttributeValueMemberS{Value: tripData.StatusChangedBy},
+		"StatusChangedAt": &types.AttributeValueMemberS{Value: formatTime(tripData.StatusChangedAt)},
+	}
+	if statusKey, dueKey, ok := statusIndexKeys(tripData); ok {
+		item["GSI3PK"] = statusKey
+		item["GSI3SK"] = dueKey
+	}
+	return item
+}
+
+// statusIndexKeys places trips the status worker still has to move on in
+// the sparse GSI3, ordered by the date they're due.
+func statusIndexKeys(tripData *Trip) (types.AttributeValue, types.AttributeValue, bool) {
+	dueDate, ok := tripData.statusDueDate()
+	if !ok {
+		return nil, nil, false
+	}
+	return &types.AttributeValueMemberS{Value: fmt.Sprintf("STATUS#%s", tripData.Status)},
+		&types.AttributeValueMemberS{Value: sortableTime(dueDate)}, true
+}
+
+func planItem(planData *Plan) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK":     &types.AttributeValueMemberS{Value: fmt.Sprintf("TRIP#%s", planData.TripID)},
+		"SK":     &types.AttributeValueMemberS{Value: fmt.Sprintf("PLAN#%s", planData.PlanID)},
+		"GSI1PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PLAN#%s", planData.PlanID)},
+		"PlanID": &types.AttributeValueMemberS{Value: planData.PlanID},
+		"TripID": &types.AttributeValueMemberS{Value: planData.TripID},
+	}
+}
+
+// versionCondition matches a record that is still at version. Records written
+// before versioning have no Version attribute and count as version 0.
+func versionCondition(version int64) string {
+	if version == 0 {
+		return "attribute_exists(PK) AND (attribute_not_exists(#Version) OR #Version = :version)"
+	}
+	return "#Version = :version"
+}
+
+// claimForDelete bumps the version of the record being deleted while it is
+// still at version, so an edit made from the old version fails from now on
+// and the final delete can be made conditional on the bumped one.
+func (r *DynamoTripRepository) claimForDelete(table string, key map[string]types.AttributeValue, version int64, notFound error) error {
+	_, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String(table),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET #Version = :nextVersion"),
+		ConditionExpression: aws.String(versionCondition(version)),
+		ExpressionAttributeNames: map[string]string{
+			"#Version": "Version",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version":     versionValue(version),
+			":nextVersion": versionValue(version + 1),
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	return versionConflictError(err, notFound)
+}
+
+func versionValue(version int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)}
+}
+
+// versionConflictError tells a stale version apart from a missing record when
+// a versioned write fails its condition check.
+func versionConflictError(err error, notFound error) error {
+	var conditionFailed *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionFailed) {
+		return err
+	}
+	if conditionFailed.Item == nil {
+		return notFound
+	}
+	return ErrPreconditionFailed
+}
+
 func formatTime(date time.Time) string {
 	return date.Format(time.RFC3339)
 }
@@ -337,16 +1166,29 @@ func formatTime(date time.Time) string {
 // {
 // 	"PK": "TRIP#ID"
 // 	"SK": "META#ID"
-// 	"GSI1PK": "USER#ID"
-// 	"GSI1SK": "TRIP#ID"
+// 	"GSI1PK": "USER#ID" // creator
+// 	"GSI2PK": "TRIP#ID"
+// 	"GSI3PK": "STATUS#STATUS" // only planned and in-progress trips
+// 	"GSI3SK": "DUE DATE"
 // }
 
 // 2. Users
 
-// 3. Trip <-> Users
+// 3. TripMembers (Trip <-> Users)
 // {
 // 	"PK": "USER#ID" // get trips by user
 // 	"SK": "TRIP#ID"
 // 	"GSI1PK": "TRIP#ID" // get user by trips
 // 	"GSI1SK": "USER#ID"
+// 	"GSI2PK": "USER#ID" // user's trips by start date
+// 	"GSI2SK": "START#DATE#TRIP#ID"
+// 	"GSI3PK": "USER#ID" // user's trips by creation time
+// 	"GSI3SK": "CREATED#TIME#TRIP#ID"
+// }
+
+// 4. PlanItems
+// {
+// 	"PK": "PLAN#ID"
+// 	"SK": "ITEM#ID"
+// 	"GSI1PK": "TRIP#ID"
 // }
@@ -1,38 +1,245 @@
 package trip
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
 	"time"
 
+	"github.com/tabichanorg/tabichan-server/internal/db"
+	"github.com/tabichanorg/tabichan-server/internal/user"
 	"github.com/tabichanorg/tabichan-server/internal/utils"
 )
 
 type TripService struct {
-	Repo *TripRepository
+	Repo    TripRepository
+	Users   user.UserRepository
+	Cursors *utils.CursorCodec
 }
 
-func (s *TripService) GetTrips(userID string) ([]*Trip, error) {
-	trips, err := s.Repo.GetTrips(userID)
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+func (s *TripService) GetTrips(userID string, query TripQuery, limit int, cursor string) (*TripPage, error) {
+	if query.Sort == "" {
+		query.Sort = SortByStartDate
+	}
+	if query.Now.IsZero() {
+		query.Now = time.Now()
+	}
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+
+	scope := "trips:" + userID + ":" + query.scope()
+	page, err := s.pageRequest(scope, limit, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	trips, lastKey, err := s.Repo.GetTrips(userID, query, page)
 	if err != nil {
 		return nil, fmt.Errorf(`error fetching trips for user with id %s: %w`, userID, err)
 	}
 
-	return trips, nil
+	nextCursor, err := s.Cursors.Encode(scope, lastKey)
+	if err != nil {
+		return nil, fmt.Errorf(`error encoding trips cursor: %w`, err)
+	}
+
+	return &TripPage{Trips: trips, NextCursor: nextCursor}, nil
 }
 
-func (s *TripService) GetTrip(tripID string) (*Trip, error) {
-	trip, err := s.Repo.GetTrip(tripID)
+// pageRequest checks the requested page size and decodes a cursor issued for
+// the same listing scope.
+func (s *TripService) pageRequest(scope string, limit int, cursor string) (db.PageRequest, error) {
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit < 0 || limit > maxPageSize {
+		return db.PageRequest{}, validationErrorf("limit must be between 1 and %d", maxPageSize)
+	}
+
+	after, err := s.Cursors.Decode(scope, cursor)
 	if err != nil {
-		return nil, fmt.Errorf(`error fetching trip with id %s: %s`, tripID, err)
+		return db.PageRequest{}, &ValidationError{Err: err}
+	}
+
+	return db.PageRequest{Limit: limit, After: after}, nil
+}
+
+func (s *TripService) GetTrip(userID, tripID string) (*Trip, error) {
+	trip, err := s.authorizeTrip(userID, tripID, ActionRead)
+	if err != nil {
+		return nil, fmt.Errorf(`error fetching trip with id %s: %w`, tripID, err)
 	}
 
 	return trip, nil
 }
 
-func (s *TripService) DeleteTrip(tripID string) error {
-	err := s.Repo.DeleteTrip(tripID)
+func (s *TripService) DeleteTrip(userID, tripID string, precondition Precondition) (*DeleteTripResult, error) {
+	trip, err := s.authorizeTrip(userID, tripID, ActionManage)
+	if err != nil {
+		return nil, fmt.Errorf(`error deleting trip with id %s: %w`, tripID, err)
+	}
+	if !precondition.Matches(trip.Version) {
+		return nil, ErrPreconditionFailed
+	}
+
+	result, err := s.Repo.DeleteTrip(tripID, trip.Version)
+	if err != nil {
+		return nil, fmt.Errorf(`error deleting trip with id %s: %w`, tripID, err)
+	}
+
+	return result, nil
+}
+
+// EditTrip applies a JSON Merge Patch (RFC 7396) to the trip, so fields left
+// out of the patch keep their value while explicit false or empty values are
+// written. Dates can't shrink past any of the trip's itineraries or items.
+// The write is rejected if the trip changed since the version the client
+// read or since it was loaded here.
+func (s *TripService) EditTrip(userID, tripID string, patch []byte, precondition Precondition) (*Trip, error) {
+	trip, err := s.authorizeTrip(userID, tripID, ActionEdit)
+	if err != nil {
+		return nil, fmt.Errorf(`error editing trip with id %s: %w`, tripID, err)
+	}
+	if !precondition.Matches(trip.Version) {
+		return nil, ErrPreconditionFailed
+	}
+
+	var editedTrip Trip
+	if err := applyMergePatch(trip, patch, &editedTrip); err != nil {
+		return nil, err
+	}
+
+	if tripReadOnlyChanged(trip, &editedTrip) {
+		return nil, fmt.Errorf("%w: only title, startDate, endDate and status can be changed", ErrInvalidPatch)
+	}
+
+	if err := validateTripData(&editedTrip, trip); err != nil {
+		return nil, fmt.Errorf(`error validating trip data: %w`, err)
+	}
+
+	if editedTrip.Status != trip.Status {
+		if !editedTrip.Status.Valid() {
+			return nil, validationErrorf("status must be one of draft, planned, in-progress, completed or archived")
+		}
+		if !trip.Status.CanTransitionTo(editedTrip.Status) {
+			return nil, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, trip.Status, editedTrip.Status)
+		}
+		editedTrip.setStatus(editedTrip.Status, userID, time.Now())
+	}
+
+	if !editedTrip.StartDate.Equal(trip.StartDate) || !editedTrip.EndDate.Equal(trip.EndDate) {
+		if err := s.validateTripContentsWithinRange(&editedTrip); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.Repo.EditTrip(&editedTrip); err != nil {
+		return nil, fmt.Errorf(`error editing trip with id %s: %w`, tripID, err)
+	}
+
+	return &editedTrip, nil
+}
+
+// tripReadOnlyChanged reports whether a patch touched any of the fields the
+// server maintains. Draft and Completed follow Status.
+func tripReadOnlyChanged(trip, editedTrip *Trip) bool {
+	return editedTrip.ID != trip.ID ||
+		editedTrip.CreatedBy != trip.CreatedBy ||
+		!editedTrip.CreatedAt.Equal(trip.CreatedAt) ||
+		editedTrip.PlanID != trip.PlanID ||
+		editedTrip.Version != trip.Version ||
+		editedTrip.Draft != trip.Draft ||
+		editedTrip.Completed != trip.Completed ||
+		editedTrip.StatusChangedBy != trip.StatusChangedBy ||
+		!editedTrip.StatusChangedAt.Equal(trip.StatusChangedAt)
+}
+
+// AdvanceTripStatuses starts planned trips whose start date has passed and
+// completes running trips whose end date has passed. A trip that was missed
+// entirely is completed straight after it is started, without reading it
+// back from the index the first step just changed. Trips that change
+// underneath it are left for the next run.
+func (s *TripService) AdvanceTripStatuses(now time.Time) (int, error) {
+	advanced := 0
+	advance := func(trip *Trip) (bool, error) {
+		trip.setStatus(trip.nextAutomaticStatus(), SystemActor, now)
+		err := s.Repo.EditTrip(trip)
+		if errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrTripNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf(`error advancing status of trip with id %s: %w`, trip.ID, err)
+		}
+		advanced++
+		return true, nil
+	}
+
+	planned, err := s.Repo.GetTripsDue(TripStatusPlanned, now)
+	if err != nil {
+		return advanced, err
+	}
+	completed := make(map[string]bool)
+	for _, trip := range planned {
+		started, err := advance(trip)
+		if err != nil {
+			return advanced, err
+		}
+		if !started || trip.EndDate.After(now) {
+			continue
+		}
+		ended, err := advance(trip)
+		if err != nil {
+			return advanced, err
+		}
+		completed[trip.ID] = ended
+	}
+
+	running, err := s.Repo.GetTripsDue(TripStatusInProgress, now)
 	if err != nil {
-		return fmt.Errorf(`error deleting trip with id %s: %s`, tripID, err)
+		return advanced, err
+	}
+	for _, trip := range running {
+		if completed[trip.ID] {
+			continue
+		}
+		if _, err := advance(trip); err != nil {
+			return advanced, err
+		}
+	}
+
+	return advanced, nil
+}
+
+func (s *TripService) validateTripContentsWithinRange(tripData *Trip) error {
+	tripRange := TimeRange{tripData.StartDate, tripData.EndDate}
+
+	itineraries, _, err := s.Repo.GetItineraries(tripData.PlanID, db.PageRequest{})
+	if err != nil {
+		return err
+	}
+
+	for _, itinerary := range itineraries {
+		if err := validateDatesWithinRange(tripRange, TimeRange{itinerary.StartDate, itinerary.EndDate}); err != nil {
+			return validationErrorf("itinerary %q would fall outside the trip dates", itinerary.ItineraryName)
+		}
+
+		itineraryItems, err := s.Repo.GetItineraryItems(itinerary.ID)
+		if err != nil {
+			return err
+		}
+		for _, itineraryItem := range itineraryItems {
+			if err := validateDatesWithinRange(tripRange, TimeRange{itineraryItem.StartDate, itineraryItem.EndDate}); err != nil {
+				return validationErrorf("itinerary item %q would fall outside the trip dates", itineraryItem.Title)
+			}
+		}
 	}
 
 	return nil
@@ -40,72 +247,108 @@ func (s *TripService) DeleteTrip(tripID string) error {
 
 func (s *TripService) CreateTrip(tripData *Trip) (*Trip, error) {
 
-	if err := validateTripData(tripData); err != nil {
-		return nil, fmt.Errorf(`error validating trip data: %s`, err)
+	if err := validateTripData(tripData, nil); err != nil {
+		return nil, fmt.Errorf(`error validating trip data: %w`, err)
+	}
+
+	status := tripData.Status
+	if status == "" {
+		status = TripStatusPlanned
+		if tripData.Draft {
+			status = TripStatusDraft
+		}
+	}
+	if status != TripStatusDraft && status != TripStatusPlanned {
+		return nil, validationErrorf("new trips must be draft or planned")
 	}
 
 	tripID := utils.GenerateID()
 	planID := utils.GenerateID()
-
-	plan, err := s.CreatePlan(planID, tripID)
-	if err != nil {
-		return nil, fmt.Errorf(`error creating plan: "%s"`, err)
+	tripData.CreatedAt = time.Now().UTC()
+	tripData.setStatus(status, tripData.CreatedBy, tripData.CreatedAt)
+
+	plan := &Plan{PlanID: planID, TripID: tripID}
+	owner := &TripMember{
+		TripID:        tripID,
+		UserID:        tripData.CreatedBy,
+		Role:          RoleOwner,
+		Status:        MemberStatusAccepted,
+		InvitedBy:     tripData.CreatedBy,
+		CreatedAt:     tripData.CreatedAt,
+		TripStartDate: tripData.StartDate,
+		TripCreatedAt: tripData.CreatedAt,
+	}
+	if creator, err := s.Users.GetUserDetailsByID(tripData.CreatedBy); err == nil {
+		owner.Username = creator.Username
 	}
 
-	if err := s.Repo.CreateTrip(tripData, plan); err != nil {
+	if err := s.Repo.CreateTrip(tripData, plan, owner); err != nil {
 		return nil, fmt.Errorf(`error creating trip: "%s"`, err)
 	}
 
 	tripData.ID = tripID
 	tripData.PlanID = planID
 
-	return tripData, err
+	return tripData, nil
 }
 
-func (s *TripService) CreatePlan(planID, tripID string) (*Plan, error) {
-	plan, err := s.Repo.CreatePlan(planID, tripID)
+func (s *TripService) GetItineraries(userID, planId string, limit int, cursor string) (*ItineraryPage, error) {
+	if _, _, err := s.authorizePlan(userID, planId, ActionRead); err != nil {
+		return nil, fmt.Errorf(`error fetching itineraries for trip with plan id %s: %w`, planId, err)
+	}
+
+	scope := "itineraries:" + planId
+	page, err := s.pageRequest(scope, limit, cursor)
 	if err != nil {
 		return nil, err
 	}
-	return plan, nil
-}
 
-func (s *TripService) GetItineraries(planId string) ([]*Itinerary, error) {
-	itineraries, err := s.Repo.GetItineraries(planId)
+	itineraries, lastKey, err := s.Repo.GetItineraries(planId, page)
 	if err != nil {
 		return nil, fmt.Errorf(`error fetching itineraries for trip with plan id %s: %w`, planId, err)
 	}
 
-	return itineraries, nil
+	nextCursor, err := s.Cursors.Encode(scope, lastKey)
+	if err != nil {
+		return nil, fmt.Errorf(`error encoding itineraries cursor: %w`, err)
+	}
+
+	return &ItineraryPage{Itineraries: itineraries, NextCursor: nextCursor}, nil
 }
 
-func (s *TripService) GetItinerary(itineraryId string) (*Itinerary, error) {
-	itinerary, err := s.Repo.GetItinerary(itineraryId)
+func (s *TripService) GetItinerary(userID, itineraryId string) (*Itinerary, error) {
+	itinerary, _, err := s.authorizeItinerary(userID, itineraryId, ActionRead)
 	if err != nil {
-		return nil, fmt.Errorf(`error fetching itinerary with id %s: %s`, itineraryId, err)
+		return nil, fmt.Errorf(`error fetching itinerary with id %s: %w`, itineraryId, err)
 	}
 
 	return itinerary, nil
 }
 
-func (s *TripService) DeleteItinerary(itineraryId string) error {
-	err := s.Repo.DeleteItinerary(itineraryId)
+func (s *TripService) DeleteItinerary(userID, itineraryId string, precondition Precondition) error {
+	itinerary, _, err := s.authorizeItinerary(userID, itineraryId, ActionEdit)
+	if err != nil {
+		return fmt.Errorf(`error deleting itinerary with id %s: %w`, itineraryId, err)
+	}
+	if !precondition.Matches(itinerary.Version) {
+		return ErrPreconditionFailed
+	}
+
+	err = s.Repo.DeleteItinerary(itineraryId, itinerary.Version)
 	if err != nil {
-		return fmt.Errorf(`error deleting itinerary with id %s: %s`, itineraryId, err)
+		return fmt.Errorf(`error deleting itinerary with id %s: %w`, itineraryId, err)
 	}
 
 	return nil
 }
 
-func (s *TripService) CreateItinerary(createItineraryData Itinerary) (*Itinerary, error) {
-	trip, err := s.GetTrip(createItineraryData.TripID)
+func (s *TripService) CreateItinerary(userID string, createItineraryData Itinerary) (*Itinerary, error) {
+	trip, err := s.authorizeTrip(userID, createItineraryData.TripID, ActionEdit)
 	if err != nil {
 		return nil, err
 	}
 
-	rangeOne := TimeRange{trip.StartDate, trip.EndDate}
-	rangeTwo := TimeRange{createItineraryData.StartDate, createItineraryData.EndDate}
-	if err := validateDatesWithinRange(rangeOne, rangeTwo); err != nil {
+	if err := validateItineraryData(trip, &createItineraryData); err != nil {
 		return nil, err
 	}
 
@@ -117,7 +360,42 @@ func (s *TripService) CreateItinerary(createItineraryData Itinerary) (*Itinerary
 	return itinerary, nil
 }
 
-func (s *TripService) GetItineraryItems(itineraryId string) ([]*ItineraryItem, error) {
+// EditItinerary applies a JSON Merge Patch (RFC 7396) to the itinerary. Only
+// the name and dates can change, and the dates must stay within the trip.
+func (s *TripService) EditItinerary(userID, itineraryId string, patch []byte, precondition Precondition) (*Itinerary, error) {
+	itinerary, trip, err := s.authorizeItinerary(userID, itineraryId, ActionEdit)
+	if err != nil {
+		return nil, fmt.Errorf(`error editing itinerary with id %s: %w`, itineraryId, err)
+	}
+	if !precondition.Matches(itinerary.Version) {
+		return nil, ErrPreconditionFailed
+	}
+
+	var editedItinerary Itinerary
+	if err := applyMergePatch(itinerary, patch, &editedItinerary); err != nil {
+		return nil, err
+	}
+
+	if editedItinerary.ID != itinerary.ID || editedItinerary.PlanID != itinerary.PlanID || editedItinerary.TripID != itinerary.TripID || editedItinerary.Version != itinerary.Version {
+		return nil, fmt.Errorf("%w: itineraryId, planId, tripId and version can't be changed", ErrInvalidPatch)
+	}
+
+	if err := validateItineraryData(trip, &editedItinerary); err != nil {
+		return nil, err
+	}
+
+	if err := s.Repo.EditItinerary(&editedItinerary); err != nil {
+		return nil, fmt.Errorf(`error editing itinerary with id %s: %w`, itineraryId, err)
+	}
+
+	return &editedItinerary, nil
+}
+
+func (s *TripService) GetItineraryItems(userID, itineraryId string) ([]*ItineraryItem, error) {
+	if _, _, err := s.authorizeItinerary(userID, itineraryId, ActionRead); err != nil {
+		return nil, fmt.Errorf(`error fetching items for itinerary with itinerary id %s: %w`, itineraryId, err)
+	}
+
 	itineraryItems, err := s.Repo.GetItineraryItems(itineraryId)
 
 	if err != nil {
@@ -127,65 +405,469 @@ func (s *TripService) GetItineraryItems(itineraryId string) ([]*ItineraryItem, e
 	return itineraryItems, nil
 }
 
-func (s *TripService) CreateItineraryItem(createItineraryItemData ItineraryItem) (*ItineraryItem, error) {
-	// validate createItineraryItemData dates
-	if !createItineraryItemData.StartDate.Before(createItineraryItemData.EndDate) {
-		return nil, fmt.Errorf("start date before end date")
+func (s *TripService) GetItineraryItem(userID, itineraryId, itineraryItemId string) (*ItineraryItem, error) {
+	itineraryItem, _, err := s.authorizeItineraryItem(userID, itineraryId, itineraryItemId, ActionRead)
+	if err != nil {
+		return nil, fmt.Errorf(`error fetching itinerary item with id %s: %w`, itineraryItemId, err)
 	}
-	// needs to verify itinerary start/end date is still within trip start/end date
-	trip, err := s.GetTrip(createItineraryItemData.TripID)
+
+	return itineraryItem, nil
+}
+
+func (s *TripService) CreateItineraryItem(userID string, createItineraryItemData ItineraryItem) (*ItineraryItem, error) {
+	_, trip, err := s.authorizeItinerary(userID, createItineraryItemData.ItineraryID, ActionEdit)
 	if err != nil {
 		return nil, err
 	}
-	
-	// validate createItineraryItemData within trip dates
-	rangeOne := TimeRange{trip.StartDate, trip.EndDate}
-	rangeTwo := TimeRange{createItineraryItemData.StartDate, createItineraryItemData.EndDate}
-	if err := validateDatesWithinRange(rangeOne, rangeTwo); err != nil {
+	createItineraryItemData.TripID = trip.ID
+	createItineraryItemData.PlanID = trip.PlanID
+
+	if err := validateItineraryItemData(trip, &createItineraryItemData); err != nil {
 		return nil, err
 	}
 
-	if len(createItineraryItemData.Title) > 15 {
-		return nil, fmt.Errorf("title must be a maximum of 15 characters long")
+	itineraryItem, err := s.Repo.CreateItineraryItem(createItineraryItemData)
+	if err != nil {
+		return nil, err
 	}
+	return itineraryItem, nil
+}
 
-	if len(createItineraryItemData.Description) > 100 {
-		return nil, fmt.Errorf("description must be a maximum of 100 characters long")
+func (s *TripService) EditItineraryItem(userID string, editItineraryItemData ItineraryItem, precondition Precondition) (*ItineraryItem, error) {
+	existing, trip, err := s.authorizeItineraryItem(userID, editItineraryItemData.ItineraryID, editItineraryItemData.ID, ActionEdit)
+	if err != nil {
+		return nil, err
+	}
+	if !precondition.Matches(existing.Version) {
+		return nil, ErrPreconditionFailed
 	}
 
+	editItineraryItemData.TripID = existing.TripID
+	editItineraryItemData.PlanID = existing.PlanID
+	editItineraryItemData.Version = existing.Version
+	if err := validateItineraryItemData(trip, &editItineraryItemData); err != nil {
+		return nil, err
+	}
 
-	// get itinerary
-	itinerary, err := s.GetItinerary(createItineraryItemData.ItineraryID)
+	itineraryItem, err := s.Repo.EditItineraryItem(editItineraryItemData)
 	if err != nil {
 		return nil, err
 	}
+	return itineraryItem, nil
+}
 
-	// edit itinerary start and end dates
-	if createItineraryItemData.StartDate.Before(itinerary.StartDate) {
-		// edit endpoint to change itinerary data
+func (s *TripService) DeleteItineraryItem(userID, itineraryId, itineraryItemId string, precondition Precondition) error {
+	itineraryItem, _, err := s.authorizeItineraryItem(userID, itineraryId, itineraryItemId, ActionEdit)
+	if err != nil {
+		return fmt.Errorf(`error deleting itinerary item with id %s: %w`, itineraryItemId, err)
 	}
-	if createItineraryItemData.EndDate.After(itinerary.EndDate) {
-		// edit endpoint to change itinerary data
+	if !precondition.Matches(itineraryItem.Version) {
+		return ErrPreconditionFailed
 	}
 
-	itineraryItem, err := s.Repo.CreateItineraryItem(createItineraryItemData)
+	err = s.Repo.DeleteItineraryItem(itineraryId, itineraryItemId, itineraryItem.Version)
+	if err != nil {
+		return fmt.Errorf(`error deleting itinerary item with id %s: %w`, itineraryItemId, err)
+	}
+
+	return nil
+}
+
+func (s *TripService) GetPlan(userID, planID string) (*PlanDetails, error) {
+	plan, _, err := s.authorizePlan(userID, planID, ActionRead)
+	if err != nil {
+		return nil, fmt.Errorf(`error fetching plan with id %s: %w`, planID, err)
+	}
+
+	planItems, err := s.Repo.GetPlanItems(planID)
+	if err != nil {
+		return nil, fmt.Errorf(`error fetching plan with id %s: %w`, planID, err)
+	}
+
+	return &PlanDetails{TripID: plan.TripID, PlanID: plan.PlanID, PlanItems: planItems}, nil
+}
+
+func (s *TripService) GetPlanItems(userID, planID string) ([]*PlanItem, error) {
+	if _, _, err := s.authorizePlan(userID, planID, ActionRead); err != nil {
+		return nil, fmt.Errorf(`error fetching items for plan with id %s: %w`, planID, err)
+	}
+
+	planItems, err := s.Repo.GetPlanItems(planID)
+	if err != nil {
+		return nil, fmt.Errorf(`error fetching items for plan with id %s: %w`, planID, err)
+	}
+
+	return planItems, nil
+}
+
+func (s *TripService) GetPlanItem(userID, planID, planItemID string) (*PlanItem, error) {
+	planItem, _, err := s.authorizePlanItem(userID, planID, planItemID, ActionRead)
+	if err != nil {
+		return nil, fmt.Errorf(`error fetching plan item with id %s: %w`, planItemID, err)
+	}
+
+	return planItem, nil
+}
+
+func (s *TripService) CreatePlanItem(userID string, createPlanItemData PlanItem) (*PlanItem, error) {
+	plan, _, err := s.authorizePlan(userID, createPlanItemData.PlanID, ActionEdit)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validatePlanItemData(&createPlanItemData); err != nil {
+		return nil, err
+	}
+
+	createPlanItemData.TripID = plan.TripID
+	createPlanItemData.CreatedBy = userID
+
+	planItem, err := s.Repo.CreatePlanItem(createPlanItemData)
+	if err != nil {
+		return nil, err
+	}
+	return planItem, nil
+}
+
+func (s *TripService) EditPlanItem(userID string, editPlanItemData PlanItem) (*PlanItem, error) {
+	existing, _, err := s.authorizePlanItem(userID, editPlanItemData.PlanID, editPlanItemData.ID, ActionEdit)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validatePlanItemData(&editPlanItemData); err != nil {
+		return nil, err
+	}
+
+	editPlanItemData.TripID = existing.TripID
+	editPlanItemData.CreatedBy = existing.CreatedBy
+
+	planItem, err := s.Repo.EditPlanItem(editPlanItemData)
+	if err != nil {
+		return nil, err
+	}
+	return planItem, nil
+}
+
+func (s *TripService) DeletePlanItem(userID, planID, planItemID string) error {
+	if _, _, err := s.authorizePlanItem(userID, planID, planItemID, ActionEdit); err != nil {
+		return fmt.Errorf(`error deleting plan item with id %s: %w`, planItemID, err)
+	}
+
+	err := s.Repo.DeletePlanItem(planID, planItemID)
+	if err != nil {
+		return fmt.Errorf(`error deleting plan item with id %s: %w`, planItemID, err)
+	}
+
+	return nil
+}
+
+// SchedulePlanItem turns a plan item into an item of one of the trip's
+// itineraries. Dates from the request take precedence over the plan item's
+// rough dates, and the result must pass the usual itinerary item validation.
+func (s *TripService) SchedulePlanItem(userID, planID, planItemID string, scheduleData SchedulePlanItemRequest) (*ItineraryItem, error) {
+	planItem, trip, err := s.authorizePlanItem(userID, planID, planItemID, ActionEdit)
+	if err != nil {
+		return nil, err
+	}
+
+	itinerary, err := s.Repo.GetItinerary(scheduleData.ItineraryID)
+	if err != nil {
+		return nil, err
+	}
+	if itinerary.TripID != trip.ID {
+		return nil, ErrItineraryNotFound
+	}
+
+	startDate, endDate := planItem.StartDate, planItem.EndDate
+	if scheduleData.StartDate != nil {
+		startDate = scheduleData.StartDate
+	}
+	if scheduleData.EndDate != nil {
+		endDate = scheduleData.EndDate
+	}
+	if startDate == nil || endDate == nil {
+		return nil, validationErrorf("start and end dates are required to schedule a plan item")
+	}
+
+	itineraryItemData := ItineraryItem{
+		TripID:      trip.ID,
+		ItineraryID: itinerary.ID,
+		PlanID:      trip.PlanID,
+		StartDate:   *startDate,
+		EndDate:     *endDate,
+		Title:       planItem.Title,
+		Description: planItem.Description,
+		Link:        planItem.Link,
+		Location:    planItem.Location,
+	}
+	if err := validateItineraryItemData(trip, &itineraryItemData); err != nil {
+		return nil, err
+	}
+
+	itineraryItem, err := s.Repo.SchedulePlanItem(planItem, itineraryItemData)
 	if err != nil {
 		return nil, err
 	}
 	return itineraryItem, nil
 }
 
-func validateTripData(tripData *Trip) error {
+func (s *TripService) GetMembers(userID, tripID string) ([]*TripMember, error) {
+	if _, err := s.authorizeTrip(userID, tripID, ActionRead); err != nil {
+		return nil, fmt.Errorf(`error fetching members of trip with id %s: %w`, tripID, err)
+	}
+
+	members, err := s.Repo.GetMembers(tripID)
+	if err != nil {
+		return nil, fmt.Errorf(`error fetching members of trip with id %s: %w`, tripID, err)
+	}
+
+	return members, nil
+}
+
+func (s *TripService) InviteMember(userID, tripID string, invite InviteMemberRequest) (*TripMember, error) {
+	if !invite.Role.Valid() {
+		return nil, ErrInvalidRole
+	}
+
+	trip, err := s.authorizeTrip(userID, tripID, ActionManage)
+	if err != nil {
+		return nil, fmt.Errorf(`error inviting member to trip with id %s: %w`, tripID, err)
+	}
+
+	inviter, err := s.Users.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up user: %w", err)
+	}
+	if !inviter.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+
+	invitee, err := s.Users.GetUserByUsernameOrEmail(invite.UsernameOrEmail)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("error looking up user: %w", err)
+	}
+	// An invitation sent to an address has to reach whoever owns it, not
+	// someone who signed up with it without proving that.
+	if utils.IsEmail(invite.UsernameOrEmail) && !invitee.EmailVerified {
+		return nil, ErrUserNotFound
+	}
+
+	member := &TripMember{
+		TripID:    tripID,
+		UserID:    invitee.UserID,
+		Username:  invitee.Username,
+		Role:      invite.Role,
+		Status:    MemberStatusPending,
+		InvitedBy: userID,
+		CreatedAt: time.Now().UTC(),
+
+		TripStartDate: trip.StartDate,
+		TripCreatedAt: trip.CreatedAt,
+	}
+	if err := s.Repo.CreateMember(member); err != nil {
+		return nil, fmt.Errorf(`error inviting member to trip with id %s: %w`, tripID, err)
+	}
+
+	return member, nil
+}
+
+func (s *TripService) UpdateMemberRole(userID, tripID, memberID string, role Role) (*TripMember, error) {
+	if !role.Valid() {
+		return nil, ErrInvalidRole
+	}
+
+	if _, err := s.authorizeTrip(userID, tripID, ActionManage); err != nil {
+		return nil, fmt.Errorf(`error updating member of trip with id %s: %w`, tripID, err)
+	}
+
+	member, err := s.Repo.GetMember(tripID, memberID)
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role == RoleOwner && role != RoleOwner {
+		if err := s.ensureAnotherOwner(tripID, memberID); err != nil {
+			return nil, err
+		}
+	}
+
+	member.Role = role
+	if err := s.Repo.UpdateMember(member); err != nil {
+		return nil, fmt.Errorf(`error updating member of trip with id %s: %w`, tripID, err)
+	}
+
+	return member, nil
+}
+
+// RemoveMember removes memberID from the trip. Owners can remove anyone, and
+// any member can remove themselves to leave the trip.
+func (s *TripService) RemoveMember(userID, tripID, memberID string) error {
+	action := ActionManage
+	if userID == memberID {
+		action = ActionRead
+	}
+
+	trip, err := s.authorizeTrip(userID, tripID, action)
+	if err != nil {
+		return fmt.Errorf(`error removing member from trip with id %s: %w`, tripID, err)
+	}
+
+	if trip.CreatedBy == memberID {
+		return ErrTripCreator
+	}
+
+	member, err := s.Repo.GetMember(tripID, memberID)
+	if err != nil {
+		return err
+	}
+
+	if member.Role == RoleOwner && member.Status == MemberStatusAccepted {
+		if err := s.ensureAnotherOwner(tripID, memberID); err != nil {
+			return err
+		}
+	}
+
+	return s.Repo.DeleteMember(tripID, memberID)
+}
+
+func (s *TripService) GetInvitations(userID string) ([]*TripMember, error) {
+	memberships, err := s.Repo.GetMemberships(userID)
+	if err != nil {
+		return nil, fmt.Errorf(`error fetching invitations for user with id %s: %w`, userID, err)
+	}
+
+	invitations := []*TripMember{}
+	for _, membership := range memberships {
+		if membership.Status == MemberStatusPending {
+			invitations = append(invitations, membership)
+		}
+	}
+
+	return invitations, nil
+}
+
+// RespondToInvitation accepts or declines a pending invitation. Declining
+// removes the invitation entirely so the user can be invited again later.
+func (s *TripService) RespondToInvitation(userID, tripID string, accept bool) (*TripMember, error) {
+	member, err := s.Repo.GetMember(tripID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Status != MemberStatusPending {
+		return nil, ErrMemberNotFound
+	}
+
+	if !accept {
+		return nil, s.Repo.DeleteMember(tripID, userID)
+	}
+
+	member.Status = MemberStatusAccepted
+	if err := s.Repo.UpdateMember(member); err != nil {
+		return nil, fmt.Errorf(`error accepting invitation to trip with id %s: %w`, tripID, err)
+	}
+
+	return member, nil
+}
+
+func (s *TripService) ensureAnotherOwner(tripID, memberID string) error {
+	members, err := s.Repo.GetMembers(tripID)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if member.UserID != memberID && member.Role == RoleOwner && member.Status == MemberStatusAccepted {
+			return nil
+		}
+	}
+
+	return ErrLastOwner
+}
+
+// validateTripData checks a new trip, or an edited one when previous is set.
+// A trip that has already started can still be edited as long as its start
+// date is left alone.
+func validateTripData(tripData *Trip, previous *Trip) error {
 	if !tripData.StartDate.Before(tripData.EndDate) {
-		return fmt.Errorf("start date must be before end date")
+		return validationErrorf("start date must be before end date")
 	}
 
-	if tripData.StartDate.Before(time.Now().UTC()) {
-		return fmt.Errorf("start date must be in the future")
+	startDateChanged := previous == nil || !tripData.StartDate.Equal(previous.StartDate)
+	if startDateChanged && tripData.StartDate.Before(time.Now().UTC()) {
+		return validationErrorf("start date must be in the future")
 	}
 
 	if len(tripData.Title) > 15 {
-		return fmt.Errorf("title must be a maximum of 15 characters long")
+		return validationErrorf("title must be a maximum of 15 characters long")
+	}
+
+	return nil
+}
+
+func validateItineraryData(trip *Trip, itineraryData *Itinerary) error {
+	if !itineraryData.StartDate.Before(itineraryData.EndDate) {
+		return validationErrorf("start date must be before end date")
+	}
+
+	rangeOne := TimeRange{trip.StartDate, trip.EndDate}
+	rangeTwo := TimeRange{itineraryData.StartDate, itineraryData.EndDate}
+	return validateDatesWithinRange(rangeOne, rangeTwo)
+}
+
+func validateItineraryItemData(trip *Trip, itineraryItemData *ItineraryItem) error {
+	if !itineraryItemData.StartDate.Before(itineraryItemData.EndDate) {
+		return validationErrorf("start date must be before end date")
+	}
+
+	// needs to verify itinerary item start/end date is still within trip start/end date
+	rangeOne := TimeRange{trip.StartDate, trip.EndDate}
+	rangeTwo := TimeRange{itineraryItemData.StartDate, itineraryItemData.EndDate}
+	if err := validateDatesWithinRange(rangeOne, rangeTwo); err != nil {
+		return err
+	}
+
+	if len(itineraryItemData.Title) > 15 {
+		return validationErrorf("title must be a maximum of 15 characters long")
+	}
+
+	if len(itineraryItemData.Description) > 100 {
+		return validationErrorf("description must be a maximum of 100 characters long")
+	}
+
+	return nil
+}
+
+func validatePlanItemData(planItemData *PlanItem) error {
+	if planItemData.Title == "" {
+		return validationErrorf("title is required")
+	}
+
+	if len(planItemData.Title) > 15 {
+		return validationErrorf("title must be a maximum of 15 characters long")
+	}
+
+	if len(planItemData.Description) > 100 {
+		return validationErrorf("description must be a maximum of 100 characters long")
+	}
+
+	if len(planItemData.Location) > 100 {
+		return validationErrorf("location must be a maximum of 100 characters long")
+	}
+
+	if planItemData.StartDate != nil && planItemData.EndDate != nil && planItemData.EndDate.Before(*planItemData.StartDate) {
+		return validationErrorf("start date must be before end date")
+	}
+
+	if planItemData.Link != "" {
+		link, err := url.Parse(planItemData.Link)
+		if err != nil || (link.Scheme != "http" && link.Scheme != "https") || link.Host == "" {
+			return validationErrorf("link must be a valid http or https URL")
+		}
 	}
 
 	return nil
@@ -193,10 +875,32 @@ func validateTripData(tripData *Trip) error {
 
 func validateDatesWithinRange(rangeOne, rangeTwo TimeRange) error {
 	if rangeOne.StartDate.After(rangeTwo.StartDate) {
-		return fmt.Errorf("start date must come before parent start date")
+		return validationErrorf("start date must come before parent start date")
 	}
 	if rangeOne.EndDate.Before(rangeTwo.EndDate) {
-		return fmt.Errorf("end date must come before parent end date")
+		return validationErrorf("end date must come before parent end date")
+	}
+	return nil
+}
+
+// applyMergePatch merges patch into the JSON form of original and decodes the
+// result into patched. Unknown fields are rejected rather than ignored.
+func applyMergePatch(original any, patch []byte, patched any) error {
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return err
+	}
+
+	patchedJSON, err := utils.MergePatch(originalJSON, patch)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPatch, err)
 	}
+
+	decoder := json.NewDecoder(bytes.NewReader(patchedJSON))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(patched); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+
 	return nil
 }
@@ -0,0 +1,86 @@
+package trip
+
+import "time"
+
+type TripStatus string
+
+const (
+	TripStatusDraft      TripStatus = "draft"
+	TripStatusPlanned    TripStatus = "planned"
+	TripStatusInProgress TripStatus = "in-progress"
+	TripStatusCompleted  TripStatus = "completed"
+	TripStatusArchived   TripStatus = "archived"
+)
+
+// SystemActor is recorded as the author of status changes made by the
+// server itself, such as the status worker.
+const SystemActor = "system"
+
+var tripStatusTransitions = map[TripStatus][]TripStatus{
+	TripStatusDraft:      {TripStatusPlanned},
+	TripStatusPlanned:    {TripStatusDraft, TripStatusInProgress},
+	TripStatusInProgress: {TripStatusCompleted},
+	TripStatusCompleted:  {TripStatusArchived},
+	TripStatusArchived:   {TripStatusCompleted},
+}
+
+func (s TripStatus) Valid() bool {
+	_, ok := tripStatusTransitions[s]
+	return ok
+}
+
+func (s TripStatus) CanTransitionTo(next TripStatus) bool {
+	for _, allowed := range tripStatusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// setStatus moves the trip to status and records who made the change. Draft
+// and Completed are kept in step for clients that still read them.
+func (t *Trip) setStatus(status TripStatus, changedBy string, now time.Time) {
+	t.Status = status
+	t.StatusChangedBy = changedBy
+	t.StatusChangedAt = now.UTC()
+	t.Draft = status == TripStatusDraft
+	t.Completed = status == TripStatusCompleted || status == TripStatusArchived
+}
+
+// normalizeStatus fills in the status of trips stored before statuses
+// existed from their Draft and Completed flags.
+func (t *Trip) normalizeStatus() {
+	if t.Status != "" {
+		return
+	}
+
+	switch {
+	case t.Draft:
+		t.Status = TripStatusDraft
+	case t.Completed:
+		t.Status = TripStatusCompleted
+	default:
+		t.Status = TripStatusPlanned
+	}
+}
+
+// statusDueDate is when the status worker should move the trip on: planned
+// trips start at their StartDate and running trips end at their EndDate.
+func (t *Trip) statusDueDate() (time.Time, bool) {
+	switch t.Status {
+	case TripStatusPlanned:
+		return t.StartDate, true
+	case TripStatusInProgress:
+		return t.EndDate, true
+	}
+	return time.Time{}, false
+}
+
+// nextAutomaticStatus is the status the worker moves a due trip to.
+func (t *Trip) nextAutomaticStatus() TripStatus {
+	if t.Status == TripStatusPlanned {
+		return TripStatusInProgress
+	}
+	return TripStatusCompleted
+}
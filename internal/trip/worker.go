@@ -0,0 +1,37 @@
+package trip
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// StatusWorker periodically moves trips whose start or end date has passed
+// to their next status.
+type StatusWorker struct {
+	Service  *TripService
+	Interval time.Duration
+}
+
+// Run advances trips once straight away and then on every tick until ctx is
+// canceled.
+func (w *StatusWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		advanced, err := w.Service.AdvanceTripStatuses(time.Now())
+		if err != nil {
+			log.Printf("Failed to advance trip statuses: %v", err)
+		}
+		if advanced > 0 {
+			log.Printf("Advanced the status of %d trips", advanced)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,15 +2,24 @@ package user
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
 )
 
 type UserHandler struct {
 	Service *UserService
+	// TrustProxyHeaders reads the client's address for login throttling
+	// from X-Forwarded-For.
+	TrustProxyHeaders bool
 }
 
 func (h *UserHandler) Signup(w http.ResponseWriter, r *http.Request) {
@@ -31,24 +40,19 @@ func (h *UserHandler) Signup(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response, err := h.Service.Signup(newUser, r.Header.Get("User-Agent"))
+	if errors.Is(err, ErrWeakPassword) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
-	expiresAt, err := time.Parse(time.RFC3339, response.Session.ExpiresAt)
-	if err != nil {
+	if err := SetSessionCookie(w, response.Session); err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sessionID",
-		Value:    response.Session.SessionID,
-		Expires:  expiresAt,
-		HttpOnly: true,
-		// Secure:   true, // TODO: use Secure when hosting HTTPS
-	})
-
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(response)
 }
@@ -64,29 +68,201 @@ func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := h.Service.Login(loginRequest.UsernameOrEmail, loginRequest.Password, r.Header.Get("User-Agent"), loginRequest.RememberMe)
+	clientIP := utils.ClientIP(r, h.TrustProxyHeaders)
+	response, challenge, err := h.Service.Login(loginRequest.UsernameOrEmail, loginRequest.Password, r.Header.Get("User-Agent"), clientIP, loginRequest.RememberMe)
 	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
+	if challenge != nil {
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	if err := SetSessionCookie(w, response.Session); err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	expiresAt, err := time.Parse(time.RFC3339, response.Session.ExpiresAt)
-	if err != nil {
+	json.NewEncoder(w).Encode(response)
+}
+
+// LoginMFA is the second step of logging in for users with two-factor
+// authentication, taking the token Login returned and a code.
+func (h *UserHandler) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var mfaRequest struct {
+		MFAToken string `json:"mfaToken"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&mfaRequest); err != nil || mfaRequest.MFAToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	response, err := h.Service.CompleteMFALogin(mfaRequest.MFAToken, mfaRequest.Code, utils.ClientIP(r, h.TrustProxyHeaders))
+	if errors.Is(err, ErrInvalidMFACode) || errors.Is(err, ErrInvalidMFAChallenge) || errors.Is(err, ErrMFANotEnrolled) {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sessionID",
-		Value:    response.Session.SessionID,
-		Expires:  expiresAt,
-		HttpOnly: true,
-		// Secure:   true, // TODO: use Secure when hosting HTTPS
-	})
+	if err := SetSessionCookie(w, response.Session); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
+// writeLoginError answers a failed login with 401 for bad credentials and
+// 429 with a Retry-After header while the login is throttled.
+func writeLoginError(w http.ResponseWriter, err error) {
+	var throttled *LoginThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		SetRetryAfter(w, err)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, ErrInvalidCredentials):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// SetRetryAfter tells the client when to try again if err is a
+// LoginThrottledError, for the other handlers that log users in.
+func SetRetryAfter(w http.ResponseWriter, err error) {
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())))
+	}
+}
+
+func (h *UserHandler) GetMFAStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	status, err := h.Service.GetMFAStatus(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+func (h *UserHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	enrollment, err := h.Service.EnrollTOTP(userID)
+	if err != nil {
+		http.Error(w, err.Error(), mfaErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+func (h *UserHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	code, ok := decodeMFACode(w, r)
+	if !ok {
+		return
+	}
+
+	recoveryCodes, err := h.Service.ConfirmTOTP(userID, code)
+	if err != nil {
+		http.Error(w, err.Error(), mfaErrorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": recoveryCodes})
+}
+
+func (h *UserHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	code, ok := decodeMFACode(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Service.DisableTOTP(userID, code, utils.ClientIP(r, h.TrustProxyHeaders)); err != nil {
+		SetRetryAfter(w, err)
+		http.Error(w, err.Error(), mfaErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	code, ok := decodeMFACode(w, r)
+	if !ok {
+		return
+	}
+
+	recoveryCodes, err := h.Service.RegenerateRecoveryCodes(userID, code, utils.ClientIP(r, h.TrustProxyHeaders))
+	if err != nil {
+		SetRetryAfter(w, err)
+		http.Error(w, err.Error(), mfaErrorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": recoveryCodes})
+}
+
+func decodeMFACode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var codeRequest struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&codeRequest); err != nil || codeRequest.Code == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return "", false
+	}
+	return codeRequest.Code, true
+}
+
+func mfaErrorStatus(err error) int {
+	var throttled *LoginThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrInvalidMFACode):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrMFAAlreadyEnabled), errors.Is(err, ErrMFANotEnrolled):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func (h *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
@@ -102,6 +278,342 @@ func (h *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(userDetails)
 }
 
+// Logout ends the session in the request's cookie and revokes its bearer
+// token and the refresh token in the body, if there are any, and clears the
+// cookie either way so an expired session can still log out.
+func (h *UserHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	var logoutRequest struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	// The body is optional; cookie clients send none.
+	json.NewDecoder(r.Body).Decode(&logoutRequest)
+	if logoutRequest.RefreshToken != "" {
+		if err := h.Service.RevokeRefreshToken(logoutRequest.RefreshToken); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if token, ok := utils.BearerToken(r); ok {
+		err := h.Service.RevokeToken(token)
+		if err != nil && !errors.Is(err, utils.ErrInvalidToken) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if cookie, err := r.Cookie("sessionID"); err == nil {
+		if err := h.Service.Logout(cookie.Value); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var refreshRequest struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&refreshRequest); err != nil || refreshRequest.RefreshToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	response, err := h.Service.RefreshTokens(refreshRequest.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *UserHandler) GetIdentities(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	identities, err := h.Service.GetIdentities(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(identities)
+}
+
+func (h *UserHandler) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	vars := mux.Vars(r)
+	err := h.Service.UnlinkIdentity(userID, vars["provider"], vars["subject"])
+	switch {
+	case errors.Is(err, ErrIdentityNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrLastLoginMethod):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VerifyEmail is where the link in a verification email leads.
+func (h *UserHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	err := h.Service.VerifyEmail(r.URL.Query().Get("token"))
+	if errors.Is(err, ErrInvalidVerificationToken) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.Service.ResendVerification(userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *UserHandler) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	var changeRequest struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&changeRequest); err != nil || changeRequest.Email == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := validateEmail(changeRequest.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := h.Service.ChangeEmail(userID, changeRequest.Email)
+	if errors.Is(err, ErrInvalidEmail) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrEmailInUse) || errors.Is(err, ErrEmailChanged) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ForgotPassword always answers 202, so it can't be used to find out which
+// emails have accounts.
+func (h *UserHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var forgotRequest struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&forgotRequest); err != nil || forgotRequest.Email == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Service.ForgotPassword(forgotRequest.Email); err != nil {
+		log.Printf("Failed to send password reset email: %v", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *UserHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var resetRequest struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resetRequest); err != nil || resetRequest.Token == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err := h.Service.ResetPassword(resetRequest.Token, resetRequest.Password)
+	if errors.Is(err, ErrInvalidResetToken) || errors.Is(err, ErrPasswordRequired) || errors.Is(err, ErrWeakPassword) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	var changeRequest struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&changeRequest); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err := h.Service.ChangePassword(userID, changeRequest.CurrentPassword, changeRequest.NewPassword, utils.ClientIP(r, h.TrustProxyHeaders))
+	var throttled *LoginThrottledError
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.As(err, &throttled):
+		SetRetryAfter(w, err)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, ErrPasswordRequired), errors.Is(err, ErrWeakPassword):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrInvalidCredentials):
+		// Not 401, which would tell the client its session is gone.
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrPasswordChanged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// JWKS publishes the public keys access tokens can be verified with.
+func (h *UserHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.Service.Tokens.JWKS())
+}
+
+func (h *UserHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	sessionID, _ := r.Context().Value("sessionID").(string)
+
+	sessions, err := h.Service.GetSessions(userID, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (h *UserHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	sessionID, _ := r.Context().Value("sessionID").(string)
+
+	current, err := h.Service.RevokeSession(userID, sessionID, mux.Vars(r)["sessionID"])
+	if errors.Is(err, ErrSessionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if current {
+		clearSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeAllSessions logs the user out on every device, this one included.
+func (h *UserHandler) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.Service.RevokeAllSessions(userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetSessionCookie hands the session to the browser for as long as the
+// session lasts.
+func SetSessionCookie(w http.ResponseWriter, session *utils.Session) error {
+	expiresAt, err := time.Parse(time.RFC3339, session.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "sessionID",
+		Path:     "/",
+		Value:    session.SessionID,
+		Expires:  expiresAt,
+		HttpOnly: true,
+		// Secure:   true, // TODO: use Secure when hosting HTTPS
+	})
+	return nil
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "sessionID",
+		Path:     "/",
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		// Secure:   true, // TODO: use Secure when hosting HTTPS
+	})
+}
+
 func validateUsername(username string) error {
 	for _, char := range username {
 		if unicode.IsSpace(char) {
@@ -0,0 +1,514 @@
+package user
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tabichanorg/tabichan-server/internal/db"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+)
+
+type MemoryUserRepository struct {
+	// identityMu makes linking an identity check and write in one step, like
+	// the conditional put on the DynamoDB backend.
+	identityMu sync.Mutex
+	// factorMu does the same for starting a TOTP enrollment, and
+	// credentialMu for registering a passkey.
+	factorMu     sync.Mutex
+	credentialMu sync.Mutex
+	// attemptsMu makes counting a failed login read and write in one step.
+	attemptsMu sync.Mutex
+
+	Users         *db.MemoryTable[UserLogin]
+	Sessions      *db.MemoryTable[utils.Session]
+	RevokedTokens *db.MemoryTable[utils.RevokedToken]
+	RefreshTokens *db.MemoryTable[RefreshToken]
+	Identities    *db.MemoryTable[LinkedIdentity]
+	ResetTokens   *db.MemoryTable[PasswordResetToken]
+	TOTPFactors   *db.MemoryTable[TOTPFactor]
+	MFAChallenges *db.MemoryTable[MFAChallenge]
+	Credentials   *db.MemoryTable[WebAuthnCredential]
+	LoginAttempts *db.MemoryTable[LoginAttempts]
+	AuditEvents   *db.MemoryTable[AuditEvent]
+}
+
+func NewMemoryUserRepository(sessions *db.MemoryTable[utils.Session], revokedTokens *db.MemoryTable[utils.RevokedToken]) *MemoryUserRepository {
+	return &MemoryUserRepository{
+		Users:         db.NewMemoryTable[UserLogin](),
+		Sessions:      sessions,
+		RevokedTokens: revokedTokens,
+		RefreshTokens: db.NewMemoryTable[RefreshToken](),
+		Identities:    db.NewMemoryTable[LinkedIdentity](),
+		ResetTokens:   db.NewMemoryTable[PasswordResetToken](),
+		TOTPFactors:   db.NewMemoryTable[TOTPFactor](),
+		MFAChallenges: db.NewMemoryTable[MFAChallenge](),
+		Credentials:   db.NewMemoryTable[WebAuthnCredential](),
+		LoginAttempts: db.NewMemoryTable[LoginAttempts](),
+		AuditEvents:   db.NewMemoryTable[AuditEvent](),
+	}
+}
+
+func (r *MemoryUserRepository) CreateUser(user UserLogin) error {
+	r.Users.Put(user.UserID, user)
+	return nil
+}
+
+func (r *MemoryUserRepository) SetPasswordHash(userID, newHash string) error {
+	if !r.Users.Update(userID, func(stored *UserLogin) bool {
+		stored.Password = newHash
+		return true
+	}) {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) MarkEmailVerified(userID, email string) error {
+	return r.updateEmail(userID, email, func(stored *UserLogin) {
+		stored.EmailVerified = true
+	})
+}
+
+func (r *MemoryUserRepository) UpdateEmail(userID, oldEmail, newEmail string) error {
+	return r.updateEmail(userID, oldEmail, func(stored *UserLogin) {
+		stored.Email = newEmail
+		stored.EmailVerified = false
+	})
+}
+
+func (r *MemoryUserRepository) updateEmail(userID, email string, update func(stored *UserLogin)) error {
+	changed := false
+	if !r.Users.Update(userID, func(stored *UserLogin) bool {
+		if stored.Email != email {
+			changed = true
+			return false
+		}
+		update(stored)
+		return true
+	}) {
+		return ErrUserNotFound
+	}
+	if changed {
+		return ErrEmailChanged
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) UpdatePasswordHash(userID, oldHash, newHash string) error {
+	changed := false
+	if !r.Users.Update(userID, func(stored *UserLogin) bool {
+		if stored.Password != oldHash {
+			changed = true
+			return false
+		}
+		stored.Password = newHash
+		return true
+	}) {
+		return ErrUserNotFound
+	}
+	if changed {
+		return ErrPasswordChanged
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) GetUserByUsernameOrEmail(usernameOrEmailInput string) (*UserLogin, error) {
+	if utils.IsEmail(usernameOrEmailInput) {
+		return r.GetUserByEmail(usernameOrEmailInput)
+	}
+	return r.GetUserByUsername(usernameOrEmailInput)
+}
+
+func (r *MemoryUserRepository) GetUserByUsername(username string) (*UserLogin, error) {
+	return r.findUser(func(user UserLogin) bool { return user.Username == username })
+}
+
+func (r *MemoryUserRepository) GetUserByEmail(email string) (*UserLogin, error) {
+	return r.findUser(func(user UserLogin) bool { return user.Email == email })
+}
+
+func (r *MemoryUserRepository) GetUserDetailsByID(id string) (*User, error) {
+	user, ok := r.Users.Get(id)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &User{Username: user.Username, UserID: user.UserID, EmailVerified: user.EmailVerified}, nil
+}
+
+func (r *MemoryUserRepository) GetUserByID(id string) (*UserLogin, error) {
+	user, ok := r.Users.Get(id)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) CreateSession(session *utils.Session) error {
+	r.Sessions.Put(session.SessionID, *session)
+	return nil
+}
+
+func (r *MemoryUserRepository) FetchSession(sessionID string) (*utils.Session, error) {
+	session, ok := r.Sessions.Get(sessionID)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (r *MemoryUserRepository) GetSessionsByUserID(userID string) ([]*utils.Session, error) {
+	matches := r.Sessions.Filter(func(session utils.Session) bool {
+		return session.UserID == userID
+	})
+
+	sessions := make([]*utils.Session, 0, len(matches))
+	for i := range matches {
+		sessions = append(sessions, &matches[i])
+	}
+	return sessions, nil
+}
+
+func (r *MemoryUserRepository) DeleteSession(sessionID string) error {
+	r.Sessions.Delete(sessionID)
+	return nil
+}
+
+func (r *MemoryUserRepository) RevokeToken(token *utils.RevokedToken) error {
+	r.RevokedTokens.Put(token.TokenID, *token)
+	return nil
+}
+
+func (r *MemoryUserRepository) CreateRefreshToken(token *RefreshToken) error {
+	r.RefreshTokens.Put(token.TokenHash, *token)
+	return nil
+}
+
+func (r *MemoryUserRepository) GetRefreshToken(tokenHash string) (*RefreshToken, error) {
+	token, ok := r.RefreshTokens.Get(tokenHash)
+	if !ok {
+		return nil, ErrInvalidRefreshToken
+	}
+	return &token, nil
+}
+
+func (r *MemoryUserRepository) GetRefreshTokensByFamily(familyID string) ([]*RefreshToken, error) {
+	return r.findRefreshTokens(func(token RefreshToken) bool { return token.FamilyID == familyID }), nil
+}
+
+func (r *MemoryUserRepository) GetRefreshTokensByUserID(userID string) ([]*RefreshToken, error) {
+	return r.findRefreshTokens(func(token RefreshToken) bool { return token.UserID == userID }), nil
+}
+
+func (r *MemoryUserRepository) findRefreshTokens(match func(token RefreshToken) bool) []*RefreshToken {
+	matches := r.RefreshTokens.Filter(match)
+	tokens := make([]*RefreshToken, 0, len(matches))
+	for i := range matches {
+		tokens = append(tokens, &matches[i])
+	}
+	return tokens
+}
+
+func (r *MemoryUserRepository) MarkRefreshTokenUsed(tokenHash, usedAt string) error {
+	reused := false
+	found := r.RefreshTokens.Update(tokenHash, func(token *RefreshToken) bool {
+		if token.UsedAt != "" {
+			reused = true
+			return false
+		}
+		token.UsedAt = usedAt
+		return true
+	})
+	if !found || reused {
+		return ErrRefreshTokenReused
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) RevokeRefreshToken(tokenHash string) error {
+	r.RefreshTokens.Update(tokenHash, func(token *RefreshToken) bool {
+		token.Revoked = true
+		return true
+	})
+	return nil
+}
+
+func (r *MemoryUserRepository) CreateIdentity(identity *LinkedIdentity) error {
+	r.identityMu.Lock()
+	defer r.identityMu.Unlock()
+
+	key := identity.Provider + "#" + identity.Subject
+	if _, ok := r.Identities.Get(key); ok {
+		return ErrIdentityInUse
+	}
+	r.Identities.Put(key, *identity)
+	return nil
+}
+
+func (r *MemoryUserRepository) GetIdentity(provider, subject string) (*LinkedIdentity, error) {
+	identity, ok := r.Identities.Get(provider + "#" + subject)
+	if !ok {
+		return nil, ErrIdentityNotFound
+	}
+	return &identity, nil
+}
+
+func (r *MemoryUserRepository) GetIdentitiesByUserID(userID string) ([]*LinkedIdentity, error) {
+	matches := r.Identities.Filter(func(identity LinkedIdentity) bool {
+		return identity.UserID == userID
+	})
+
+	identities := make([]*LinkedIdentity, 0, len(matches))
+	for i := range matches {
+		identities = append(identities, &matches[i])
+	}
+	return identities, nil
+}
+
+func (r *MemoryUserRepository) DeleteIdentity(provider, subject string) error {
+	r.Identities.Delete(provider + "#" + subject)
+	return nil
+}
+
+func (r *MemoryUserRepository) CreatePasswordResetToken(token *PasswordResetToken) error {
+	r.ResetTokens.Put(token.TokenHash, *token)
+	return nil
+}
+
+func (r *MemoryUserRepository) ConsumePasswordResetToken(tokenHash string) (*PasswordResetToken, error) {
+	token, ok := r.ResetTokens.Get(tokenHash)
+	if !ok || !r.ResetTokens.Delete(tokenHash) {
+		return nil, ErrInvalidResetToken
+	}
+	return &token, nil
+}
+
+func (r *MemoryUserRepository) CreateTOTPFactor(factor *TOTPFactor) error {
+	r.factorMu.Lock()
+	defer r.factorMu.Unlock()
+
+	if existing, ok := r.TOTPFactors.Get(factor.UserID); ok && existing.Confirmed {
+		return ErrMFAAlreadyEnabled
+	}
+	r.TOTPFactors.Put(factor.UserID, *factor)
+	return nil
+}
+
+func (r *MemoryUserRepository) GetTOTPFactor(userID string) (*TOTPFactor, error) {
+	factor, ok := r.TOTPFactors.Get(userID)
+	if !ok {
+		return nil, ErrMFANotEnrolled
+	}
+	return &factor, nil
+}
+
+func (r *MemoryUserRepository) ConfirmTOTPFactor(userID string, step int64, recoveryCodes []string) error {
+	confirmed := false
+	r.TOTPFactors.Update(userID, func(factor *TOTPFactor) bool {
+		if factor.Confirmed {
+			return false
+		}
+		factor.Confirmed = true
+		factor.LastUsedStep = step
+		factor.RecoveryCodes = recoveryCodes
+		confirmed = true
+		return true
+	})
+	if !confirmed {
+		return ErrMFAAlreadyEnabled
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) UseTOTPStep(userID string, step int64) error {
+	used := false
+	r.TOTPFactors.Update(userID, func(factor *TOTPFactor) bool {
+		if factor.LastUsedStep >= step {
+			return false
+		}
+		factor.LastUsedStep = step
+		used = true
+		return true
+	})
+	if !used {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) UseRecoveryCode(userID, codeHash string) error {
+	used := false
+	r.TOTPFactors.Update(userID, func(factor *TOTPFactor) bool {
+		remaining := make([]string, 0, len(factor.RecoveryCodes))
+		for _, code := range factor.RecoveryCodes {
+			if code != codeHash {
+				remaining = append(remaining, code)
+			}
+		}
+		if len(remaining) == len(factor.RecoveryCodes) {
+			return false
+		}
+		factor.RecoveryCodes = remaining
+		used = true
+		return true
+	})
+	if !used {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) ReplaceRecoveryCodes(userID string, recoveryCodes []string) error {
+	replaced := false
+	r.TOTPFactors.Update(userID, func(factor *TOTPFactor) bool {
+		if !factor.Confirmed {
+			return false
+		}
+		factor.RecoveryCodes = recoveryCodes
+		replaced = true
+		return true
+	})
+	if !replaced {
+		return ErrMFANotEnrolled
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) DeleteTOTPFactor(userID string) error {
+	r.TOTPFactors.Delete(userID)
+	return nil
+}
+
+func (r *MemoryUserRepository) CreateMFAChallenge(challenge *MFAChallenge) error {
+	r.MFAChallenges.Put(challenge.TokenHash, *challenge)
+	return nil
+}
+
+func (r *MemoryUserRepository) GetMFAChallenge(tokenHash string) (*MFAChallenge, error) {
+	challenge, ok := r.MFAChallenges.Get(tokenHash)
+	if !ok {
+		return nil, ErrInvalidMFAChallenge
+	}
+	return &challenge, nil
+}
+
+func (r *MemoryUserRepository) RecordMFAChallengeFailure(tokenHash string) (int, error) {
+	var attempts int
+	if !r.MFAChallenges.Update(tokenHash, func(challenge *MFAChallenge) bool {
+		challenge.Attempts++
+		attempts = challenge.Attempts
+		return true
+	}) {
+		return 0, ErrInvalidMFAChallenge
+	}
+	return attempts, nil
+}
+
+func (r *MemoryUserRepository) ConsumeMFAChallenge(tokenHash string) (*MFAChallenge, error) {
+	challenge, ok := r.MFAChallenges.Get(tokenHash)
+	if !ok || !r.MFAChallenges.Delete(tokenHash) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	return &challenge, nil
+}
+
+func (r *MemoryUserRepository) CreateWebAuthnCredential(credential *WebAuthnCredential) error {
+	r.credentialMu.Lock()
+	defer r.credentialMu.Unlock()
+
+	if _, ok := r.Credentials.Get(credential.CredentialID); ok {
+		return ErrCredentialInUse
+	}
+	r.Credentials.Put(credential.CredentialID, *credential)
+	return nil
+}
+
+func (r *MemoryUserRepository) GetWebAuthnCredential(credentialID string) (*WebAuthnCredential, error) {
+	credential, ok := r.Credentials.Get(credentialID)
+	if !ok {
+		return nil, ErrCredentialNotFound
+	}
+	return &credential, nil
+}
+
+func (r *MemoryUserRepository) GetWebAuthnCredentialsByUserID(userID string) ([]*WebAuthnCredential, error) {
+	matches := r.Credentials.Filter(func(credential WebAuthnCredential) bool {
+		return credential.UserID == userID
+	})
+
+	credentials := make([]*WebAuthnCredential, 0, len(matches))
+	for i := range matches {
+		credentials = append(credentials, &matches[i])
+	}
+	return credentials, nil
+}
+
+func (r *MemoryUserRepository) UpdateWebAuthnSignCount(credentialID string, oldCount, newCount uint32, usedAt string) error {
+	updated := false
+	r.Credentials.Update(credentialID, func(credential *WebAuthnCredential) bool {
+		if credential.SignCount != oldCount {
+			return false
+		}
+		credential.SignCount = newCount
+		credential.LastUsedAt = usedAt
+		updated = true
+		return true
+	})
+	if !updated {
+		return ErrSignCountMismatch
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) DeleteWebAuthnCredential(credentialID string) error {
+	r.Credentials.Delete(credentialID)
+	return nil
+}
+
+func (r *MemoryUserRepository) GetLoginAttempts(key string) (*LoginAttempts, error) {
+	attempts, ok := r.LoginAttempts.Get(key)
+	if !ok {
+		return &LoginAttempts{Key: key}, nil
+	}
+	return &attempts, nil
+}
+
+func (r *MemoryUserRepository) RecordLoginFailure(key string, at time.Time, expiresAt time.Time) (*LoginAttempts, error) {
+	r.attemptsMu.Lock()
+	defer r.attemptsMu.Unlock()
+
+	attempts, ok := r.LoginAttempts.Get(key)
+	if !ok || attempts.ExpiresAtTTL <= at.Unix() {
+		attempts = LoginAttempts{Key: key}
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = at.UTC().Format(time.RFC3339)
+	attempts.ExpiresAtTTL = expiresAt.Unix()
+	r.LoginAttempts.Put(key, attempts)
+	return &attempts, nil
+}
+
+func (r *MemoryUserRepository) LockLogin(key string, until time.Time) error {
+	r.LoginAttempts.Update(key, func(attempts *LoginAttempts) bool {
+		attempts.LockedUntil = until.UTC().Format(time.RFC3339)
+		return true
+	})
+	return nil
+}
+
+func (r *MemoryUserRepository) ResetLoginAttempts(key string) error {
+	r.LoginAttempts.Delete(key)
+	return nil
+}
+
+func (r *MemoryUserRepository) CreateAuditEvent(event *AuditEvent) error {
+	r.AuditEvents.Put(event.EventID, *event)
+	return nil
+}
+
+func (r *MemoryUserRepository) findUser(match func(user UserLogin) bool) (*UserLogin, error) {
+	users := r.Users.Filter(match)
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return &users[0], nil
+}
@@ -0,0 +1,289 @@
+package user
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+)
+
+const (
+	totpIssuer = "tabichan"
+
+	// mfaChallengeLifetime is how long a user has to enter their code after
+	// getting the password right.
+	mfaChallengeLifetime = 5 * time.Minute
+	// maxMFAAttempts wrong codes end the challenge, so the password has to be
+	// entered again.
+	maxMFAAttempts = 5
+
+	recoveryCodeCount = 10
+)
+
+// recoveryCodeAlphabet is Crockford's base32, which leaves out letters that
+// are easy to misread. Having 32 characters means each one takes five random
+// bits without bias.
+const recoveryCodeAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// EnrollTOTP creates a new authenticator secret for the user. It doesn't
+// guard logins until ConfirmTOTP, and enrolling again before that replaces
+// it.
+func (s *UserService) EnrollTOTP(userID string) (*TOTPEnrollment, error) {
+	user, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TOTP secret: %v", err)
+	}
+
+	err = s.Repo.CreateTOTPFactor(&TOTPFactor{
+		UserID:    userID,
+		Secret:    secret,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		if errors.Is(err, ErrMFAAlreadyEnabled) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to store TOTP secret: %v", err)
+	}
+
+	return &TOTPEnrollment{Secret: secret, URI: utils.TOTPURI(totpIssuer, user.Username, secret)}, nil
+}
+
+// ConfirmTOTP turns on two-factor authentication once the user proves their
+// app works, and returns the recovery codes. They are only shown this once.
+func (s *UserService) ConfirmTOTP(userID, code string) ([]string, error) {
+	factor, err := s.Repo.GetTOTPFactor(userID)
+	if err != nil {
+		if errors.Is(err, ErrMFANotEnrolled) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to fetch TOTP factor: %v", err)
+	}
+	if factor.Confirmed {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	step, ok := utils.ValidateTOTP(factor.Secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Repo.ConfirmTOTPFactor(userID, step, hashes); err != nil {
+		if errors.Is(err, ErrMFAAlreadyEnabled) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to enable TOTP: %v", err)
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces every recovery code, used or not, after
+// checking a current code.
+func (s *UserService) RegenerateRecoveryCodes(userID, code, clientIP string) ([]string, error) {
+	if err := s.checkSecondFactor(userID, code, clientIP); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Repo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		if errors.Is(err, ErrMFANotEnrolled) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to store recovery codes: %v", err)
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off after checking a current
+// code or a recovery code, so a stolen session alone can't do it.
+func (s *UserService) DisableTOTP(userID, code, clientIP string) error {
+	if err := s.checkSecondFactor(userID, code, clientIP); err != nil {
+		return err
+	}
+	if err := s.Repo.DeleteTOTPFactor(userID); err != nil {
+		return fmt.Errorf("failed to disable TOTP: %v", err)
+	}
+	return nil
+}
+
+func (s *UserService) GetMFAStatus(userID string) (*MFAStatus, error) {
+	factor, err := s.Repo.GetTOTPFactor(userID)
+	if errors.Is(err, ErrMFANotEnrolled) {
+		return &MFAStatus{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch TOTP factor: %v", err)
+	}
+	if !factor.Confirmed {
+		return &MFAStatus{}, nil
+	}
+	return &MFAStatus{TOTPEnabled: true, RecoveryCodesLeft: len(factor.RecoveryCodes)}, nil
+}
+
+// CompleteMFALogin exchanges an MFA challenge and a code from the user's app,
+// or a recovery code, for a session. Each wrong code counts against the
+// challenge, and also against the account and clientIP like a wrong password
+// would, so codes can't be guessed by starting new challenges.
+func (s *UserService) CompleteMFALogin(mfaToken, code, clientIP string) (*LoginRequestResponse, error) {
+	tokenHash := hashToken(mfaToken)
+	challenge, err := s.Repo.GetMFAChallenge(tokenHash)
+	if err != nil {
+		if errors.Is(err, ErrInvalidMFAChallenge) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to fetch MFA challenge: %v", err)
+	}
+
+	expiresAt, err := utils.ConvertTimeStringToRFC3339(challenge.ExpiresAt)
+	if err != nil || time.Now().After(expiresAt) {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	if err := s.checkSecondFactor(challenge.UserID, code, clientIP); err != nil {
+		if !errors.Is(err, ErrInvalidMFACode) {
+			return nil, err
+		}
+		attempts, failErr := s.Repo.RecordMFAChallengeFailure(tokenHash)
+		if failErr == nil && attempts >= maxMFAAttempts {
+			_, failErr = s.Repo.ConsumeMFAChallenge(tokenHash)
+		}
+		if failErr != nil && !errors.Is(failErr, ErrInvalidMFAChallenge) {
+			return nil, fmt.Errorf("failed to record MFA attempt: %v", failErr)
+		}
+		return nil, err
+	}
+
+	// Deleting the challenge is what claims it, so two requests racing with
+	// the same challenge can't both get a session.
+	if _, err := s.Repo.ConsumeMFAChallenge(tokenHash); err != nil {
+		if errors.Is(err, ErrInvalidMFAChallenge) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to consume MFA challenge: %v", err)
+	}
+
+	s.resetLoginFailures(challenge.UserID)
+	return s.startLogin(challenge.UserID, challenge.Device, challenge.RememberMe)
+}
+
+func (s *UserService) mfaEnabled(userID string) (bool, error) {
+	factor, err := s.Repo.GetTOTPFactor(userID)
+	if errors.Is(err, ErrMFANotEnrolled) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch TOTP factor: %v", err)
+	}
+	return factor.Confirmed, nil
+}
+
+func (s *UserService) startMFAChallenge(userID, device string, rememberMe bool) (*MFAChallengeResponse, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate MFA token: %v", err)
+	}
+
+	expiresAt := time.Now().Add(mfaChallengeLifetime)
+	err = s.Repo.CreateMFAChallenge(&MFAChallenge{
+		TokenHash:    hashToken(token),
+		UserID:       userID,
+		Device:       device,
+		RememberMe:   rememberMe,
+		ExpiresAt:    expiresAt.Format(time.RFC3339),
+		ExpiresAtTTL: expiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store MFA challenge: %v", err)
+	}
+
+	return &MFAChallengeResponse{MFARequired: true, MFAToken: token, ExpiresAt: expiresAt.Format(time.RFC3339)}, nil
+}
+
+// checkSecondFactor verifies a code like verifySecondFactor, counting wrong
+// ones against the account and clientIP the way wrong passwords are, so
+// codes can't be guessed at any of the places that ask for one.
+func (s *UserService) checkSecondFactor(userID, code, clientIP string) error {
+	accountKey, ipKey := loginAttemptKeys(userID, "", clientIP)
+	if err := s.checkLoginThrottle(accountKey, ipKey); err != nil {
+		return err
+	}
+
+	err := s.verifySecondFactor(userID, code)
+	if errors.Is(err, ErrInvalidMFACode) {
+		if failErr := s.recordLoginFailure(userID, accountKey, ipKey, clientIP); failErr != nil {
+			return failErr
+		}
+	}
+	return err
+}
+
+// verifySecondFactor accepts a code from the user's app, each of which works
+// once, or one of their recovery codes, which is used up.
+func (s *UserService) verifySecondFactor(userID, code string) error {
+	factor, err := s.Repo.GetTOTPFactor(userID)
+	if err != nil {
+		if errors.Is(err, ErrMFANotEnrolled) {
+			return err
+		}
+		return fmt.Errorf("failed to fetch TOTP factor: %v", err)
+	}
+	if !factor.Confirmed {
+		return ErrMFANotEnrolled
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := utils.ValidateTOTP(factor.Secret, code, time.Now()); ok {
+		return s.Repo.UseTOTPStep(userID, step)
+	}
+
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return ErrInvalidMFACode
+	}
+	return s.Repo.UseRecoveryCode(userID, hashToken(normalized))
+}
+
+// newRecoveryCodes returns codes formatted for the user, like
+// "4k7qz-m2x9c", and the hashes to store for them.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		random := make([]byte, 10)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+
+		raw := make([]byte, len(random))
+		for i, b := range random {
+			raw[i] = recoveryCodeAlphabet[b&31]
+		}
+
+		codes = append(codes, string(raw[:5])+"-"+string(raw[5:]))
+		hashes = append(hashes, hashToken(string(raw)))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.ReplaceAll(code, "-", ""), " ", ""))
+	if len(code) != 10 {
+		return ""
+	}
+	return code
+}
@@ -10,6 +10,7 @@ type UserLogin struct {
 	Username      string `json:"username"`
 	Password      string `json:"password"`
 	Email         string `json:"email"`
+	EmailVerified bool   `json:"-"`
 	OAuthProvider string `json:"oauth"`
 	UserID        string `json:"userId"`
 }
@@ -18,12 +19,155 @@ type User struct {
 	Username         string    `json:"username"`
 	DisplayName      string    `json:"displayName"`
 	UserID           string    `json:"userId"`
+	EmailVerified    bool      `json:"emailVerified"`
 	ProfileImageData string    `json:"profileImageData"`
 	CreatedAt        time.Time `json:"createdAt"`
 	LastLoginAt      time.Time `json:"lastLoginAt"`
 }
 
+// SessionInfo describes one of a user's sessions without exposing the
+// session ID itself, which works as a credential.
+type SessionInfo struct {
+	ID        string `json:"id"`
+	Device    string `json:"device"`
+	CreatedAt string `json:"createdAt"`
+	ExpiresAt string `json:"expiresAt"`
+	Current   bool   `json:"current"`
+}
+
+// LinkedIdentity is a login provider account that logs in as the user. A
+// user can have any number of them next to, or instead of, a password.
+type LinkedIdentity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	UserID   string `json:"-"`
+	Email    string `json:"email"`
+	LinkedAt string `json:"linkedAt"`
+}
+
+// WebAuthnCredential is a passkey that logs in as the user. CredentialID is
+// base64url encoded and PublicKey is in PKIX form. SignCount is the
+// authenticator's counter from its last use; authenticators that keep one
+// have to report a higher count every time.
+type WebAuthnCredential struct {
+	CredentialID string   `json:"id"`
+	UserID       string   `json:"-"`
+	Name         string   `json:"name"`
+	PublicKey    []byte   `json:"-"`
+	Algorithm    int      `json:"-"`
+	SignCount    uint32   `json:"-"`
+	Transports   []string `json:"transports" dynamodbav:",omitempty"`
+	CreatedAt    string   `json:"createdAt"`
+	LastUsedAt   string   `json:"lastUsedAt,omitempty" dynamodbav:",omitempty"`
+}
+
+// ExternalIdentity is an account a login provider has vouched for.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
 type LoginRequestResponse struct {
-	Token   string         `json:"token"`
-	Session *utils.Session `json:"session"`
+	Token        string         `json:"token"`
+	RefreshToken string         `json:"refreshToken,omitempty"`
+	Session      *utils.Session `json:"session"`
+}
+
+// RefreshToken is the stored form of an opaque refresh token; only its
+// SHA-256 hash is kept. Every token issued by rotating another one shares its
+// FamilyID, so a replayed token can take the whole chain down with it.
+type RefreshToken struct {
+	TokenHash    string
+	FamilyID     string
+	UserID       string
+	CreatedAt    string
+	ExpiresAt    string
+	ExpiresAtTTL int64
+	UsedAt       string `dynamodbav:",omitempty"`
+	Revoked      bool
+}
+
+// PasswordResetToken is the stored form of an emailed reset token; only its
+// SHA-256 hash is kept and it is deleted when used.
+type PasswordResetToken struct {
+	TokenHash    string
+	UserID       string
+	ExpiresAt    string
+	ExpiresAtTTL int64
+}
+
+// TOTPFactor is a user's authenticator app. It only guards logins once
+// Confirmed, which happens when the user enters a first code from it.
+// LastUsedStep keeps a code from being used twice, and RecoveryCodes holds
+// the SHA-256 hashes of the recovery codes not used yet.
+type TOTPFactor struct {
+	UserID        string
+	Secret        string
+	Confirmed     bool
+	LastUsedStep  int64
+	RecoveryCodes []string `dynamodbav:",stringset,omitempty"`
+	CreatedAt     string
+}
+
+// MFAChallenge is a login that got the password right and still needs a
+// second factor. Only the SHA-256 hash of its token is kept, and it is
+// deleted when used or after too many wrong codes.
+type MFAChallenge struct {
+	TokenHash    string
+	UserID       string
+	Device       string
+	RememberMe   bool
+	Attempts     int
+	ExpiresAt    string
+	ExpiresAtTTL int64
+}
+
+// MFAChallengeResponse is what a login with the right password returns when
+// the user has two-factor authentication enabled.
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfaRequired"`
+	MFAToken    string `json:"mfaToken"`
+	ExpiresAt   string `json:"expiresAt"`
+}
+
+// TOTPEnrollment is the secret of a new authenticator app, both raw and as
+// an otpauth:// URI.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type MFAStatus struct {
+	TOTPEnabled       bool `json:"totpEnabled"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+// LoginAttempts counts recent failed logins for one account or client IP,
+// keyed like "user#<id>", "name#<identifier>" or "ip#<address>". The count starts over once
+// ExpiresAtTTL passes without another failure, and LockedUntil is when the
+// next attempt is allowed.
+type LoginAttempts struct {
+	Key           string
+	Failures      int
+	LastFailureAt string
+	LockedUntil   string `dynamodbav:",omitempty"`
+	ExpiresAtTTL  int64
+}
+
+// AuditEvent records something security relevant that happened to an
+// account, such as it being locked out after too many failed logins.
+type AuditEvent struct {
+	EventID   string
+	Type      string
+	UserID    string `dynamodbav:",omitempty"`
+	IP        string `dynamodbav:",omitempty"`
+	Detail    string
+	CreatedAt string
+}
+
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
 }
@@ -0,0 +1,84 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AddWebAuthnCredential stores a passkey the webauthn package has verified.
+func (s *UserService) AddWebAuthnCredential(credential *WebAuthnCredential) error {
+	err := s.Repo.CreateWebAuthnCredential(credential)
+	if errors.Is(err, ErrCredentialInUse) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store passkey: %v", err)
+	}
+	return nil
+}
+
+func (s *UserService) GetWebAuthnCredential(credentialID string) (*WebAuthnCredential, error) {
+	credential, err := s.Repo.GetWebAuthnCredential(credentialID)
+	if errors.Is(err, ErrCredentialNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch passkey: %v", err)
+	}
+	return credential, nil
+}
+
+func (s *UserService) GetWebAuthnCredentials(userID string) ([]*WebAuthnCredential, error) {
+	credentials, err := s.Repo.GetWebAuthnCredentialsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch passkeys: %v", err)
+	}
+	return credentials, nil
+}
+
+// DeleteWebAuthnCredential removes one of the user's passkeys, as long as
+// they keep another way to log in.
+func (s *UserService) DeleteWebAuthnCredential(userID, credentialID string) error {
+	credential, err := s.Repo.GetWebAuthnCredential(credentialID)
+	if errors.Is(err, ErrCredentialNotFound) || (err == nil && credential.UserID != userID) {
+		return ErrCredentialNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch passkey: %v", err)
+	}
+
+	if err := s.checkOtherLoginMethod(userID); err != nil {
+		return err
+	}
+
+	if err := s.Repo.DeleteWebAuthnCredential(credentialID); err != nil {
+		return fmt.Errorf("failed to delete passkey: %v", err)
+	}
+	return nil
+}
+
+// LoginWithWebAuthn logs in as the owner of a passkey that just produced a
+// valid assertion with newSignCount. A passkey with user verification counts
+// as both factors, so no MFA challenge follows. It still fails with a
+// LoginThrottledError while the account is locked out.
+func (s *UserService) LoginWithWebAuthn(credential *WebAuthnCredential, newSignCount uint32, device string, rememberMe bool) (*LoginRequestResponse, error) {
+	if err := s.checkAccountLock(credential.UserID); err != nil {
+		return nil, err
+	}
+
+	// Authenticators that don't keep a counter always report zero.
+	if (newSignCount != 0 || credential.SignCount != 0) && newSignCount <= credential.SignCount {
+		return nil, ErrSignCountMismatch
+	}
+
+	err := s.Repo.UpdateWebAuthnSignCount(credential.CredentialID, credential.SignCount, newSignCount, time.Now().Format(time.RFC3339))
+	if errors.Is(err, ErrSignCountMismatch) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update passkey: %v", err)
+	}
+
+	return s.startLogin(credential.UserID, device, rememberMe)
+}
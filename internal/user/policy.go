@@ -0,0 +1,68 @@
+package user
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrWeakPassword = errors.New("password is not allowed")
+
+// PasswordPolicy decides which new passwords are accepted: at least
+// MinLength characters, at most MaxLength bytes and not in the list of known
+// breached passwords. MaxLength is zero for no limit. Only bcrypt needs one,
+// since it ignores everything past utils.BcryptMaxPasswordLength bytes;
+// argon2id takes passwords of any length.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	breached  map[string]struct{}
+}
+
+// LoadPasswordPolicy reads the breached passwords from breachedFile, one per
+// line, with blank lines and lines starting with # skipped. An empty path
+// means no list. Entries are compared case-insensitively. Empty passwords are
+// never accepted, whatever minLength is.
+func LoadPasswordPolicy(minLength int, breachedFile string) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{MinLength: max(minLength, 1), breached: map[string]struct{}{}}
+	if breachedFile == "" {
+		return policy, nil
+	}
+
+	file, err := os.Open(breachedFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password list: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		policy.breached[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read breached password list: %v", err)
+	}
+	return policy, nil
+}
+
+// Check returns an error wrapping ErrWeakPassword that says what is wrong
+// with password.
+func (p *PasswordPolicy) Check(password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("%w: it must be at least %d characters long", ErrWeakPassword, p.MinLength)
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		return fmt.Errorf("%w: it must be at most %d bytes long", ErrWeakPassword, p.MaxLength)
+	}
+	if _, ok := p.breached[strings.ToLower(password)]; ok {
+		return fmt.Errorf("%w: it has appeared in a data breach, choose another one", ErrWeakPassword)
+	}
+	return nil
+}
@@ -2,51 +2,281 @@ package user
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/tabichanorg/tabichan-server/internal/db"
 	"github.com/tabichanorg/tabichan-server/internal/utils"
 )
 
-type UserRepository struct {
+type UserRepository interface {
+	CreateUser(user UserLogin) error
+	GetUserByUsernameOrEmail(usernameOrEmailInput string) (*UserLogin, error)
+	GetUserByUsername(username string) (*UserLogin, error)
+	GetUserByEmail(email string) (*UserLogin, error)
+	GetUserDetailsByID(id string) (*User, error)
+	GetUserByID(id string) (*UserLogin, error)
+	CreateSession(session *utils.Session) error
+	FetchSession(sessionID string) (*utils.Session, error)
+	GetSessionsByUserID(userID string) ([]*utils.Session, error)
+	DeleteSession(sessionID string) error
+	RevokeToken(token *utils.RevokedToken) error
+	CreateRefreshToken(token *RefreshToken) error
+	GetRefreshToken(tokenHash string) (*RefreshToken, error)
+	GetRefreshTokensByFamily(familyID string) ([]*RefreshToken, error)
+	GetRefreshTokensByUserID(userID string) ([]*RefreshToken, error)
+	MarkRefreshTokenUsed(tokenHash, usedAt string) error
+	RevokeRefreshToken(tokenHash string) error
+	CreateIdentity(identity *LinkedIdentity) error
+	GetIdentity(provider, subject string) (*LinkedIdentity, error)
+	GetIdentitiesByUserID(userID string) ([]*LinkedIdentity, error)
+	DeleteIdentity(provider, subject string) error
+	CreatePasswordResetToken(token *PasswordResetToken) error
+	// ConsumePasswordResetToken removes and returns the token, so that it
+	// can only be used once.
+	ConsumePasswordResetToken(tokenHash string) (*PasswordResetToken, error)
+	// CreateTOTPFactor starts an enrollment, replacing one that was never
+	// confirmed. It fails with ErrMFAAlreadyEnabled once one is confirmed.
+	CreateTOTPFactor(factor *TOTPFactor) error
+	GetTOTPFactor(userID string) (*TOTPFactor, error)
+	ConfirmTOTPFactor(userID string, step int64, recoveryCodes []string) error
+	// UseTOTPStep records that the code for step was used, failing with
+	// ErrInvalidMFACode if it or a later one already was.
+	UseTOTPStep(userID string, step int64) error
+	// UseRecoveryCode removes the code, failing with ErrInvalidMFACode if it
+	// isn't one of the user's unused codes.
+	UseRecoveryCode(userID, codeHash string) error
+	ReplaceRecoveryCodes(userID string, recoveryCodes []string) error
+	DeleteTOTPFactor(userID string) error
+	CreateMFAChallenge(challenge *MFAChallenge) error
+	GetMFAChallenge(tokenHash string) (*MFAChallenge, error)
+	// RecordMFAChallengeFailure counts a wrong code against the challenge and
+	// returns how many there have been.
+	RecordMFAChallengeFailure(tokenHash string) (int, error)
+	// ConsumeMFAChallenge removes and returns the challenge, so that it can
+	// only be used once.
+	ConsumeMFAChallenge(tokenHash string) (*MFAChallenge, error)
+	// CreateWebAuthnCredential fails with ErrCredentialInUse if the
+	// credential is already registered to anyone.
+	CreateWebAuthnCredential(credential *WebAuthnCredential) error
+	GetWebAuthnCredential(credentialID string) (*WebAuthnCredential, error)
+	GetWebAuthnCredentialsByUserID(userID string) ([]*WebAuthnCredential, error)
+	// UpdateWebAuthnSignCount moves the credential's counter from oldCount to
+	// newCount, failing with ErrSignCountMismatch if another login moved it
+	// first.
+	UpdateWebAuthnSignCount(credentialID string, oldCount, newCount uint32, usedAt string) error
+	DeleteWebAuthnCredential(credentialID string) error
+	// UpdatePasswordHash replaces the user's password hash, failing with
+	// ErrPasswordChanged if it is no longer oldHash because the password was
+	// changed in the meantime.
+	UpdatePasswordHash(userID, oldHash, newHash string) error
+	// SetPasswordHash replaces the user's password hash whatever it is.
+	SetPasswordHash(userID, newHash string) error
+	// MarkEmailVerified verifies the user's email, failing with
+	// ErrEmailChanged if it is no longer email.
+	MarkEmailVerified(userID, email string) error
+	// UpdateEmail switches the user to newEmail, unverified, failing with
+	// ErrEmailChanged if their email is no longer oldEmail.
+	UpdateEmail(userID, oldEmail, newEmail string) error
+	// GetLoginAttempts returns an empty record for a key without failures.
+	GetLoginAttempts(key string) (*LoginAttempts, error)
+	// RecordLoginFailure adds a failure to the key's count, starting over if
+	// the previous failures have expired.
+	RecordLoginFailure(key string, at time.Time, expiresAt time.Time) (*LoginAttempts, error)
+	LockLogin(key string, until time.Time) error
+	ResetLoginAttempts(key string) error
+	CreateAuditEvent(event *AuditEvent) error
+}
+
+type DynamoUserRepository struct {
 	Client *dynamodb.Client
+
+	usersKeyMu    sync.Mutex
+	usersKeyNames []string
 }
 
-func (r *UserRepository) CreateUser(user UserLogin) error {
+func (r *DynamoUserRepository) CreateUser(user UserLogin) error {
 	input := &dynamodb.PutItemInput{
 		TableName: aws.String("Users"),
-		Item: map[string]types.AttributeValue{
-			"Username":      &types.AttributeValueMemberS{Value: user.Username},
-			"Password":      &types.AttributeValueMemberS{Value: user.Password},
-			"Email":         &types.AttributeValueMemberS{Value: user.Email},
-			"OAuthProvider": &types.AttributeValueMemberS{Value: user.OAuthProvider},
-			"UserID":        &types.AttributeValueMemberS{Value: user.UserID},
-		},
+		Item:      userItem(user),
 	}
 
 	_, err := r.Client.PutItem(context.TODO(), input)
 	return err
 }
 
-func (r *UserRepository) GetUserByUsernameOrEmail(usernameOrEmailInput string) (*UserLogin, error) {
+func (r *DynamoUserRepository) UpdatePasswordHash(userID, oldHash, newHash string) error {
+	key, err := r.userKey(userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String("Users"),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET Password = :new"),
+		ConditionExpression: aws.String("Password = :old"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":new": &types.AttributeValueMemberS{Value: newHash},
+			":old": &types.AttributeValueMemberS{Value: oldHash},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrPasswordChanged
+	}
+	return err
+}
+
+func (r *DynamoUserRepository) SetPasswordHash(userID, newHash string) error {
+	key, err := r.userKey(userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String("Users"),
+		Key:              key,
+		UpdateExpression: aws.String("SET Password = :new"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":new": &types.AttributeValueMemberS{Value: newHash},
+		},
+	})
+	return err
+}
+
+func (r *DynamoUserRepository) MarkEmailVerified(userID, email string) error {
+	return r.updateEmail(userID, email, "SET EmailVerified = :verified", map[string]types.AttributeValue{
+		":verified": &types.AttributeValueMemberBOOL{Value: true},
+	})
+}
+
+func (r *DynamoUserRepository) UpdateEmail(userID, oldEmail, newEmail string) error {
+	return r.updateEmail(userID, oldEmail, "SET Email = :new, EmailVerified = :verified", map[string]types.AttributeValue{
+		":new":      &types.AttributeValueMemberS{Value: newEmail},
+		":verified": &types.AttributeValueMemberBOOL{Value: false},
+	})
+}
+
+// updateEmail applies update to the user as long as their email is still
+// email.
+func (r *DynamoUserRepository) updateEmail(userID, email, update string, values map[string]types.AttributeValue) error {
+	key, err := r.userKey(userID)
+	if err != nil {
+		return err
+	}
+
+	values[":email"] = &types.AttributeValueMemberS{Value: email}
+	_, err = r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:                 aws.String("Users"),
+		Key:                       key,
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("Email = :email"),
+		ExpressionAttributeValues: values,
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrEmailChanged
+	}
+	return err
+}
+
+// userKey returns the primary key of the user's item. Users are only ever
+// found through the table's indexes, so the key's attributes are taken from
+// the table's key schema rather than assumed; index queries return them with
+// every item.
+func (r *DynamoUserRepository) userKey(userID string) (map[string]types.AttributeValue, error) {
+	names, err := r.usersKeySchema()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := r.Client.Query(context.TODO(), &dynamodb.QueryInput{
+		TableName:              aws.String("Users"),
+		IndexName:              aws.String("UserIDIndex"),
+		KeyConditionExpression: aws.String("UserID = :userid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userid": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Items) == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	key := make(map[string]types.AttributeValue, len(names))
+	for _, name := range names {
+		value, ok := result.Items[0][name]
+		if !ok {
+			return nil, fmt.Errorf("user %s has no key attribute %s", userID, name)
+		}
+		key[name] = value
+	}
+	return key, nil
+}
+
+// usersKeySchema returns the names of the Users table's key attributes,
+// describing the table the first time.
+func (r *DynamoUserRepository) usersKeySchema() ([]string, error) {
+	r.usersKeyMu.Lock()
+	defer r.usersKeyMu.Unlock()
+	if r.usersKeyNames != nil {
+		return r.usersKeyNames, nil
+	}
+
+	result, err := r.Client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String("Users"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe Users table: %w", err)
+	}
+
+	names := make([]string, 0, len(result.Table.KeySchema))
+	for _, element := range result.Table.KeySchema {
+		names = append(names, aws.ToString(element.AttributeName))
+	}
+	r.usersKeyNames = names
+	return names, nil
+}
+
+func userItem(user UserLogin) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Username":      &types.AttributeValueMemberS{Value: user.Username},
+		"Password":      &types.AttributeValueMemberS{Value: user.Password},
+		"Email":         &types.AttributeValueMemberS{Value: user.Email},
+		"EmailVerified": &types.AttributeValueMemberBOOL{Value: user.EmailVerified},
+		"OAuthProvider": &types.AttributeValueMemberS{Value: user.OAuthProvider},
+		"UserID":        &types.AttributeValueMemberS{Value: user.UserID},
+	}
+}
+
+func (r *DynamoUserRepository) GetUserByUsernameOrEmail(usernameOrEmailInput string) (*UserLogin, error) {
 	if utils.IsEmail(usernameOrEmailInput) {
 		return r.GetUserByEmail(usernameOrEmailInput)
 	}
 	return r.GetUserByUsername(usernameOrEmailInput)
 }
 
-func (r *UserRepository) GetUserByUsername(username string) (*UserLogin, error) {
+func (r *DynamoUserRepository) GetUserByUsername(username string) (*UserLogin, error) {
 	return r.FetchUserInfo(username, "UsernameIndex", "Username = :username", ":username")
 }
 
-func (r *UserRepository) GetUserByEmail(email string) (*UserLogin, error) {
+func (r *DynamoUserRepository) GetUserByEmail(email string) (*UserLogin, error) {
 	return r.FetchUserInfo(email, "EmailIndex", "Email = :email", ":email")
 }
 
-func (r *UserRepository) FetchUserInfo(usernameOrEmailInput, indexName, keyConditionExpression, keyAttribute string) (*UserLogin, error) {
+func (r *DynamoUserRepository) FetchUserInfo(usernameOrEmailInput, indexName, keyConditionExpression, keyAttribute string) (*UserLogin, error) {
 	queryInput := &dynamodb.QueryInput{
 		TableName:              aws.String("Users"),
 		IndexName:              aws.String(indexName),
@@ -61,7 +291,7 @@ func (r *UserRepository) FetchUserInfo(usernameOrEmailInput, indexName, keyCondi
 	}
 
 	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	var user UserLogin
@@ -73,11 +303,15 @@ func (r *UserRepository) FetchUserInfo(usernameOrEmailInput, indexName, keyCondi
 	return &user, nil
 }
 
-func (r *UserRepository) GetUserDetailsByID(id string) (*User, error) {
+func (r *DynamoUserRepository) GetUserDetailsByID(id string) (*User, error) {
 	return r.FetchUserDetails(id, "UserIDIndex", "UserID = :userid", ":userid")
 }
 
-func (r *UserRepository) FetchUserDetails(id, indexName, keyConditionExpression, keyAttribute string) (*User, error) {
+func (r *DynamoUserRepository) GetUserByID(id string) (*UserLogin, error) {
+	return r.FetchUserInfo(id, "UserIDIndex", "UserID = :userid", ":userid")
+}
+
+func (r *DynamoUserRepository) FetchUserDetails(id, indexName, keyConditionExpression, keyAttribute string) (*User, error) {
 	queryInput := &dynamodb.QueryInput{
 		TableName:              aws.String("Users"),
 		IndexName:              aws.String(indexName),
@@ -92,7 +326,7 @@ func (r *UserRepository) FetchUserDetails(id, indexName, keyConditionExpression,
 	}
 
 	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	var user User
@@ -104,15 +338,17 @@ func (r *UserRepository) FetchUserDetails(id, indexName, keyConditionExpression,
 	return &user, nil
 }
 
-func (r *UserRepository) CreateSession(session *utils.Session) error {
+func (r *DynamoUserRepository) CreateSession(session *utils.Session) error {
 	input := &dynamodb.PutItemInput{
 		TableName: aws.String("Sessions"),
 		Item: map[string]types.AttributeValue{
-			"SessionID": &types.AttributeValueMemberS{Value: session.SessionID},
-			"UserID":    &types.AttributeValueMemberS{Value: session.UserID},
-			"Device":    &types.AttributeValueMemberS{Value: session.Device},
-			"CreatedAt": &types.AttributeValueMemberS{Value: session.CreatedAt},
-			"ExpiresAt": &types.AttributeValueMemberS{Value: session.ExpiresAt},
+			"SessionID":    &types.AttributeValueMemberS{Value: session.SessionID},
+			"UserID":       &types.AttributeValueMemberS{Value: session.UserID},
+			"Device":       &types.AttributeValueMemberS{Value: session.Device},
+			"CreatedAt":    &types.AttributeValueMemberS{Value: session.CreatedAt},
+			"ExpiresAt":    &types.AttributeValueMemberS{Value: session.ExpiresAt},
+			"RememberMe":   &types.AttributeValueMemberBOOL{Value: session.RememberMe},
+			"ExpiresAtTTL": &types.AttributeValueMemberN{Value: strconv.FormatInt(session.ExpiresAtTTL, 10)},
 		},
 	}
 
@@ -120,7 +356,7 @@ func (r *UserRepository) CreateSession(session *utils.Session) error {
 	return err
 }
 
-func (r *UserRepository) FetchSession(sessionID string) (*utils.Session, error) {
+func (r *DynamoUserRepository) FetchSession(sessionID string) (*utils.Session, error) {
 	queryInput := &dynamodb.QueryInput{
 		TableName:              aws.String("Sessions"),
 		IndexName:              aws.String("SessionIDIndex"),
@@ -135,7 +371,7 @@ func (r *UserRepository) FetchSession(sessionID string) (*utils.Session, error)
 	}
 
 	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("session not found")
+		return nil, ErrSessionNotFound
 	}
 
 	var session utils.Session
@@ -146,3 +382,706 @@ func (r *UserRepository) FetchSession(sessionID string) (*utils.Session, error)
 
 	return &session, nil
 }
+
+func (r *DynamoUserRepository) GetSessionsByUserID(userID string) ([]*utils.Session, error) {
+	items, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("Sessions"),
+		IndexName:              aws.String("UserIDIndex"),
+		KeyConditionExpression: aws.String("UserID = :userID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*utils.Session, 0, len(items))
+	for _, item := range items {
+		var session utils.Session
+		if err := attributevalue.UnmarshalMap(item, &session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, nil
+}
+
+func (r *DynamoUserRepository) RevokeToken(token *utils.RevokedToken) error {
+	item := map[string]types.AttributeValue{
+		"TokenID":      &types.AttributeValueMemberS{Value: token.TokenID},
+		"UserID":       &types.AttributeValueMemberS{Value: token.UserID},
+		"ExpiresAt":    &types.AttributeValueMemberS{Value: token.ExpiresAt},
+		"ExpiresAtTTL": &types.AttributeValueMemberN{Value: strconv.FormatInt(token.ExpiresAtTTL, 10)},
+	}
+	if token.IssuedBefore != 0 {
+		item["IssuedBefore"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(token.IssuedBefore, 10)}
+	}
+
+	_, err := r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String("RevokedTokens"),
+		Item:      item,
+	})
+	return err
+}
+
+func (r *DynamoUserRepository) CreateRefreshToken(token *RefreshToken) error {
+	item, err := attributevalue.MarshalMap(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal refresh token: %w", err)
+	}
+
+	_, err = r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String("RefreshTokens"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(TokenHash)"),
+	})
+	return err
+}
+
+func (r *DynamoUserRepository) GetRefreshToken(tokenHash string) (*RefreshToken, error) {
+	result, err := r.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String("RefreshTokens"),
+		Key: map[string]types.AttributeValue{
+			"TokenHash": &types.AttributeValueMemberS{Value: tokenHash},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	var token RefreshToken
+	if err := attributevalue.UnmarshalMap(result.Item, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (r *DynamoUserRepository) GetRefreshTokensByFamily(familyID string) ([]*RefreshToken, error) {
+	return r.queryRefreshTokens("FamilyIDIndex", "FamilyID", familyID)
+}
+
+func (r *DynamoUserRepository) GetRefreshTokensByUserID(userID string) ([]*RefreshToken, error) {
+	return r.queryRefreshTokens("UserIDIndex", "UserID", userID)
+}
+
+func (r *DynamoUserRepository) queryRefreshTokens(indexName, attribute, value string) ([]*RefreshToken, error) {
+	items, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("RefreshTokens"),
+		IndexName:              aws.String(indexName),
+		KeyConditionExpression: aws.String(attribute + " = :value"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":value": &types.AttributeValueMemberS{Value: value},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]*RefreshToken, 0, len(items))
+	for _, item := range items {
+		var token RefreshToken
+		if err := attributevalue.UnmarshalMap(item, &token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+	return tokens, nil
+}
+
+// MarkRefreshTokenUsed records that the token was exchanged. Only one caller
+// can do so; everyone after gets ErrRefreshTokenReused.
+func (r *DynamoUserRepository) MarkRefreshTokenUsed(tokenHash, usedAt string) error {
+	_, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String("RefreshTokens"),
+		Key: map[string]types.AttributeValue{
+			"TokenHash": &types.AttributeValueMemberS{Value: tokenHash},
+		},
+		UpdateExpression:    aws.String("SET UsedAt = :usedAt"),
+		ConditionExpression: aws.String("attribute_exists(TokenHash) AND attribute_not_exists(UsedAt)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":usedAt": &types.AttributeValueMemberS{Value: usedAt},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrRefreshTokenReused
+	}
+	return err
+}
+
+func (r *DynamoUserRepository) RevokeRefreshToken(tokenHash string) error {
+	_, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String("RefreshTokens"),
+		Key: map[string]types.AttributeValue{
+			"TokenHash": &types.AttributeValueMemberS{Value: tokenHash},
+		},
+		UpdateExpression:    aws.String("SET Revoked = :revoked"),
+		ConditionExpression: aws.String("attribute_exists(TokenHash)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":revoked": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nil
+	}
+	return err
+}
+
+// CreateIdentity links the identity, failing with ErrIdentityInUse if it is
+// already linked to any user. Identities are keyed by Provider and Subject.
+func (r *DynamoUserRepository) CreateIdentity(identity *LinkedIdentity) error {
+	item, err := attributevalue.MarshalMap(identity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal identity: %w", err)
+	}
+
+	_, err = r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String("Identities"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(Provider)"),
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrIdentityInUse
+	}
+	return err
+}
+
+func (r *DynamoUserRepository) GetIdentity(provider, subject string) (*LinkedIdentity, error) {
+	result, err := r.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String("Identities"),
+		Key:       identityKey(provider, subject),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, ErrIdentityNotFound
+	}
+
+	var identity LinkedIdentity
+	if err := attributevalue.UnmarshalMap(result.Item, &identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (r *DynamoUserRepository) GetIdentitiesByUserID(userID string) ([]*LinkedIdentity, error) {
+	items, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("Identities"),
+		IndexName:              aws.String("UserIDIndex"),
+		KeyConditionExpression: aws.String("UserID = :userID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	identities := make([]*LinkedIdentity, 0, len(items))
+	for _, item := range items {
+		var identity LinkedIdentity
+		if err := attributevalue.UnmarshalMap(item, &identity); err != nil {
+			return nil, err
+		}
+		identities = append(identities, &identity)
+	}
+	return identities, nil
+}
+
+func (r *DynamoUserRepository) DeleteIdentity(provider, subject string) error {
+	_, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String("Identities"),
+		Key:       identityKey(provider, subject),
+	})
+	return err
+}
+
+func (r *DynamoUserRepository) CreatePasswordResetToken(token *PasswordResetToken) error {
+	item, err := attributevalue.MarshalMap(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal password reset token: %w", err)
+	}
+
+	_, err = r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String("PasswordResetTokens"),
+		Item:      item,
+	})
+	return err
+}
+
+func (r *DynamoUserRepository) ConsumePasswordResetToken(tokenHash string) (*PasswordResetToken, error) {
+	result, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String("PasswordResetTokens"),
+		Key: map[string]types.AttributeValue{
+			"TokenHash": &types.AttributeValueMemberS{Value: tokenHash},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Attributes) == 0 {
+		return nil, ErrInvalidResetToken
+	}
+
+	var token PasswordResetToken
+	if err := attributevalue.UnmarshalMap(result.Attributes, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// CreateTOTPFactor keys factors by UserID.
+func (r *DynamoUserRepository) CreateTOTPFactor(factor *TOTPFactor) error {
+	item, err := attributevalue.MarshalMap(factor)
+	if err != nil {
+		return fmt.Errorf("failed to marshal TOTP factor: %w", err)
+	}
+
+	_, err = r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String("TOTPFactors"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(UserID) OR Confirmed = :false"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":false": &types.AttributeValueMemberBOOL{Value: false},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrMFAAlreadyEnabled
+	}
+	return err
+}
+
+func (r *DynamoUserRepository) GetTOTPFactor(userID string) (*TOTPFactor, error) {
+	result, err := r.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String("TOTPFactors"),
+		Key:       totpFactorKey(userID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, ErrMFANotEnrolled
+	}
+
+	var factor TOTPFactor
+	if err := attributevalue.UnmarshalMap(result.Item, &factor); err != nil {
+		return nil, err
+	}
+	return &factor, nil
+}
+
+func (r *DynamoUserRepository) ConfirmTOTPFactor(userID string, step int64, recoveryCodes []string) error {
+	_, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String("TOTPFactors"),
+		Key:                 totpFactorKey(userID),
+		UpdateExpression:    aws.String("SET Confirmed = :true, LastUsedStep = :step, RecoveryCodes = :codes"),
+		ConditionExpression: aws.String("Confirmed = :false"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true":  &types.AttributeValueMemberBOOL{Value: true},
+			":false": &types.AttributeValueMemberBOOL{Value: false},
+			":step":  &types.AttributeValueMemberN{Value: strconv.FormatInt(step, 10)},
+			":codes": &types.AttributeValueMemberSS{Value: recoveryCodes},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrMFAAlreadyEnabled
+	}
+	return err
+}
+
+func (r *DynamoUserRepository) UseTOTPStep(userID string, step int64) error {
+	_, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String("TOTPFactors"),
+		Key:                 totpFactorKey(userID),
+		UpdateExpression:    aws.String("SET LastUsedStep = :step"),
+		ConditionExpression: aws.String("attribute_exists(UserID) AND LastUsedStep < :step"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":step": &types.AttributeValueMemberN{Value: strconv.FormatInt(step, 10)},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrInvalidMFACode
+	}
+	return err
+}
+
+func (r *DynamoUserRepository) UseRecoveryCode(userID, codeHash string) error {
+	_, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String("TOTPFactors"),
+		Key:                 totpFactorKey(userID),
+		UpdateExpression:    aws.String("DELETE RecoveryCodes :codes"),
+		ConditionExpression: aws.String("contains(RecoveryCodes, :code)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":codes": &types.AttributeValueMemberSS{Value: []string{codeHash}},
+			":code":  &types.AttributeValueMemberS{Value: codeHash},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrInvalidMFACode
+	}
+	return err
+}
+
+func (r *DynamoUserRepository) ReplaceRecoveryCodes(userID string, recoveryCodes []string) error {
+	_, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String("TOTPFactors"),
+		Key:                 totpFactorKey(userID),
+		UpdateExpression:    aws.String("SET RecoveryCodes = :codes"),
+		ConditionExpression: aws.String("Confirmed = :true"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true":  &types.AttributeValueMemberBOOL{Value: true},
+			":codes": &types.AttributeValueMemberSS{Value: recoveryCodes},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrMFANotEnrolled
+	}
+	return err
+}
+
+func (r *DynamoUserRepository) DeleteTOTPFactor(userID string) error {
+	_, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String("TOTPFactors"),
+		Key:       totpFactorKey(userID),
+	})
+	return err
+}
+
+// CreateMFAChallenge keys challenges by TokenHash.
+func (r *DynamoUserRepository) CreateMFAChallenge(challenge *MFAChallenge) error {
+	item, err := attributevalue.MarshalMap(challenge)
+	if err != nil {
+		return fmt.Errorf("failed to marshal MFA challenge: %w", err)
+	}
+
+	_, err = r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String("MFAChallenges"),
+		Item:      item,
+	})
+	return err
+}
+
+func (r *DynamoUserRepository) GetMFAChallenge(tokenHash string) (*MFAChallenge, error) {
+	result, err := r.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String("MFAChallenges"),
+		Key:       mfaChallengeKey(tokenHash),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	var challenge MFAChallenge
+	if err := attributevalue.UnmarshalMap(result.Item, &challenge); err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+func (r *DynamoUserRepository) RecordMFAChallengeFailure(tokenHash string) (int, error) {
+	result, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String("MFAChallenges"),
+		Key:                 mfaChallengeKey(tokenHash),
+		UpdateExpression:    aws.String("ADD Attempts :one"),
+		ConditionExpression: aws.String("attribute_exists(TokenHash)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return 0, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var updated struct{ Attempts int }
+	if err := attributevalue.UnmarshalMap(result.Attributes, &updated); err != nil {
+		return 0, err
+	}
+	return updated.Attempts, nil
+}
+
+func (r *DynamoUserRepository) ConsumeMFAChallenge(tokenHash string) (*MFAChallenge, error) {
+	result, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName:    aws.String("MFAChallenges"),
+		Key:          mfaChallengeKey(tokenHash),
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Attributes) == 0 {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	var challenge MFAChallenge
+	if err := attributevalue.UnmarshalMap(result.Attributes, &challenge); err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// CreateWebAuthnCredential keys credentials by CredentialID; they are found by
+// user through the UserIDIndex.
+func (r *DynamoUserRepository) CreateWebAuthnCredential(credential *WebAuthnCredential) error {
+	item, err := attributevalue.MarshalMap(credential)
+	if err != nil {
+		return fmt.Errorf("failed to marshal WebAuthn credential: %w", err)
+	}
+
+	_, err = r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String("WebAuthnCredentials"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(CredentialID)"),
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrCredentialInUse
+	}
+	return err
+}
+
+func (r *DynamoUserRepository) GetWebAuthnCredential(credentialID string) (*WebAuthnCredential, error) {
+	result, err := r.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String("WebAuthnCredentials"),
+		Key:       webAuthnCredentialKey(credentialID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, ErrCredentialNotFound
+	}
+
+	var credential WebAuthnCredential
+	if err := attributevalue.UnmarshalMap(result.Item, &credential); err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+func (r *DynamoUserRepository) GetWebAuthnCredentialsByUserID(userID string) ([]*WebAuthnCredential, error) {
+	items, err := db.QueryAll(r.Client, &dynamodb.QueryInput{
+		TableName:              aws.String("WebAuthnCredentials"),
+		IndexName:              aws.String("UserIDIndex"),
+		KeyConditionExpression: aws.String("UserID = :userID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := make([]*WebAuthnCredential, 0, len(items))
+	for _, item := range items {
+		var credential WebAuthnCredential
+		if err := attributevalue.UnmarshalMap(item, &credential); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, &credential)
+	}
+	return credentials, nil
+}
+
+func (r *DynamoUserRepository) UpdateWebAuthnSignCount(credentialID string, oldCount, newCount uint32, usedAt string) error {
+	_, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String("WebAuthnCredentials"),
+		Key:                 webAuthnCredentialKey(credentialID),
+		UpdateExpression:    aws.String("SET SignCount = :new, LastUsedAt = :usedAt"),
+		ConditionExpression: aws.String("SignCount = :old"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":old":    &types.AttributeValueMemberN{Value: strconv.FormatUint(uint64(oldCount), 10)},
+			":new":    &types.AttributeValueMemberN{Value: strconv.FormatUint(uint64(newCount), 10)},
+			":usedAt": &types.AttributeValueMemberS{Value: usedAt},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrSignCountMismatch
+	}
+	return err
+}
+
+func (r *DynamoUserRepository) DeleteWebAuthnCredential(credentialID string) error {
+	_, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String("WebAuthnCredentials"),
+		Key:       webAuthnCredentialKey(credentialID),
+	})
+	return err
+}
+
+func (r *DynamoUserRepository) GetLoginAttempts(key string) (*LoginAttempts, error) {
+	result, err := r.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String("LoginAttempts"),
+		Key:       loginAttemptsKey(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return &LoginAttempts{Key: key}, nil
+	}
+
+	var attempts LoginAttempts
+	if err := attributevalue.UnmarshalMap(result.Item, &attempts); err != nil {
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+// RecordLoginFailure keys attempts by Key, cleaned up through TTL on
+// ExpiresAtTTL. The count only goes up while the stored failures haven't
+// expired; otherwise the row is replaced with a single failure.
+func (r *DynamoUserRepository) RecordLoginFailure(key string, at time.Time, expiresAt time.Time) (*LoginAttempts, error) {
+	result, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String("LoginAttempts"),
+		Key:                 loginAttemptsKey(key),
+		UpdateExpression:    aws.String("SET Failures = Failures + :one, LastFailureAt = :at, ExpiresAtTTL = :ttl"),
+		ConditionExpression: aws.String("ExpiresAtTTL > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":at":  &types.AttributeValueMemberS{Value: at.UTC().Format(time.RFC3339)},
+			":ttl": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(at.Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		attempts := &LoginAttempts{
+			Key:           key,
+			Failures:      1,
+			LastFailureAt: at.UTC().Format(time.RFC3339),
+			ExpiresAtTTL:  expiresAt.Unix(),
+		}
+		item, err := attributevalue.MarshalMap(attempts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal login attempts: %w", err)
+		}
+		_, err = r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName: aws.String("LoginAttempts"),
+			Item:      item,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return attempts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var attempts LoginAttempts
+	if err := attributevalue.UnmarshalMap(result.Attributes, &attempts); err != nil {
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+func (r *DynamoUserRepository) LockLogin(key string, until time.Time) error {
+	_, err := r.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String("LoginAttempts"),
+		Key:              loginAttemptsKey(key),
+		UpdateExpression: aws.String("SET LockedUntil = :until"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":until": &types.AttributeValueMemberS{Value: until.UTC().Format(time.RFC3339)},
+		},
+	})
+	return err
+}
+
+func (r *DynamoUserRepository) ResetLoginAttempts(key string) error {
+	_, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String("LoginAttempts"),
+		Key:       loginAttemptsKey(key),
+	})
+	return err
+}
+
+// CreateAuditEvent keys events by EventID. They are kept until removed by
+// hand.
+func (r *DynamoUserRepository) CreateAuditEvent(event *AuditEvent) error {
+	item, err := attributevalue.MarshalMap(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	_, err = r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String("AuditEvents"),
+		Item:      item,
+	})
+	return err
+}
+
+func loginAttemptsKey(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Key": &types.AttributeValueMemberS{Value: key},
+	}
+}
+
+func webAuthnCredentialKey(credentialID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"CredentialID": &types.AttributeValueMemberS{Value: credentialID},
+	}
+}
+
+func totpFactorKey(userID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"UserID": &types.AttributeValueMemberS{Value: userID},
+	}
+}
+
+func mfaChallengeKey(tokenHash string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"TokenHash": &types.AttributeValueMemberS{Value: tokenHash},
+	}
+}
+
+func identityKey(provider, subject string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Provider": &types.AttributeValueMemberS{Value: provider},
+		"Subject":  &types.AttributeValueMemberS{Value: subject},
+	}
+}
+
+func (r *DynamoUserRepository) DeleteSession(sessionID string) error {
+	_, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String("Sessions"),
+		Key: map[string]types.AttributeValue{
+			"SessionID": &types.AttributeValueMemberS{Value: sessionID},
+		},
+	})
+	return err
+}
@@ -1,78 +1,419 @@
 package user
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/google/uuid"
+	"github.com/tabichanorg/tabichan-server/internal/mailer"
 	"github.com/tabichanorg/tabichan-server/internal/utils"
 )
 
 type UserService struct {
-	Repo *UserRepository
+	Repo   UserRepository
+	Tokens *utils.JWTKeySet
+	Mailer mailer.Mailer
+	// Verifier signs the links that verify a user's email.
+	Verifier *EmailVerifier
+	// AppURL is the address of the web app, which emailed links point to.
+	AppURL string
+	// Hasher hashes new passwords. Hashes it didn't make are still checked
+	// and replaced on the user's next login.
+	Hasher utils.PasswordHasher
+	Policy *PasswordPolicy
+
+	dummyHashOnce sync.Once
+	dummyHash     string
 }
 
+var (
+	ErrUserNotFound        = errors.New("user not found")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token already used")
+	ErrEmailNotVerified    = errors.New("provider account has no verified email")
+	ErrIdentityNotFound    = errors.New("identity not found")
+	ErrIdentityInUse       = errors.New("identity is already linked to an account")
+	ErrLastLoginMethod     = errors.New("can't unlink the last way to log in")
+	ErrPasswordRequired    = errors.New("password is required")
+	ErrInvalidResetToken   = errors.New("password reset link is invalid or has expired")
+	ErrUnverifiedAccount   = errors.New("an account with this email exists but hasn't verified it yet")
+	ErrInvalidEmail        = errors.New("email is not valid")
+	ErrEmailInUse          = errors.New("email is already in use")
+	ErrEmailChanged        = errors.New("email was changed by another request")
+	ErrPasswordChanged     = errors.New("password was changed by another request")
+	ErrInvalidCredentials  = errors.New("invalid credentials")
+
+	ErrInvalidVerificationToken = errors.New("email verification link is invalid or has expired")
+
+	ErrMFAAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnrolled      = errors.New("two-factor authentication is not set up")
+	ErrInvalidMFACode      = errors.New("invalid authentication code")
+	ErrInvalidMFAChallenge = errors.New("login attempt is invalid or has expired")
+
+	ErrCredentialNotFound = errors.New("passkey not found")
+	ErrCredentialInUse    = errors.New("passkey is already registered")
+	ErrSignCountMismatch  = errors.New("passkey sign count didn't increase, it may have been cloned")
+)
+
+const (
+	refreshTokenLifetime       = 30 * 24 * time.Hour
+	passwordResetTokenLifetime = time.Hour
+	emailVerificationLifetime  = 48 * time.Hour
+)
+
 func (s *UserService) Signup(newUser UserLogin, device string) (*LoginRequestResponse, error) {
 	if !utils.IsEmail(newUser.Email) {
-		return &LoginRequestResponse{}, fmt.Errorf(`email "%s" is not valid`, newUser.Email)
+		return nil, fmt.Errorf(`email "%s" is not valid`, newUser.Email)
+	}
+
+	if err := s.Policy.Check(newUser.Password); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkUsernameOrEmailInUse(newUser.Email, newUser.Username); err != nil {
-		return &LoginRequestResponse{}, err
+		return nil, err
 	}
 
-	hashedPassword, err := utils.HashPassword(newUser.Password)
+	hashedPassword, err := s.Hasher.Hash(newUser.Password)
 	if err != nil {
-		return &LoginRequestResponse{}, fmt.Errorf("error hashing password: %v", err)
+		return nil, fmt.Errorf("error hashing password: %v", err)
 	}
 
 	newUser.Password = hashedPassword
 	newUser.UserID = utils.GenerateID()
 
-	expiresAt := time.Now().Add(24 * time.Hour)
+	if err := s.Repo.CreateUser(newUser); err != nil {
+		return nil, err
+	}
+
+	// The account works without a verified email, so a failed send only
+	// means the user has to ask for another link.
+	if err := s.sendVerificationEmail(&newUser); err != nil {
+		log.Printf("Failed to send verification email: %v", err)
+	}
+
+	return s.startLogin(newUser.UserID, device, false)
+}
+
+// Login checks a password login from clientIP. Unknown users, wrong
+// passwords and accounts without a password all fail with
+// ErrInvalidCredentials, and repeated failures for the account or the IP get
+// a LoginThrottledError until they have waited long enough. Users with
+// two-factor authentication get an MFA challenge instead of a session, to be
+// completed with CompleteMFALogin.
+func (s *UserService) Login(usernameOrEmail, password, device, clientIP string, rememberMeSelected bool) (*LoginRequestResponse, *MFAChallengeResponse, error) {
+	user, err := s.Repo.GetUserByUsernameOrEmail(usernameOrEmail)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return nil, nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+	userID, passwordHash := "", s.dummyPasswordHash()
+	if err == nil {
+		userID, passwordHash = user.UserID, user.Password
+	}
+
+	accountKey, ipKey := loginAttemptKeys(userID, usernameOrEmail, clientIP)
+	if err := s.checkLoginThrottle(accountKey, ipKey); err != nil {
+		return nil, nil, err
+	}
+
+	// The dummy hash never matches, and accounts without a password have an
+	// empty hash that doesn't either.
+	ok, rehash := s.Hasher.Verify(password, passwordHash)
+	if !ok || userID == "" {
+		if err := s.recordLoginFailure(userID, accountKey, ipKey, clientIP); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrInvalidCredentials
+	}
+	if rehash {
+		s.rehashPassword(user, password)
+	}
+
+	response, challenge, err := s.startLoginOrMFA(user.UserID, device, rememberMeSelected)
+	if response != nil {
+		s.resetLoginFailures(user.UserID)
+	}
+	return response, challenge, err
+}
+
+// startLoginOrMFA starts a session for a user who has proven who they are,
+// or an MFA challenge instead when they have two-factor authentication
+// enabled.
+func (s *UserService) startLoginOrMFA(userID, device string, rememberMe bool) (*LoginRequestResponse, *MFAChallengeResponse, error) {
+	enabled, err := s.mfaEnabled(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if enabled {
+		challenge, err := s.startMFAChallenge(userID, device, rememberMe)
+		return nil, challenge, err
+	}
+
+	response, err := s.startLogin(userID, device, rememberMe)
+	return response, nil, err
+}
+
+// rehashPassword replaces the user's password hash with one from the
+// configured hasher. Logging in works either way, so failures are only
+// logged.
+func (s *UserService) rehashPassword(user *UserLogin, password string) {
+	hashedPassword, err := s.Hasher.Hash(password)
+	if err != nil {
+		log.Printf("Failed to rehash password: %v", err)
+		return
+	}
+	// A changed password is hashed with the configured hasher anyway.
+	err = s.Repo.UpdatePasswordHash(user.UserID, user.Password, hashedPassword)
+	if err != nil && !errors.Is(err, ErrPasswordChanged) {
+		log.Printf("Failed to store rehashed password: %v", err)
+	}
+}
+
+// ChangePassword replaces a logged in user's password once they have given
+// the current one. Wrong current passwords count against the account and
+// clientIP like failed logins, so a session can't be used to guess it.
+func (s *UserService) ChangePassword(userID, currentPassword, newPassword, clientIP string) error {
+	if newPassword == "" {
+		return ErrPasswordRequired
+	}
+	if err := s.Policy.Check(newPassword); err != nil {
+		return err
+	}
 
-	session, err := s.createNewSession(expiresAt, newUser.UserID, device)
+	user, err := s.Repo.GetUserByID(userID)
 	if err != nil {
-		return &LoginRequestResponse{}, err
+		return fmt.Errorf("failed to fetch user: %v", err)
 	}
 
-	token, err := utils.GenerateJWT(newUser.Username)
+	accountKey, ipKey := loginAttemptKeys(userID, "", clientIP)
+	if err := s.checkLoginThrottle(accountKey, ipKey); err != nil {
+		return err
+	}
+	// Accounts without a password have an empty hash that never matches.
+	if ok, _ := s.Hasher.Verify(currentPassword, user.Password); !ok {
+		if err := s.recordLoginFailure(userID, accountKey, ipKey, clientIP); err != nil {
+			return err
+		}
+		return ErrInvalidCredentials
+	}
+
+	hashedPassword, err := s.Hasher.Hash(newPassword)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %v", err)
+	}
+	err = s.Repo.UpdatePasswordHash(userID, user.Password, hashedPassword)
+	if errors.Is(err, ErrPasswordChanged) {
+		return err
+	}
 	if err != nil {
-		return &LoginRequestResponse{}, fmt.Errorf("failed to generate token: %v", err)
+		return fmt.Errorf("failed to update password: %v", err)
+	}
+	return nil
+}
+
+// LoginWithProvider logs in the user the identity is linked to. An identity
+// seen for the first time is linked by its verified email to the account
+// with that email, or to a new account without a password. Like Login, it
+// returns an MFA challenge instead of a session for users with two-factor
+// authentication, and a LoginThrottledError while the account is locked out.
+func (s *UserService) LoginWithProvider(identity ExternalIdentity, device string) (*LoginRequestResponse, *MFAChallengeResponse, error) {
+	linked, err := s.Repo.GetIdentity(identity.Provider, identity.Subject)
+	if err == nil {
+		if err := s.checkAccountLock(linked.UserID); err != nil {
+			return nil, nil, err
+		}
+		return s.startLoginOrMFA(linked.UserID, device, false)
+	}
+	if !errors.Is(err, ErrIdentityNotFound) {
+		return nil, nil, fmt.Errorf("failed to fetch identity: %v", err)
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, nil, ErrEmailNotVerified
 	}
 
-	return &LoginRequestResponse{Token: token, Session: session}, s.Repo.CreateUser(newUser)
+	user, err := s.Repo.GetUserByEmail(identity.Email)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return nil, nil, fmt.Errorf("error checking email: %v", err)
+	}
+
+	// Whoever signed up with the email never proved they own it, so handing
+	// the account to the provider's user could let them in with a password
+	// someone else chose.
+	if user != nil && !user.EmailVerified {
+		return nil, nil, ErrUnverifiedAccount
+	}
+	if user != nil {
+		if err := s.checkAccountLock(user.UserID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if user == nil {
+		username, err := s.availableUsername(identity.Email)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		user = &UserLogin{
+			Username:      username,
+			Email:         identity.Email,
+			EmailVerified: true,
+			OAuthProvider: identity.Provider,
+			UserID:        utils.GenerateID(),
+		}
+		if err := s.Repo.CreateUser(*user); err != nil {
+			return nil, nil, fmt.Errorf("failed to create user: %v", err)
+		}
+	}
+
+	if _, err := s.LinkIdentity(user.UserID, identity); err != nil && !errors.Is(err, ErrIdentityInUse) {
+		return nil, nil, err
+	}
+
+	return s.startLoginOrMFA(user.UserID, device, false)
 }
 
-func (s *UserService) Login(usernameOrEmail, password, device string, rememberMeSelected bool) (*LoginRequestResponse, error) {
-	user, err := s.Repo.GetUserByUsernameOrEmail(usernameOrEmail)
+// LinkIdentity attaches the identity to the user so it can log in as them.
+func (s *UserService) LinkIdentity(userID string, identity ExternalIdentity) (*LinkedIdentity, error) {
+	linked := &LinkedIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		UserID:   userID,
+		Email:    identity.Email,
+		LinkedAt: time.Now().Format(time.RFC3339),
+	}
+
+	err := s.Repo.CreateIdentity(linked)
+	if errors.Is(err, ErrIdentityInUse) {
+		existing, getErr := s.Repo.GetIdentity(identity.Provider, identity.Subject)
+		if getErr == nil && existing.UserID == userID {
+			return existing, nil
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to link identity: %v", err)
+	}
+	return linked, nil
+}
+
+func (s *UserService) GetIdentities(userID string) ([]*LinkedIdentity, error) {
+	identities, err := s.Repo.GetIdentitiesByUserID(userID)
 	if err != nil {
-		return &LoginRequestResponse{}, err
+		return nil, fmt.Errorf("failed to fetch identities: %v", err)
+	}
+	return identities, nil
+}
+
+// UnlinkIdentity detaches one of the user's identities, as long as the user
+// still has a password, passkey or another identity to log in with
+// afterwards.
+func (s *UserService) UnlinkIdentity(userID, provider, subject string) error {
+	identity, err := s.Repo.GetIdentity(provider, subject)
+	if errors.Is(err, ErrIdentityNotFound) || (err == nil && identity.UserID != userID) {
+		return ErrIdentityNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch identity: %v", err)
+	}
+
+	if err := s.checkOtherLoginMethod(userID); err != nil {
+		return err
+	}
+
+	if err := s.Repo.DeleteIdentity(provider, subject); err != nil {
+		return fmt.Errorf("failed to unlink identity: %v", err)
+	}
+	return nil
+}
+
+// checkOtherLoginMethod fails with ErrLastLoginMethod unless the user has a
+// way to log in besides the one identity or passkey about to be removed.
+func (s *UserService) checkOtherLoginMethod(userID string) error {
+	user, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch user: %v", err)
+	}
+	if user.Password != "" {
+		return nil
+	}
+
+	identities, err := s.Repo.GetIdentitiesByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch identities: %v", err)
+	}
+	credentials, err := s.Repo.GetWebAuthnCredentialsByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch passkeys: %v", err)
 	}
 
-	if !utils.CheckPasswordHash(password, user.Password) {
-		return &LoginRequestResponse{}, fmt.Errorf("invalid username or password")
+	if len(identities)+len(credentials) <= 1 {
+		return ErrLastLoginMethod
 	}
+	return nil
+}
 
-	var expiresAt time.Time
-	if rememberMeSelected {
-		expiresAt = time.Now().Add(30 * 24 * time.Hour)
-	} else {
-		expiresAt = time.Now().Add(24 * time.Hour)
+// startLogin creates the session and tokens a successful login returns.
+func (s *UserService) startLogin(userID, device string, rememberMe bool) (*LoginRequestResponse, error) {
+	session, err := s.createNewSession(rememberMe, userID, device)
+	if err != nil {
+		return nil, err
 	}
 
-	session, err := s.createNewSession(expiresAt, user.UserID, device)
+	token, err := s.Tokens.Generate(userID)
 	if err != nil {
-		return &LoginRequestResponse{}, err
+		return nil, fmt.Errorf("failed to generate token: %v", err)
 	}
 
-	// TODO: incorporate before MVP completion
-	token, err := utils.GenerateJWT(user.Username)
+	refreshToken, err := s.issueRefreshToken(userID, "")
 	if err != nil {
-		return &LoginRequestResponse{}, fmt.Errorf("failed to generate token: %v", err)
+		return nil, err
+	}
+
+	return &LoginRequestResponse{Token: token, RefreshToken: refreshToken, Session: session}, nil
+}
+
+// availableUsername derives a username from the email's local part, adding
+// digits when it is already taken.
+func (s *UserService) availableUsername(email string) (string, error) {
+	local, _, _ := strings.Cut(email, "@")
+	base := strings.Map(func(char rune) rune {
+		if unicode.IsLetter(char) || unicode.IsNumber(char) {
+			return char
+		}
+		return -1
+	}, local)
+	if base == "" {
+		base = "user"
 	}
 
-	return &LoginRequestResponse{Token: token, Session: session}, nil
+	username := base
+	for attempt := 0; attempt < 10; attempt++ {
+		if attempt > 0 {
+			username = fmt.Sprintf("%s%d", base, mathrand.Intn(10000))
+		}
+		_, err := s.Repo.GetUserByUsername(username)
+		if err != nil && errors.Is(err, ErrUserNotFound) {
+			return username, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("error checking username: %v", err)
+		}
+	}
+	return "", fmt.Errorf("no free username found for %s", email)
 }
 
 func (s *UserService) GetUser(userId string) (*User, error) {
@@ -84,14 +425,524 @@ func (s *UserService) GetUser(userId string) (*User, error) {
 	return user, nil
 }
 
-func (s *UserService) createNewSession(expiresAt time.Time, userID string, device string) (*utils.Session, error) {
+// Logout ends the session along with the other ID it may still be reachable
+// by during a rotation grace period.
+func (s *UserService) Logout(sessionID string) error {
+	session, err := s.Repo.FetchSession(sessionID)
+	if err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to fetch session: %v", err)
+	}
+
+	sessions, err := s.Repo.GetSessionsByUserID(session.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch sessions: %v", err)
+	}
+
+	for _, id := range rotationChain(sessions, sessionID) {
+		if err := s.Repo.DeleteSession(id); err != nil {
+			return fmt.Errorf("failed to delete session: %v", err)
+		}
+	}
+	return nil
+}
+
+// rotationChain returns sessionID together with the IDs it was rotated from
+// and to, which all still log in while their grace periods last.
+func rotationChain(sessions []*utils.Session, sessionID string) []string {
+	replacedBy := map[string]string{}
+	for _, session := range sessions {
+		replacedBy[session.SessionID] = session.ReplacedBy
+	}
+
+	chain := map[string]bool{sessionID: true}
+	for grown := true; grown; {
+		grown = false
+		for id, next := range replacedBy {
+			if chain[id] == chain[next] || next == "" {
+				continue
+			}
+			chain[id], chain[next] = true, true
+			grown = true
+		}
+	}
+
+	ids := make([]string, 0, len(chain))
+	for id := range chain {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// RevokeToken stops a JWT from authenticating any further requests. Tokens
+// that don't verify can't be used anyway and are reported as invalid.
+func (s *UserService) RevokeToken(tokenString string) error {
+	claims, err := s.Tokens.Parse(tokenString)
+	if err != nil {
+		return err
+	}
+
+	token := &utils.RevokedToken{
+		TokenID:      claims.ID,
+		UserID:       claims.Subject,
+		ExpiresAt:    claims.ExpiresAt.Format(time.RFC3339),
+		ExpiresAtTTL: claims.ExpiresAt.Unix(),
+	}
+	if err := s.Repo.RevokeToken(token); err != nil {
+		return fmt.Errorf("failed to revoke token: %v", err)
+	}
+	return nil
+}
+
+// GetSessions lists the user's unexpired sessions, flagging the one the
+// request was made with.
+func (s *UserService) GetSessions(userID, currentSessionID string) ([]*SessionInfo, error) {
+	sessions, err := s.activeSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, &SessionInfo{
+			ID:        sessionHandle(session.SessionID),
+			Device:    session.Device,
+			CreatedAt: session.CreatedAt,
+			ExpiresAt: session.ExpiresAt,
+			Current:   session.SessionID == currentSessionID,
+		})
+	}
+	return infos, nil
+}
+
+// RevokeSession ends the user's session with the given handle, as returned
+// by GetSessions, along with the IDs it was rotated from and to, like
+// Logout. It reports whether the current session was among them.
+func (s *UserService) RevokeSession(userID, currentSessionID, handle string) (bool, error) {
+	sessions, err := s.activeSessions(userID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, session := range sessions {
+		if sessionHandle(session.SessionID) != handle {
+			continue
+		}
+
+		all, err := s.Repo.GetSessionsByUserID(userID)
+		if err != nil {
+			return false, fmt.Errorf("failed to fetch sessions: %v", err)
+		}
+		current := false
+		for _, id := range rotationChain(all, session.SessionID) {
+			if err := s.Repo.DeleteSession(id); err != nil {
+				return false, fmt.Errorf("failed to delete session: %v", err)
+			}
+			current = current || id == currentSessionID
+		}
+		return current, nil
+	}
+
+	return false, ErrSessionNotFound
+}
+
+// RevokeAllSessions logs the user out everywhere, including the current
+// session. Bearer tokens already issued are revoked along with the sessions
+// and refresh tokens.
+func (s *UserService) RevokeAllSessions(userID string) error {
+	if err := s.Repo.RevokeToken(utils.UserTokensRevocation(userID, time.Now())); err != nil {
+		return fmt.Errorf("failed to revoke tokens: %v", err)
+	}
+
+	sessions, err := s.Repo.GetSessionsByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch sessions: %v", err)
+	}
+
+	for _, session := range sessions {
+		if err := s.Repo.DeleteSession(session.SessionID); err != nil {
+			return fmt.Errorf("failed to delete session: %v", err)
+		}
+	}
+
+	tokens, err := s.Repo.GetRefreshTokensByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch refresh tokens: %v", err)
+	}
+	return s.revokeRefreshTokens(tokens)
+}
+
+// ForgotPassword emails a password reset link to the user with the email, if
+// there is one. Callers shouldn't reveal whether there was.
+func (s *UserService) ForgotPassword(email string) error {
+	user, err := s.Repo.GetUserByEmail(email)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil
+		}
+		return fmt.Errorf("error checking email: %v", err)
+	}
+	// Until the address is verified it may not be the user's own, and the
+	// link would hand the account to whoever reads it.
+	if !user.EmailVerified {
+		return nil
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate password reset token: %v", err)
+	}
+
+	expiresAt := time.Now().Add(passwordResetTokenLifetime)
+	err = s.Repo.CreatePasswordResetToken(&PasswordResetToken{
+		TokenHash:    hashToken(token),
+		UserID:       user.UserID,
+		ExpiresAt:    expiresAt.Format(time.RFC3339),
+		ExpiresAtTTL: expiresAt.Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store password reset token: %v", err)
+	}
+
+	link := strings.TrimSuffix(s.AppURL, "/") + "/password/reset?token=" + url.QueryEscape(token)
+	return s.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your tabichan password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse this link within an hour to choose a new password:\n\n%s\n\n"+
+			"If you didn't ask for this, you can ignore this email.\n", user.Username, link),
+	})
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword and
+// logs the user out everywhere, since whoever knew the old password may
+// still hold a session.
+func (s *UserService) ResetPassword(token, password string) error {
+	if password == "" {
+		return ErrPasswordRequired
+	}
+	// Checked before the token is used up, so the user can pick another
+	// password with the same link.
+	if err := s.Policy.Check(password); err != nil {
+		return err
+	}
+
+	stored, err := s.Repo.ConsumePasswordResetToken(hashToken(token))
+	if errors.Is(err, ErrInvalidResetToken) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch password reset token: %v", err)
+	}
+
+	expiresAt, err := utils.ConvertTimeStringToRFC3339(stored.ExpiresAt)
+	if err != nil || time.Now().After(expiresAt) {
+		return ErrInvalidResetToken
+	}
+
+	user, err := s.Repo.GetUserByID(stored.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch user: %v", err)
+	}
+	if !user.EmailVerified {
+		return ErrInvalidResetToken
+	}
+
+	hashedPassword, err := s.Hasher.Hash(password)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %v", err)
+	}
+
+	if err := s.Repo.SetPasswordHash(user.UserID, hashedPassword); err != nil {
+		return fmt.Errorf("failed to update password: %v", err)
+	}
+
+	// Whoever locked the account out doesn't know the new password, so its
+	// owner can log in again straight away.
+	s.resetLoginFailures(user.UserID)
+	return s.RevokeAllSessions(user.UserID)
+}
+
+// VerifyEmail marks the user's email verified if the token was signed for
+// their current address.
+func (s *UserService) VerifyEmail(token string) error {
+	userID, email, err := s.Verifier.Verify(token)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return ErrInvalidVerificationToken
+		}
+		return fmt.Errorf("failed to fetch user: %v", err)
+	}
+	if user.Email != email {
+		return ErrInvalidVerificationToken
+	}
+	if user.EmailVerified {
+		return nil
+	}
+
+	// The email may have been changed since it was read, and the link
+	// doesn't vouch for the new one.
+	err = s.Repo.MarkEmailVerified(userID, email)
+	if errors.Is(err, ErrEmailChanged) {
+		return ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return fmt.Errorf("failed to verify email: %v", err)
+	}
+	return nil
+}
+
+// ResendVerification sends a new link for the user's email, unless it is
+// already verified.
+func (s *UserService) ResendVerification(userID string) error {
+	user, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch user: %v", err)
+	}
+	if user.EmailVerified {
+		return nil
+	}
+	return s.sendVerificationEmail(user)
+}
+
+// ChangeEmail switches the user to an unverified new address and sends it a
+// verification link. The old address is told about the change, in case it
+// wasn't the user who made it.
+func (s *UserService) ChangeEmail(userID, email string) error {
+	if !utils.IsEmail(email) {
+		return ErrInvalidEmail
+	}
+
+	user, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch user: %v", err)
+	}
+	if user.Email == email {
+		return nil
+	}
+
+	existing, err := s.Repo.GetUserByEmail(email)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return fmt.Errorf("error checking email: %v", err)
+	}
+	if existing != nil {
+		return ErrEmailInUse
+	}
+
+	oldEmail := user.Email
+	err = s.Repo.UpdateEmail(userID, oldEmail, email)
+	if errors.Is(err, ErrEmailChanged) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to change email: %v", err)
+	}
+	user.Email = email
+
+	if err := s.sendVerificationEmail(user); err != nil {
+		log.Printf("Failed to send verification email: %v", err)
+	}
+	err = s.Mailer.Send(mailer.Message{
+		To:      oldEmail,
+		Subject: "Your tabichan email was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe email address of your tabichan account was changed to %s.\n\n"+
+			"If you didn't do this, reset your password and contact us.\n", user.Username, email),
+	})
+	if err != nil {
+		log.Printf("Failed to send email change notice: %v", err)
+	}
+	return nil
+}
+
+func (s *UserService) sendVerificationEmail(user *UserLogin) error {
+	token, err := s.Verifier.Sign(user.UserID, user.Email, time.Now().Add(emailVerificationLifetime))
+	if err != nil {
+		return fmt.Errorf("failed to sign verification link: %v", err)
+	}
+
+	link := strings.TrimSuffix(s.AppURL, "/") + "/verify-email?token=" + url.QueryEscape(token)
+	return s.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your tabichan email",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link within two days to verify your email address:\n\n%s\n",
+			user.Username, link),
+	})
+}
+
+// RefreshTokens exchanges a refresh token for a new access token and a new
+// refresh token in the same family. Presenting a token that was already
+// exchanged means it leaked, so every token in its family is revoked.
+func (s *UserService) RefreshTokens(refreshToken string) (*TokenResponse, error) {
+	stored, err := s.Repo.GetRefreshToken(hashToken(refreshToken))
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch refresh token: %v", err)
+	}
+
+	if stored.Revoked {
+		return nil, ErrInvalidRefreshToken
+	}
+	if stored.UsedAt != "" {
+		return nil, s.revokeRefreshTokenFamily(stored.FamilyID)
+	}
+
+	expiresAt, err := utils.ConvertTimeStringToRFC3339(stored.ExpiresAt)
+	if err != nil || time.Now().After(expiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	err = s.Repo.MarkRefreshTokenUsed(stored.TokenHash, time.Now().Format(time.RFC3339))
+	if errors.Is(err, ErrRefreshTokenReused) {
+		return nil, s.revokeRefreshTokenFamily(stored.FamilyID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to use refresh token: %v", err)
+	}
+
+	token, err := s.Tokens.Generate(stored.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+
+	next, err := s.issueRefreshToken(stored.UserID, stored.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{Token: token, RefreshToken: next}, nil
+}
+
+// RevokeRefreshToken ends the family the refresh token belongs to. Unknown
+// tokens are ignored.
+func (s *UserService) RevokeRefreshToken(refreshToken string) error {
+	stored, err := s.Repo.GetRefreshToken(hashToken(refreshToken))
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch refresh token: %v", err)
+	}
+
+	if err := s.revokeRefreshTokenFamily(stored.FamilyID); err != nil && !errors.Is(err, ErrRefreshTokenReused) {
+		return err
+	}
+	return nil
+}
+
+// revokeRefreshTokenFamily revokes every token in the family and returns
+// ErrRefreshTokenReused for the caller to report, unless revoking fails.
+func (s *UserService) revokeRefreshTokenFamily(familyID string) error {
+	tokens, err := s.Repo.GetRefreshTokensByFamily(familyID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch refresh tokens: %v", err)
+	}
+	if err := s.revokeRefreshTokens(tokens); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+func (s *UserService) revokeRefreshTokens(tokens []*RefreshToken) error {
+	for _, token := range tokens {
+		if token.Revoked {
+			continue
+		}
+		if err := s.Repo.RevokeRefreshToken(token.TokenHash); err != nil {
+			return fmt.Errorf("failed to revoke refresh token: %v", err)
+		}
+	}
+	return nil
+}
+
+// issueRefreshToken stores a new refresh token for the user and returns it.
+// An empty familyID starts a new family, as happens on every login.
+func (s *UserService) issueRefreshToken(userID, familyID string) (string, error) {
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %v", err)
+	}
+
+	if familyID == "" {
+		familyID = uuid.New().String()
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(refreshTokenLifetime)
+	err = s.Repo.CreateRefreshToken(&RefreshToken{
+		TokenHash:    hashToken(refreshToken),
+		FamilyID:     familyID,
+		UserID:       userID,
+		CreatedAt:    now.Format(time.RFC3339),
+		ExpiresAt:    expiresAt.Format(time.RFC3339),
+		ExpiresAtTTL: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store refresh token: %v", err)
+	}
+
+	return refreshToken, nil
+}
+
+// newOpaqueToken returns a random token for handing out to clients, who get
+// the only copy; the server keeps hashToken of it.
+func newOpaqueToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *UserService) activeSessions(userID string) ([]*utils.Session, error) {
+	sessions, err := s.Repo.GetSessionsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sessions: %v", err)
+	}
+
+	active := make([]*utils.Session, 0, len(sessions))
+	for _, session := range sessions {
+		// Rotated sessions only linger for the grace period and are listed
+		// under their replacement.
+		if session.ReplacedBy != "" {
+			continue
+		}
+		expiresAt, err := utils.ConvertTimeStringToRFC3339(session.ExpiresAt)
+		if err == nil && time.Now().Before(expiresAt) {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+// sessionHandle derives a stable public ID for a session from its secret ID.
+func sessionHandle(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:12])
+}
+
+func (s *UserService) createNewSession(rememberMe bool, userID string, device string) (*utils.Session, error) {
+	now := time.Now()
 	session := &utils.Session{
-		SessionID: uuid.New().String(),
-		UserID:    userID,
-		ExpiresAt: expiresAt.Format(time.RFC3339),
-		CreatedAt: time.Now().Format(time.RFC3339),
-		Device:    device,
+		SessionID:  uuid.New().String(),
+		UserID:     userID,
+		CreatedAt:  now.Format(time.RFC3339),
+		Device:     device,
+		RememberMe: rememberMe,
 	}
+	session.SetExpiry(now.Add(utils.SessionLifetimeFor(rememberMe)))
 
 	err := s.Repo.CreateSession(session)
 	if err != nil {
@@ -103,12 +954,12 @@ func (s *UserService) createNewSession(expiresAt time.Time, userID string, devic
 
 func (s *UserService) checkUsernameOrEmailInUse(email, username string) error {
 	usernameExists, err := s.Repo.GetUserByUsername(username)
-	if err != nil && err.Error() != "user not found" {
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
 		return fmt.Errorf("error checking username: %v", err)
 	}
 
 	emailExists, err := s.Repo.GetUserByEmail(email)
-	if err != nil && err.Error() != "user not found" {
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
 		return fmt.Errorf("error checking email: %v", err)
 	}
 
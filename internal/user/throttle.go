@@ -0,0 +1,166 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+)
+
+// LoginThrottledError is returned while an account or client IP has to wait
+// before it may try to log in again.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return "too many failed login attempts, try again later"
+}
+
+// throttlePolicy decides how long to wait after a number of failed logins.
+// The first freeFailures cost nothing, each one after that doubles the wait
+// starting at a second, and from lockoutFailures on the key is locked out
+// for lockoutDuration.
+type throttlePolicy struct {
+	freeFailures    int
+	lockoutFailures int
+	lockoutDuration time.Duration
+}
+
+var (
+	accountThrottle = throttlePolicy{freeFailures: 3, lockoutFailures: 10, lockoutDuration: 15 * time.Minute}
+	// A client IP can be shared by many users, so it is allowed more.
+	ipThrottle = throttlePolicy{freeFailures: 20, lockoutFailures: 100, lockoutDuration: 15 * time.Minute}
+)
+
+// failureWindow is how long failed logins are remembered after the last one.
+const failureWindow = time.Hour
+
+const auditLoginLockout = "login_lockout"
+
+func (p throttlePolicy) delay(failures int) time.Duration {
+	if failures >= p.lockoutFailures {
+		return p.lockoutDuration
+	}
+	if failures <= p.freeFailures {
+		return 0
+	}
+	// Past a few doublings the wait is longer than any lockout, and shifting
+	// further would overflow.
+	doublings := failures - p.freeFailures - 1
+	if doublings >= 20 {
+		return p.lockoutDuration
+	}
+	return min(time.Second<<doublings, p.lockoutDuration)
+}
+
+// loginAttemptKeys returns the counter keys for a login as the account (or
+// the identifier typed, when no account matches) and the client IP. Unknown
+// identifiers are throttled the same way as real ones, so lockouts don't give
+// away which accounts exist. They are counted apart from user IDs, so nobody
+// can lock an account out by typing its ID as a username.
+func loginAttemptKeys(userID, identifier, clientIP string) (string, string) {
+	account := "user#" + userID
+	if userID == "" {
+		account = "name#" + strings.ToLower(strings.TrimSpace(identifier))
+	}
+	return account, "ip#" + clientIP
+}
+
+// checkLoginThrottle returns a LoginThrottledError if either key has to wait.
+func (s *UserService) checkLoginThrottle(keys ...string) error {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		attempts, err := s.Repo.GetLoginAttempts(key)
+		if err != nil {
+			return fmt.Errorf("failed to fetch login attempts: %v", err)
+		}
+		if attempts.LockedUntil == "" {
+			continue
+		}
+		lockedUntil, err := utils.ConvertTimeStringToRFC3339(attempts.LockedUntil)
+		if err == nil && lockedUntil.After(now) {
+			wait = max(wait, lockedUntil.Sub(now))
+		}
+	}
+	if wait > 0 {
+		return &LoginThrottledError{RetryAfter: (wait + time.Second - 1).Truncate(time.Second)}
+	}
+	return nil
+}
+
+// checkAccountLock returns a LoginThrottledError while the user's account is
+// locked out. Logins without a password check it too, so a lockout keeps out
+// every way in rather than only the one being guessed at.
+func (s *UserService) checkAccountLock(userID string) error {
+	accountKey, _ := loginAttemptKeys(userID, "", "")
+	return s.checkLoginThrottle(accountKey)
+}
+
+// recordLoginFailure counts a failed login against the account and the
+// client IP, making them wait before the next attempt where the policy says
+// so, and records an audit event whenever one gets locked out.
+func (s *UserService) recordLoginFailure(userID, accountKey, ipKey, clientIP string) error {
+	for _, counter := range []struct {
+		key    string
+		policy throttlePolicy
+	}{
+		{accountKey, accountThrottle},
+		{ipKey, ipThrottle},
+	} {
+		now := time.Now()
+		attempts, err := s.Repo.RecordLoginFailure(counter.key, now, now.Add(failureWindow))
+		if err != nil {
+			return fmt.Errorf("failed to record login attempt: %v", err)
+		}
+
+		delay := counter.policy.delay(attempts.Failures)
+		if delay == 0 {
+			continue
+		}
+		if err := s.Repo.LockLogin(counter.key, now.Add(delay)); err != nil {
+			return fmt.Errorf("failed to lock login: %v", err)
+		}
+
+		if attempts.Failures == counter.policy.lockoutFailures {
+			event := &AuditEvent{
+				EventID:   uuid.New().String(),
+				Type:      auditLoginLockout,
+				IP:        clientIP,
+				Detail:    fmt.Sprintf("%s locked out for %s after %d failed logins", counter.key, delay, attempts.Failures),
+				CreatedAt: now.Format(time.RFC3339),
+			}
+			if counter.key == accountKey {
+				event.UserID = userID
+			}
+			log.Printf("audit: %s: %s (user %q, ip %s)", event.Type, event.Detail, event.UserID, event.IP)
+			if err := s.Repo.CreateAuditEvent(event); err != nil {
+				log.Printf("Failed to store audit event: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// dummyPasswordHash is checked against when no account matches a login, so
+// that unknown usernames take as long to reject as wrong passwords.
+func (s *UserService) dummyPasswordHash() string {
+	s.dummyHashOnce.Do(func() {
+		s.dummyHash, _ = s.Hasher.Hash("not a real password")
+	})
+	return s.dummyHash
+}
+
+// resetLoginFailures forgets an account's failed logins once its owner has
+// proven who they are. The client IP's count is left alone, since one good
+// login says nothing about the other accounts tried from it.
+func (s *UserService) resetLoginFailures(userID string) {
+	accountKey, _ := loginAttemptKeys(userID, "", "")
+	if err := s.Repo.ResetLoginAttempts(accountKey); err != nil {
+		log.Printf("Failed to reset login attempts: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottlePolicyDelay(t *testing.T) {
+	for name, policy := range map[string]throttlePolicy{"account": accountThrottle, "ip": ipThrottle} {
+		previous := time.Duration(0)
+		for failures := 0; failures <= policy.lockoutFailures+10; failures++ {
+			delay := policy.delay(failures)
+			switch {
+			case failures <= policy.freeFailures && delay != 0:
+				t.Errorf("%s: %d failures wait %s, want none", name, failures, delay)
+			case failures > policy.freeFailures && (delay < previous || delay <= 0 || delay > policy.lockoutDuration):
+				t.Errorf("%s: %d failures wait %s after %s", name, failures, delay, previous)
+			case failures >= policy.lockoutFailures && delay != policy.lockoutDuration:
+				t.Errorf("%s: %d failures wait %s, want the %s lockout", name, failures, delay, policy.lockoutDuration)
+			}
+			previous = delay
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+// EmailVerifier signs the links that prove a user owns their email. Nothing
+// is stored for a link; it names the user and the address it was sent to, so
+// it stops working as soon as the user changes their email.
+type EmailVerifier struct {
+	secret []byte
+}
+
+type verificationPayload struct {
+	UserID    string `json:"u"`
+	Email     string `json:"e"`
+	ExpiresAt int64  `json:"x"`
+}
+
+// NewEmailVerifier signs links with secret. Without a secret a random one is
+// generated, so links stop working when the process restarts.
+func NewEmailVerifier(secret string) *EmailVerifier {
+	if secret != "" {
+		return &EmailVerifier{secret: []byte(secret)}
+	}
+
+	log.Println("EMAIL_VERIFICATION_SECRET is not set, using a random key for verification links")
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		log.Fatalf("Failed to generate verification key: %v", err)
+	}
+	return &EmailVerifier{secret: random}
+}
+
+func (v *EmailVerifier) Sign(userID, email string, expiresAt time.Time) (string, error) {
+	payload, err := json.Marshal(verificationPayload{UserID: userID, Email: email, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(v.sign(encoded)), nil
+}
+
+// Verify returns the user and email the token was signed for, as long as it
+// hasn't expired.
+func (v *EmailVerifier) Verify(token string) (userID, email string, err error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", ErrInvalidVerificationToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, v.sign(encoded)) {
+		return "", "", ErrInvalidVerificationToken
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", ErrInvalidVerificationToken
+	}
+	var payload verificationPayload
+	if err := json.Unmarshal(raw, &payload); err != nil || payload.UserID == "" || payload.Email == "" {
+		return "", "", ErrInvalidVerificationToken
+	}
+	if time.Now().Unix() > payload.ExpiresAt {
+		return "", "", ErrInvalidVerificationToken
+	}
+
+	return payload.UserID, payload.Email, nil
+}
+
+func (v *EmailVerifier) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte("email-verification:" + encoded))
+	return mac.Sum(nil)
+}
@@ -1,14 +1,133 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+// PasswordHasher hashes passwords for storage and checks them at login.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Verify reports whether password matches hash, which may have been made
+	// by any of the hashers, and whether hash should be replaced because it
+	// uses another algorithm or other parameters than this hasher.
+	Verify(password, hash string) (ok bool, rehash bool)
+}
+
+// BcryptMaxPasswordLength is in bytes. bcrypt ignores the rest of a longer
+// password, and newer versions refuse to hash it.
+const BcryptMaxPasswordLength = 72
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
 	return string(bytes), err
 }
 
-func CheckPasswordHash(password, hash string) bool {
-	return nil == bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+func (h *BcryptHasher) Verify(password, hash string) (bool, bool) {
+	if !checkPasswordHash(password, hash) {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, err != nil || cost != h.Cost
+}
+
+// Argon2idHasher hashes with argon2id, taking Time passes over Memory KiB
+// with Threads lanes. Hashes are stored in the PHC string format.
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+type argon2Hash struct {
+	time, memory uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, argon2KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2idHasher) Verify(password, hash string) (bool, bool) {
+	if !checkPasswordHash(password, hash) {
+		return false, false
+	}
+	parsed, err := parseArgon2Hash(hash)
+	if err != nil {
+		return true, true
+	}
+	return true, parsed.time != h.Time || parsed.memory != h.Memory || parsed.threads != h.Threads ||
+		len(parsed.key) != argon2KeyLength
+}
+
+// checkPasswordHash tells the algorithm apart by the hash's prefix, so
+// passwords keep working when the configured hasher changes.
+func checkPasswordHash(password, hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		parsed, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), parsed.salt, parsed.time, parsed.memory, parsed.threads, uint32(len(parsed.key)))
+		return subtle.ConstantTimeCompare(key, parsed.key) == 1
+	case strings.HasPrefix(hash, "$2"):
+		return nil == bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	}
+	return false
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	var parsed argon2Hash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.time, &parsed.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters: %v", err)
+	}
+	if parsed.time == 0 || parsed.threads == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(parsed.key) == 0 {
+		return nil, fmt.Errorf("invalid argon2id key")
+	}
+	return &parsed, nil
 }
@@ -1,24 +1,164 @@
 package utils
 
 import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 )
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET_KEY"))
+// jwtLifetime is kept short since revoked access tokens have to be
+// remembered until they expire; clients renew them with a refresh token.
+const jwtLifetime = 15 * time.Minute
 
-func GenerateJWT(userID string) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
+var ErrInvalidToken = errors.New("invalid token")
+
+type jwtKey struct {
+	id     string
+	method jwt.SigningMethod
+	signer crypto.Signer
+}
+
+// JWTKeySet signs access tokens with one key and verifies them with any key
+// in the set, picked by the token's kid header. Keeping the previous key in
+// the set after switching the signing key lets tokens it issued run out.
+type JWTKeySet struct {
+	signing *jwtKey
+	keys    map[string]*jwtKey
+}
+
+// JWK is a public key in JSON Web Key form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadJWTKeySet reads every .pem private key in dir, RSA or Ed25519, using
+// the file name without extension as the key's kid. signingKeyID picks the
+// key new tokens are signed with and may be left empty when dir holds a
+// single key. Without a dir a random Ed25519 key is generated, so tokens stop
+// working when the process restarts.
+func LoadJWTKeySet(dir, signingKeyID string) (*JWTKeySet, error) {
+	if dir == "" {
+		log.Println("JWT_KEYS_DIR is not set, using a random key for access tokens")
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate JWT key: %w", err)
+		}
+		key := &jwtKey{id: uuid.New().String(), method: jwt.SigningMethodEdDSA, signer: private}
+		return &JWTKeySet{signing: key, keys: map[string]*jwtKey{key.id: key}}, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list JWT keys: %w", err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no .pem keys found in %s", dir)
+	}
+
+	keys := map[string]*jwtKey{}
+	for _, path := range paths {
+		key, err := readJWTKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys[key.id] = key
+	}
+
+	if signingKeyID == "" {
+		if len(keys) > 1 {
+			return nil, fmt.Errorf("JWT_SIGNING_KEY_ID must be set when %s holds more than one key", dir)
+		}
+		for id := range keys {
+			signingKeyID = id
+		}
+	}
+
+	signing, ok := keys[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("signing key %q not found in %s", signingKeyID, dir)
+	}
+
+	return &JWTKeySet{signing: signing, keys: keys}, nil
+}
+
+func readJWTKey(path string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s holds an unsupported %s block", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &jwtKey{id: id, method: jwt.SigningMethodRS256, signer: private}, nil
+	case ed25519.PrivateKey:
+		return &jwtKey{id: id, method: jwt.SigningMethodEdDSA, signer: private}, nil
+	default:
+		return nil, fmt.Errorf("%s is neither an RSA nor an Ed25519 key", path)
+	}
+}
+
+// Generate issues a token for the user with a unique jti, so it can be
+// revoked on its own before it expires.
+func (k *JWTKeySet) Generate(userID string) (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Subject:   userID,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(jwtLifetime)),
+		ID:        uuid.New().String(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	token.Header["kid"] = k.signing.id
 
-	tokenString, err := token.SignedString(jwtSecret)
+	tokenString, err := token.SignedString(k.signing.signer)
 	if err != nil {
 		return "", err
 	}
@@ -26,26 +166,83 @@ func GenerateJWT(userID string) (string, error) {
 	return tokenString, nil
 }
 
-func ValidateJWT(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
-			return
+// UserTokensRevocationID is the RevokedToken ID of the user-wide revocation
+// made by UserTokensRevocation. It can't collide with a jti, which is a UUID.
+func UserTokensRevocationID(userID string) string {
+	return "user#" + userID
+}
+
+// UserTokensRevocation revokes every token issued to the user up to now,
+// including any issued within the same second since iat has no finer
+// precision. It only needs keeping until the last of them has expired.
+func UserTokensRevocation(userID string, now time.Time) *RevokedToken {
+	expiresAt := now.Add(jwtLifetime)
+	return &RevokedToken{
+		TokenID:      UserTokensRevocationID(userID),
+		UserID:       userID,
+		ExpiresAt:    expiresAt.Format(time.RFC3339),
+		ExpiresAtTTL: expiresAt.Unix(),
+		IssuedBefore: now.Unix() + 1,
+	}
+}
+
+// Parse verifies the token's signature and expiry and that it carries every
+// claim Generate sets.
+func (k *JWTKeySet) Parse(tokenString string) (*jwt.RegisteredClaims, error) {
+	claims := &jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		id, _ := token.Header["kid"].(string)
+		key, ok := k.keys[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", id)
+		}
+		// The algorithm has to be the key's own, not whatever the header
+		// claims.
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
 		}
+		return key.signer.Public(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, http.ErrNoCookie
-			}
-			return jwtSecret, nil
-		})
+	if claims.Subject == "" || claims.ID == "" || claims.IssuedAt == nil || claims.ExpiresAt == nil {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
 
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
+// JWKS returns the public half of every key in the set, for other services
+// to verify tokens with.
+func (k *JWTKeySet) JWKS() JWKSet {
+	set := JWKSet{Keys: make([]JWK, 0, len(k.keys))}
+	for _, key := range k.keys {
+		jwk := JWK{KeyID: key.id, Use: "sig", Algorithm: key.method.Alg()}
+		switch public := key.signer.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
 		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+	return set
+}
 
-		next(w, r)
+// BearerToken returns the token in the request's Authorization header, if it
+// uses the Bearer scheme.
+func BearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
 	}
+	return strings.TrimSpace(token), true
 }
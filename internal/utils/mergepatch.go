@@ -0,0 +1,39 @@
+package utils
+
+import "encoding/json"
+
+// MergePatch applies an RFC 7396 JSON Merge Patch to original and returns the
+// patched document. Members set to null in the patch are removed, objects are
+// merged recursively and every other value replaces the original outright.
+func MergePatch(original, patch []byte) ([]byte, error) {
+	var originalValue, patchValue any
+	if err := json.Unmarshal(original, &originalValue); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &patchValue); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergePatchValue(originalValue, patchValue))
+}
+
+func mergePatchValue(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergePatchValue(targetObject[name], value)
+	}
+	return targetObject
+}
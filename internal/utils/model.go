@@ -1,9 +1,28 @@
 package utils
 
 type Session struct {
-	SessionID string `json:"session_id"`
-	UserID    string `json:"user_id"`
-	Device    string `json:"device"`
-	CreatedAt string `json:"created_at"`
-	ExpiresAt string `json:"expires_at"`
+	SessionID  string `json:"session_id"`
+	UserID     string `json:"user_id"`
+	Device     string `json:"device"`
+	CreatedAt  string `json:"created_at"`
+	ExpiresAt  string `json:"expires_at"`
+	RememberMe bool   `json:"remember_me"`
+	// ReplacedBy is set once the session has been rotated; the old ID then
+	// keeps working until its shortened ExpiresAt.
+	ReplacedBy string `json:"-"`
+	// ExpiresAtTTL mirrors ExpiresAt as epoch seconds for DynamoDB TTL.
+	ExpiresAtTTL int64 `json:"-"`
+}
+
+// RevokedToken records a JWT that must no longer be accepted. It only needs
+// keeping until the token would have expired anyway.
+type RevokedToken struct {
+	TokenID      string `json:"token_id"`
+	UserID       string `json:"user_id"`
+	ExpiresAt    string `json:"expires_at"`
+	ExpiresAtTTL int64  `json:"-"`
+	// IssuedBefore is set on a user-wide revocation, keyed by
+	// UserTokensRevocationID, and revokes every token of UserID whose iat
+	// is earlier, in epoch seconds.
+	IssuedBefore int64 `json:"-"`
 }
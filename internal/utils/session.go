@@ -0,0 +1,23 @@
+package utils
+
+import "time"
+
+const (
+	SessionLifetime           = 24 * time.Hour
+	RememberedSessionLifetime = 30 * 24 * time.Hour
+)
+
+// SessionLifetimeFor is how long a new or rotated session stays valid.
+func SessionLifetimeFor(rememberMe bool) time.Duration {
+	if rememberMe {
+		return RememberedSessionLifetime
+	}
+	return SessionLifetime
+}
+
+// SetExpiry sets ExpiresAt together with the TTL attribute DynamoDB uses to
+// clean up expired sessions.
+func (s *Session) SetExpiry(expiresAt time.Time) {
+	s.ExpiresAt = expiresAt.Format(time.RFC3339)
+	s.ExpiresAtTTL = expiresAt.Unix()
+}
@@ -0,0 +1,79 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent     = 0x01
+	flagUserVerified    = 0x04
+	flagAttestedData    = 0x40
+	flagExtensionData   = 0x80
+	maxCredentialIDSize = 1023
+)
+
+var errInvalidAuthData = errors.New("invalid authenticator data")
+
+// authenticatorData is the part of a registration or assertion the
+// authenticator itself signs.
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+
+	// Only present when registering.
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errInvalidAuthData
+	}
+
+	parsed := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if parsed.Flags&flagAttestedData != 0 {
+		// The AAGUID is skipped: without attestation it identifies nothing
+		// that can be trusted.
+		if len(rest) < 18 {
+			return nil, errInvalidAuthData
+		}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength > maxCredentialIDSize || len(rest) < idLength {
+			return nil, errInvalidAuthData
+		}
+		parsed.CredentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		// The COSE key has no length prefix, so decoding it is the only way
+		// to find where it ends.
+		_, afterKey, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, errInvalidAuthData
+		}
+		parsed.PublicKey = rest[:len(rest)-len(afterKey)]
+		rest = afterKey
+	}
+
+	if parsed.Flags&flagExtensionData != 0 {
+		_, afterExtensions, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, errInvalidAuthData
+		}
+		rest = afterExtensions
+	}
+
+	if len(rest) != 0 {
+		return nil, errInvalidAuthData
+	}
+	return parsed, nil
+}
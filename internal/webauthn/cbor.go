@@ -0,0 +1,127 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// errInvalidCBOR is returned for anything the decoder can't read. It only
+// handles what authenticators send: definite lengths, integers, byte and
+// text strings, arrays, maps and the simple values false, true and null.
+var errInvalidCBOR = errors.New("invalid CBOR")
+
+// maxCBORDepth bounds nesting, since the input comes from the client.
+const maxCBORDepth = 16
+
+// decodeCBOR reads one item from data and returns it with the bytes after
+// it. Integers come back as int64, byte strings as []byte, text as string,
+// arrays as []any and maps as map[any]any.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth || len(data) == 0 {
+		return nil, nil, errInvalidCBOR
+	}
+
+	major := data[0] >> 5
+	argument, rest, err := decodeCBORArgument(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if argument > 1<<63-1 {
+			return nil, nil, errInvalidCBOR
+		}
+		return int64(argument), rest, nil
+	case 1:
+		if argument > 1<<63-1 {
+			return nil, nil, errInvalidCBOR
+		}
+		return -1 - int64(argument), rest, nil
+	case 2, 3:
+		if argument > uint64(len(rest)) {
+			return nil, nil, errInvalidCBOR
+		}
+		value := rest[:argument]
+		if major == 3 {
+			return string(value), rest[argument:], nil
+		}
+		return append([]byte(nil), value...), rest[argument:], nil
+	case 4:
+		// Every item takes at least one byte, which bounds the allocation.
+		if argument > uint64(len(rest)) {
+			return nil, nil, errInvalidCBOR
+		}
+		items := make([]any, 0, argument)
+		for range argument {
+			var item any
+			item, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if argument > uint64(len(rest)) {
+			return nil, nil, errInvalidCBOR
+		}
+		entries := make(map[any]any, argument)
+		for range argument {
+			var key, value any
+			key, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key", errInvalidCBOR)
+			}
+			if _, ok := entries[key]; ok {
+				return nil, nil, fmt.Errorf("%w: duplicate map key", errInvalidCBOR)
+			}
+			value, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			entries[key] = value
+		}
+		return entries, rest, nil
+	case 7:
+		switch data[0] & 0x1f {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22:
+			return nil, rest, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: unsupported item 0x%02x", errInvalidCBOR, data[0])
+}
+
+// decodeCBORArgument reads the length or value that follows an item's
+// initial byte.
+func decodeCBORArgument(data []byte) (uint64, []byte, error) {
+	info := data[0] & 0x1f
+	rest := data[1:]
+	switch {
+	case info < 24:
+		return uint64(info), rest, nil
+	case info == 24 && len(rest) >= 1:
+		return uint64(rest[0]), rest[1:], nil
+	case info == 25 && len(rest) >= 2:
+		return uint64(binary.BigEndian.Uint16(rest)), rest[2:], nil
+	case info == 26 && len(rest) >= 4:
+		return uint64(binary.BigEndian.Uint32(rest)), rest[4:], nil
+	case info == 27 && len(rest) >= 8:
+		return binary.BigEndian.Uint64(rest), rest[8:], nil
+	}
+	return 0, nil, errInvalidCBOR
+}
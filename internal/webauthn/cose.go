@@ -0,0 +1,102 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms passkeys are accepted with, in order of preference.
+const (
+	algES256 = -7
+	algEdDSA = -8
+	algRS256 = -257
+)
+
+var supportedAlgorithms = []int{algES256, algEdDSA, algRS256}
+
+var errUnsupportedKey = errors.New("unsupported credential public key")
+
+// parseCOSEKey turns a COSE_Key from an authenticator into a public key and
+// its algorithm.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int, error) {
+	decoded, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, 0, errUnsupportedKey
+	}
+
+	keyType, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case keyType == 2 && alg == algES256:
+		curve, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if curve != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errUnsupportedKey
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		// Going through PKIX checks that the point is on the curve.
+		der, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			return nil, 0, errUnsupportedKey
+		}
+		if _, err := x509.ParsePKIXPublicKey(der); err != nil {
+			return nil, 0, errUnsupportedKey
+		}
+		return public, algES256, nil
+	case keyType == 1 && alg == algEdDSA:
+		curve, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if curve != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errUnsupportedKey
+		}
+		return ed25519.PublicKey(x), algEdDSA, nil
+	case keyType == 3 && alg == algRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errUnsupportedKey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, algRS256, nil
+	}
+	return nil, 0, fmt.Errorf("%w: key type %d with algorithm %d", errUnsupportedKey, keyType, alg)
+}
+
+// verifySignature checks an assertion signature made with a stored PKIX
+// public key.
+func verifySignature(publicKeyDER []byte, alg int, signed, signature []byte) error {
+	parsed, err := x509.ParsePKIXPublicKey(publicKeyDER)
+	if err != nil {
+		return fmt.Errorf("failed to parse stored public key: %w", err)
+	}
+
+	digest := sha256.Sum256(signed)
+	switch public := parsed.(type) {
+	case *ecdsa.PublicKey:
+		if alg == algES256 && ecdsa.VerifyASN1(public, digest[:], signature) {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if alg == algEdDSA && ed25519.Verify(public, signed, signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if alg == algRS256 && rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	}
+	return ErrInvalidAssertion
+}
@@ -0,0 +1,148 @@
+package webauthn
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tabichanorg/tabichan-server/internal/user"
+)
+
+type WebAuthnHandler struct {
+	Service *WebAuthnService
+}
+
+func (h *WebAuthnHandler) BeginRegistration(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	options, err := h.Service.BeginRegistration(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(options)
+}
+
+func (h *WebAuthnHandler) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	var registration struct {
+		Name       string                 `json:"name"`
+		Credential RegistrationCredential `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	credential, err := h.Service.FinishRegistration(userID, registration.Name, registration.Credential)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(credential)
+}
+
+func (h *WebAuthnHandler) BeginLogin(w http.ResponseWriter, r *http.Request) {
+	options, err := h.Service.BeginLogin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(options)
+}
+
+func (h *WebAuthnHandler) FinishLogin(w http.ResponseWriter, r *http.Request) {
+	var login struct {
+		Credential AssertionCredential `json:"credential"`
+		RememberMe bool                `json:"rememberMe"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	response, err := h.Service.FinishLogin(login.Credential, r.Header.Get("User-Agent"), login.RememberMe)
+	if err != nil {
+		status := errorStatus(err)
+		if status == http.StatusBadRequest {
+			status = http.StatusUnauthorized
+		}
+		user.SetRetryAfter(w, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err := user.SetSessionCookie(w, response.Session); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *WebAuthnHandler) GetCredentials(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	credentials, err := h.Service.Users.GetWebAuthnCredentials(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(credentials)
+}
+
+func (h *WebAuthnHandler) DeleteCredential(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	err := h.Service.Users.DeleteWebAuthnCredential(userID, mux.Vars(r)["credentialID"])
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func errorStatus(err error) int {
+	var throttled *user.LoginThrottledError
+	switch {
+	case errors.Is(err, ErrInvalidChallenge),
+		errors.Is(err, ErrInvalidAttestation):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrInvalidAssertion),
+		errors.Is(err, user.ErrSignCountMismatch):
+		return http.StatusUnauthorized
+	case errors.Is(err, user.ErrCredentialNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, user.ErrCredentialInUse),
+		errors.Is(err, user.ErrLastLoginMethod):
+		return http.StatusConflict
+	case errors.As(err, &throttled):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,25 @@
+package webauthn
+
+import "github.com/tabichanorg/tabichan-server/internal/db"
+
+type MemoryWebAuthnRepository struct {
+	Challenges *db.MemoryTable[Challenge]
+}
+
+func NewMemoryWebAuthnRepository() *MemoryWebAuthnRepository {
+	return &MemoryWebAuthnRepository{Challenges: db.NewMemoryTable[Challenge]()}
+}
+
+func (r *MemoryWebAuthnRepository) CreateChallenge(challenge *Challenge) error {
+	r.Challenges.Put(challenge.Challenge, *challenge)
+	return nil
+}
+
+func (r *MemoryWebAuthnRepository) ConsumeChallenge(challenge string) (*Challenge, error) {
+	stored, ok := r.Challenges.Get(challenge)
+	// Only the caller that actually deletes the challenge gets to use it.
+	if !ok || !r.Challenges.Delete(challenge) {
+		return nil, ErrInvalidChallenge
+	}
+	return &stored, nil
+}
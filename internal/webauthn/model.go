@@ -0,0 +1,135 @@
+package webauthn
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+)
+
+// Challenge is what the server remembers about a registration or login
+// between handing out options and the browser answering them. It can only
+// be used once. UserID is set for registrations, naming the user adding the
+// passkey.
+type Challenge struct {
+	Challenge    string
+	Ceremony     string
+	UserID       string `dynamodbav:",omitempty"`
+	ExpiresAt    string
+	ExpiresAtTTL int64
+}
+
+// URLEncodedBytes is binary data that appears in JSON as base64url, the
+// encoding the WebAuthn JSON forms of options and credentials use.
+type URLEncodedBytes []byte
+
+func (b URLEncodedBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *URLEncodedBytes) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// CreationOptions is passed to navigator.credentials.create, after
+// PublicKeyCredential.parseCreationOptionsFromJSON.
+type CreationOptions struct {
+	RP                     RelyingParty           `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              URLEncodedBytes        `json:"challenge"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions is passed to navigator.credentials.get, after
+// PublicKeyCredential.parseRequestOptionsFromJSON.
+type RequestOptions struct {
+	Challenge        URLEncodedBytes        `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          URLEncodedBytes `json:"id"`
+	Name        string          `json:"name"`
+	DisplayName string          `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string          `json:"type"`
+	ID         URLEncodedBytes `json:"id"`
+	Transports []string        `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// RegistrationCredential is the JSON form of the credential
+// navigator.credentials.create returns.
+type RegistrationCredential struct {
+	ID       string              `json:"id"`
+	RawID    URLEncodedBytes     `json:"rawId"`
+	Type     string              `json:"type"`
+	Response AttestationResponse `json:"response"`
+}
+
+type AttestationResponse struct {
+	ClientDataJSON    URLEncodedBytes `json:"clientDataJSON"`
+	AttestationObject URLEncodedBytes `json:"attestationObject"`
+	Transports        []string        `json:"transports"`
+}
+
+// AssertionCredential is the JSON form of the credential
+// navigator.credentials.get returns.
+type AssertionCredential struct {
+	ID       string            `json:"id"`
+	RawID    URLEncodedBytes   `json:"rawId"`
+	Type     string            `json:"type"`
+	Response AssertionResponse `json:"response"`
+}
+
+type AssertionResponse struct {
+	ClientDataJSON    URLEncodedBytes `json:"clientDataJSON"`
+	AuthenticatorData URLEncodedBytes `json:"authenticatorData"`
+	Signature         URLEncodedBytes `json:"signature"`
+	UserHandle        URLEncodedBytes `json:"userHandle"`
+}
+
+// clientData is what the browser says about the request it signed.
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
@@ -0,0 +1,60 @@
+package webauthn
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type WebAuthnRepository interface {
+	CreateChallenge(challenge *Challenge) error
+	// ConsumeChallenge removes and returns the challenge, so that it can't
+	// be answered twice.
+	ConsumeChallenge(challenge string) (*Challenge, error)
+}
+
+// DynamoWebAuthnRepository stores challenges in the WebAuthnChallenges
+// table, keyed by Challenge and cleaned up through TTL on ExpiresAtTTL.
+type DynamoWebAuthnRepository struct {
+	Client *dynamodb.Client
+}
+
+func (r *DynamoWebAuthnRepository) CreateChallenge(challenge *Challenge) error {
+	item, err := attributevalue.MarshalMap(challenge)
+	if err != nil {
+		return fmt.Errorf("failed to marshal WebAuthn challenge: %w", err)
+	}
+
+	_, err = r.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String("WebAuthnChallenges"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(Challenge)"),
+	})
+	return err
+}
+
+func (r *DynamoWebAuthnRepository) ConsumeChallenge(challenge string) (*Challenge, error) {
+	result, err := r.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String("WebAuthnChallenges"),
+		Key: map[string]types.AttributeValue{
+			"Challenge": &types.AttributeValueMemberS{Value: challenge},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Attributes) == 0 {
+		return nil, ErrInvalidChallenge
+	}
+
+	var stored Challenge
+	if err := attributevalue.UnmarshalMap(result.Attributes, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal WebAuthn challenge: %w", err)
+	}
+	return &stored, nil
+}
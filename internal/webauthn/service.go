@@ -0,0 +1,288 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/tabichanorg/tabichan-server/internal/user"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+)
+
+var (
+	ErrInvalidChallenge   = errors.New("passkey request is invalid or has expired")
+	ErrInvalidAttestation = errors.New("passkey registration could not be verified")
+	ErrInvalidAssertion   = errors.New("passkey could not be verified")
+)
+
+const (
+	// challengeLifetime is how long the browser has to answer a challenge,
+	// which is also the timeout it is given.
+	challengeLifetime = 5 * time.Minute
+
+	maxCredentialNameLength = 64
+	maxTransports           = 8
+)
+
+// WebAuthnService runs passkey registration and login. Passkeys are always
+// discoverable and always require user verification, so a login needs no
+// username and no second factor. Attestation is not requested, since which
+// authenticator holds a passkey doesn't matter here.
+type WebAuthnService struct {
+	// RPID is the domain passkeys are scoped to, and Origins the pages that
+	// may use them.
+	RPID    string
+	RPName  string
+	Origins []string
+	Repo    WebAuthnRepository
+	Users   *user.UserService
+}
+
+// BeginRegistration returns the options for adding a passkey to the user.
+func (s *WebAuthnService) BeginRegistration(userID string) (*CreationOptions, error) {
+	details, err := s.Users.GetUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+
+	existing, err := s.Users.GetWebAuthnCredentials(userID)
+	if err != nil {
+		return nil, err
+	}
+	exclude := make([]CredentialDescriptor, 0, len(existing))
+	for _, credential := range existing {
+		id, err := base64.RawURLEncoding.DecodeString(credential.CredentialID)
+		if err != nil {
+			continue
+		}
+		exclude = append(exclude, CredentialDescriptor{Type: "public-key", ID: id, Transports: credential.Transports})
+	}
+
+	challenge, err := s.newChallenge(ceremonyRegistration, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	displayName := details.DisplayName
+	if displayName == "" {
+		displayName = details.Username
+	}
+
+	params := make([]CredentialParameter, 0, len(supportedAlgorithms))
+	for _, alg := range supportedAlgorithms {
+		params = append(params, CredentialParameter{Type: "public-key", Alg: alg})
+	}
+
+	return &CreationOptions{
+		RP:                 RelyingParty{ID: s.RPID, Name: s.RPName},
+		User:               UserEntity{ID: []byte(userID), Name: details.Username, DisplayName: displayName},
+		Challenge:          challenge,
+		PubKeyCredParams:   params,
+		Timeout:            challengeLifetime.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "required",
+		},
+		Attestation: "none",
+	}, nil
+}
+
+// FinishRegistration verifies the browser's answer to BeginRegistration and
+// stores the new passkey under name.
+func (s *WebAuthnService) FinishRegistration(userID, name string, credential RegistrationCredential) (*user.WebAuthnCredential, error) {
+	if credential.Type != "public-key" {
+		return nil, ErrInvalidAttestation
+	}
+	if err := s.verifyClientData(credential.Response.ClientDataJSON, "webauthn.create", ceremonyRegistration, userID); err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := decodeCBOR(credential.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, ErrInvalidAttestation
+	}
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[any]any)
+	rawAuthData, _ := attestation["authData"].([]byte)
+	// Browsers answer with the "none" format when no attestation is asked
+	// for.
+	if format != "none" || len(statement) != 0 {
+		return nil, fmt.Errorf("%w: unexpected %q attestation", ErrInvalidAttestation, format)
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	if err := s.checkAuthData(authData); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	if authData.Flags&flagAttestedData == 0 || !bytes.Equal(authData.CredentialID, credential.RawID) {
+		return nil, fmt.Errorf("%w: credential ID mismatch", ErrInvalidAttestation)
+	}
+
+	publicKey, alg, err := parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > maxCredentialNameLength {
+		name = name[:maxCredentialNameLength]
+	}
+	transports := credential.Response.Transports
+	if len(transports) > maxTransports {
+		transports = transports[:maxTransports]
+	}
+
+	stored := &user.WebAuthnCredential{
+		CredentialID: base64.RawURLEncoding.EncodeToString(authData.CredentialID),
+		UserID:       userID,
+		Name:         name,
+		PublicKey:    publicKeyDER,
+		Algorithm:    alg,
+		SignCount:    authData.SignCount,
+		Transports:   transports,
+		CreatedAt:    time.Now().Format(time.RFC3339),
+	}
+	if err := s.Users.AddWebAuthnCredential(stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// BeginLogin returns the options for logging in with any passkey for this
+// site. The authenticator offers the user the passkeys it holds.
+func (s *WebAuthnService) BeginLogin() (*RequestOptions, error) {
+	challenge, err := s.newChallenge(ceremonyLogin, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          challengeLifetime.Milliseconds(),
+		RPID:             s.RPID,
+		AllowCredentials: []CredentialDescriptor{},
+		UserVerification: "required",
+	}, nil
+}
+
+// FinishLogin verifies the browser's answer to BeginLogin and logs in as the
+// passkey's owner.
+func (s *WebAuthnService) FinishLogin(credential AssertionCredential, device string, rememberMe bool) (*user.LoginRequestResponse, error) {
+	if credential.Type != "public-key" {
+		return nil, ErrInvalidAssertion
+	}
+	if err := s.verifyClientData(credential.Response.ClientDataJSON, "webauthn.get", ceremonyLogin, ""); err != nil {
+		return nil, err
+	}
+
+	stored, err := s.Users.GetWebAuthnCredential(base64.RawURLEncoding.EncodeToString(credential.RawID))
+	if errors.Is(err, user.ErrCredentialNotFound) {
+		return nil, ErrInvalidAssertion
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(credential.Response.UserHandle) != 0 && string(credential.Response.UserHandle) != stored.UserID {
+		return nil, ErrInvalidAssertion
+	}
+
+	authData, err := parseAuthenticatorData(credential.Response.AuthenticatorData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAssertion, err)
+	}
+	if err := s.checkAuthData(authData); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAssertion, err)
+	}
+
+	clientDataHash := sha256.Sum256(credential.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), credential.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := verifySignature(stored.PublicKey, stored.Algorithm, signed, credential.Response.Signature); err != nil {
+		return nil, err
+	}
+
+	return s.Users.LoginWithWebAuthn(stored, authData.SignCount, device, rememberMe)
+}
+
+func (s *WebAuthnService) newChallenge(ceremony, userID string) ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, fmt.Errorf("failed to generate challenge: %v", err)
+	}
+
+	expiresAt := time.Now().Add(challengeLifetime)
+	err := s.Repo.CreateChallenge(&Challenge{
+		Challenge:    base64.RawURLEncoding.EncodeToString(challenge),
+		Ceremony:     ceremony,
+		UserID:       userID,
+		ExpiresAt:    expiresAt.Format(time.RFC3339),
+		ExpiresAtTTL: expiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store challenge: %v", err)
+	}
+	return challenge, nil
+}
+
+// verifyClientData checks that the browser signed a request of the expected
+// type from one of our origins, and uses up the challenge it answered.
+func (s *WebAuthnService) verifyClientData(raw []byte, expectedType, ceremony, userID string) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return ErrInvalidChallenge
+	}
+	if data.Type != expectedType || data.Challenge == "" {
+		return ErrInvalidChallenge
+	}
+
+	stored, err := s.Repo.ConsumeChallenge(data.Challenge)
+	if err != nil {
+		if errors.Is(err, ErrInvalidChallenge) {
+			return err
+		}
+		return fmt.Errorf("failed to fetch challenge: %v", err)
+	}
+	expiresAt, err := utils.ConvertTimeStringToRFC3339(stored.ExpiresAt)
+	if err != nil || time.Now().After(expiresAt) || stored.Ceremony != ceremony || stored.UserID != userID {
+		return ErrInvalidChallenge
+	}
+
+	if data.CrossOrigin || !slices.Contains(s.Origins, data.Origin) {
+		return fmt.Errorf("%w: unexpected origin %q", ErrInvalidChallenge, data.Origin)
+	}
+	return nil
+}
+
+// checkAuthData checks that the authenticator scoped the credential to our
+// RP ID and that the user was present and verified.
+func (s *WebAuthnService) checkAuthData(authData *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(s.RPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return errors.New("credential is for another RP ID")
+	}
+	if authData.Flags&flagUserPresent == 0 || authData.Flags&flagUserVerified == 0 {
+		return errors.New("user was not verified")
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/tabichanorg/tabichan-server/internal/db"
+	"github.com/tabichanorg/tabichan-server/internal/user"
+	"github.com/tabichanorg/tabichan-server/internal/utils"
+)
+
+const (
+	testRPID   = "tabichan.example"
+	testOrigin = "https://tabichan.example"
+	testUserID = "user-1"
+)
+
+// testAuthenticator is a passkey authenticator in software. It answers
+// options the way a browser and platform authenticator would, and its
+// fields can be changed to make it misbehave.
+type testAuthenticator struct {
+	alg          int
+	ecKey        *ecdsa.PrivateKey
+	edKey        ed25519.PrivateKey
+	credentialID []byte
+	signCount    uint32
+
+	rpID   string
+	origin string
+	flags  byte
+}
+
+func newTestAuthenticator(t *testing.T, alg int) *testAuthenticator {
+	a := &testAuthenticator{
+		alg:          alg,
+		credentialID: make([]byte, 16),
+		rpID:         testRPID,
+		origin:       testOrigin,
+		flags:        flagUserPresent | flagUserVerified,
+	}
+	if _, err := rand.Read(a.credentialID); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	switch alg {
+	case algES256:
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case algEdDSA:
+		_, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// coseKey encodes the public key as a COSE_Key.
+func (a *testAuthenticator) coseKey(t *testing.T) []byte {
+	if a.alg == algEdDSA {
+		return cborMap(
+			cborInt(1), cborInt(1),
+			cborInt(3), cborInt(algEdDSA),
+			cborInt(-1), cborInt(6),
+			cborInt(-2), cborBytes(a.edKey.Public().(ed25519.PublicKey)),
+		)
+	}
+
+	public, err := a.ecKey.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The uncompressed point is 0x04 followed by X and Y.
+	point := public.Bytes()
+	return cborMap(
+		cborInt(1), cborInt(2),
+		cborInt(3), cborInt(algES256),
+		cborInt(-1), cborInt(1),
+		cborInt(-2), cborBytes(point[1:33]),
+		cborInt(-3), cborBytes(point[33:]),
+	)
+}
+
+func (a *testAuthenticator) authData(extra []byte, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, extra...)
+}
+
+func (a *testAuthenticator) clientData(t *testing.T, ceremonyType string, challenge []byte) []byte {
+	data, err := json.Marshal(clientData{
+		Type:      ceremonyType,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// register answers BeginRegistration with a "none" attestation.
+func (a *testAuthenticator) register(t *testing.T, options *CreationOptions) RegistrationCredential {
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, a.coseKey(t)...)
+
+	attestationObject := cborMap(
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(),
+		cborText("authData"), cborBytes(a.authData(attested, a.flags|flagAttestedData)),
+	)
+
+	return RegistrationCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  "public-key",
+		Response: AttestationResponse{
+			ClientDataJSON:    a.clientData(t, "webauthn.create", options.Challenge),
+			AttestationObject: attestationObject,
+			Transports:        []string{"internal"},
+		},
+	}
+}
+
+// login answers BeginLogin, counting the signature first.
+func (a *testAuthenticator) login(t *testing.T, options *RequestOptions) AssertionCredential {
+	a.signCount++
+	authData := a.authData(nil, a.flags)
+	clientDataJSON := a.clientData(t, "webauthn.get", options.Challenge)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	var signature []byte
+	if a.alg == algEdDSA {
+		signature = ed25519.Sign(a.edKey, signed)
+	} else {
+		digest := sha256.Sum256(signed)
+		var err error
+		if signature, err = ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return AssertionCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  "public-key",
+		Response: AssertionResponse{
+			ClientDataJSON:    clientDataJSON,
+			AuthenticatorData: authData,
+			Signature:         signature,
+			UserHandle:        []byte(testUserID),
+		},
+	}
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+}
+
+func cborInt(v int64) []byte {
+	if v < 0 {
+		return cborHead(1, uint64(-1-v))
+	}
+	return cborHead(0, uint64(v))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, uint64(len(b))), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, uint64(len(s))), s...)
+}
+
+// cborMap encodes alternating keys and values as a map.
+func cborMap(items ...[]byte) []byte {
+	encoded := cborHead(5, uint64(len(items)/2))
+	for _, item := range items {
+		encoded = append(encoded, item...)
+	}
+	return encoded
+}
+
+func newTestService(t *testing.T) *WebAuthnService {
+	tokens, err := utils.LoadJWTKeySet("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := user.NewMemoryUserRepository(db.NewMemoryTable[utils.Session](), db.NewMemoryTable[utils.RevokedToken]())
+	if err := repo.CreateUser(user.UserLogin{UserID: testUserID, Username: "traveller", Email: "traveller@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &WebAuthnService{
+		RPID:    testRPID,
+		RPName:  "tabichan",
+		Origins: []string{testOrigin},
+		Repo:    NewMemoryWebAuthnRepository(),
+		Users:   &user.UserService{Repo: repo, Tokens: tokens, Hasher: &utils.BcryptHasher{Cost: 4}},
+	}
+}
+
+func register(t *testing.T, s *WebAuthnService, authenticator *testAuthenticator) (*user.WebAuthnCredential, error) {
+	options, err := s.BeginRegistration(testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.FinishRegistration(testUserID, "Laptop", authenticator.register(t, options))
+}
+
+func login(t *testing.T, s *WebAuthnService, authenticator *testAuthenticator) (*user.LoginRequestResponse, error) {
+	options, err := s.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.FinishLogin(authenticator.login(t, options), "test", false)
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	for name, alg := range map[string]int{"ES256": algES256, "Ed25519": algEdDSA} {
+		t.Run(name, func(t *testing.T) {
+			s := newTestService(t)
+			authenticator := newTestAuthenticator(t, alg)
+
+			stored, err := register(t, s, authenticator)
+			if err != nil {
+				t.Fatalf("register: %v", err)
+			}
+			if stored.Algorithm != alg || stored.UserID != testUserID || stored.Name != "Laptop" {
+				t.Errorf("stored %+v", stored)
+			}
+
+			for i := range 2 {
+				response, err := login(t, s, authenticator)
+				if err != nil {
+					t.Fatalf("login %d: %v", i, err)
+				}
+				if response.Session == nil || response.Session.UserID != testUserID {
+					t.Fatalf("login %d: got %+v", i, response)
+				}
+			}
+
+			credential, err := s.Users.GetWebAuthnCredential(stored.CredentialID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if credential.SignCount != 2 {
+				t.Errorf("sign count is %d, want 2", credential.SignCount)
+			}
+		})
+	}
+}
+
+func TestFinishRegistrationRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(*testAuthenticator)
+		want   error
+	}{
+		{"wrong origin", func(a *testAuthenticator) { a.origin = "https://evil.example" }, ErrInvalidChallenge},
+		{"wrong rpIdHash", func(a *testAuthenticator) { a.rpID = "evil.example" }, ErrInvalidAttestation},
+		{"user not verified", func(a *testAuthenticator) { a.flags = flagUserPresent }, ErrInvalidAttestation},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestService(t)
+			authenticator := newTestAuthenticator(t, algES256)
+			test.tamper(authenticator)
+
+			if _, err := register(t, s, authenticator); !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+			if credentials, _ := s.Users.GetWebAuthnCredentials(testUserID); len(credentials) != 0 {
+				t.Errorf("stored %d passkeys, want none", len(credentials))
+			}
+		})
+	}
+}
+
+func TestFinishRegistrationChallengeReplay(t *testing.T) {
+	s := newTestService(t)
+	authenticator := newTestAuthenticator(t, algEdDSA)
+
+	options, err := s.BeginRegistration(testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential := authenticator.register(t, options)
+	if _, err := s.FinishRegistration(testUserID, "Laptop", credential); err != nil {
+		t.Fatalf("first answer: %v", err)
+	}
+
+	other := newTestAuthenticator(t, algEdDSA)
+	if _, err := s.FinishRegistration(testUserID, "Phone", other.register(t, options)); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("replayed challenge: got %v, want %v", err, ErrInvalidChallenge)
+	}
+}
+
+func TestFinishLoginRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(*testAuthenticator)
+		want   error
+	}{
+		{"wrong origin", func(a *testAuthenticator) { a.origin = "https://evil.example" }, ErrInvalidChallenge},
+		{"wrong rpIdHash", func(a *testAuthenticator) { a.rpID = "evil.example" }, ErrInvalidAssertion},
+		{"user not verified", func(a *testAuthenticator) { a.flags = flagUserPresent }, ErrInvalidAssertion},
+		{"sign count went back", func(a *testAuthenticator) { a.signCount = 0 }, user.ErrSignCountMismatch},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestService(t)
+			authenticator := newTestAuthenticator(t, algES256)
+			if _, err := register(t, s, authenticator); err != nil {
+				t.Fatalf("register: %v", err)
+			}
+			if _, err := login(t, s, authenticator); err != nil {
+				t.Fatalf("first login: %v", err)
+			}
+			test.tamper(authenticator)
+
+			if _, err := login(t, s, authenticator); !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestFinishLoginChallengeReplay(t *testing.T) {
+	s := newTestService(t)
+	authenticator := newTestAuthenticator(t, algES256)
+	if _, err := register(t, s, authenticator); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	options, err := s.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion := authenticator.login(t, options)
+	if _, err := s.FinishLogin(assertion, "test", false); err != nil {
+		t.Fatalf("first answer: %v", err)
+	}
+
+	// The same assertion again, and a fresh one for the used challenge.
+	if _, err := s.FinishLogin(assertion, "test", false); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("replayed assertion: got %v, want %v", err, ErrInvalidChallenge)
+	}
+	if _, err := s.FinishLogin(authenticator.login(t, options), "test", false); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("replayed challenge: got %v, want %v", err, ErrInvalidChallenge)
+	}
+}